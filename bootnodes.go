@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Errors
+var (
+	ErrorUnknownNetwork = errors.New("Unknown network")
+	ErrorNoBootnodes    = errors.New("No bootnode responded")
+)
+
+// Bootnodes of the public networks, as published by go-ethereum.
+var networkBootnodes = map[string][]string{
+	"mainnet": {
+		"enode://d860a01f9722d78051619d1e2351aba3f43f943f6f00718d1b9baa4101932a1f5011f16bb2b1bb35db20d6fe28fa0bf09636d26a87d31de9ec6203eeedb1f666@18.138.108.67:30303", // bootnode-aws-ap-southeast-1-001
+		"enode://22a8232c3abc76a16ae9d6c3b164f98775fe226f0917b0ca871128a74a8e9630b458460865bab457221f1d448dd9791d24c4e5d88786180ac185df813a68d4de@3.209.45.79:30303",   // bootnode-aws-us-east-1-001
+		"enode://2b252ab6a1d0f971d9722cb839a42cb81db019ba44c08754628ab4a823487071b5695317c8ccd085219c3a03af063495b2f1da8d18218da2d6a82981b45e6ffc@65.108.70.101:30303", // bootnode-hetzner-hel
+		"enode://4aeb4ab6c14b23e2c4cfdce879c04b0748a20d8e9b59e25ded2a08143e265c6c25936e74cbc8e641e3312ca288673d91f2f93f8e277de3cfa444ecdaaf982052@157.90.35.166:30303", // bootnode-hetzner-fsn
+	},
+	"sepolia": {
+		"enode://4e5e92199ee224a01932a377160aa432f31d0b351f84ab413a8e0a42f4f36476f8fb1cbe914af0d9aef0d51665c214cf653c651c4bbd9d5550a934f241f1682b@138.197.51.181:30303", // sepolia-bootnode-1-nyc3
+		"enode://143e11fb766781d22d92a2e33f8f104cddae4411a122295ed1fdb6638de96a6ce65f5b7c964ba3763bba27961738fef7d3ecc739268f3e5e771fb4c87b6234ba@146.190.1.103:30303",  // sepolia-bootnode-1-sfo3
+		"enode://8b61dc2d06c3f96fddcbebb0efb29d60d3598650275dc469c22229d3e5620369b0d3dedafd929835fe7f489618f19f456fe7c0df572bf2d914a9f4e006f783a9@170.64.250.88:30303",  // sepolia-bootnode-1-syd1
+		"enode://10d62eff032205fcef19497f35ca8477bea0eadfff6d769a147e895d8b2b8f8ae6341630c645c30f5df6e67547c03494ced3d9c5764e8622a26587b083b028e8@139.59.49.206:30303",  // sepolia-bootnode-1-blr1
+		"enode://9e9492e2e8836114cc75f5b929784f4f46c324ad01daf87d956f98b3b6c5fcba95524d6e5cf9861dc96a2c8a171ea7105bb554a197455058de185fa870970c7c@138.68.123.152:30303", // sepolia-bootnode-1-ams3
+	},
+	"holesky": {
+		"enode://ac906289e4b7f12df423d654c5a962b6ebe5b3a74cc9e06292a85221f9a64a6f1cfdd6b714ed6dacef51578f92b34c60ee91e9ede9c7f8fadc4d347326d95e2b@146.190.13.128:30303",
+		"enode://a3435a0155a3e837c02f5e7f5662a2f1fbc25b48e4dc232016e1c51b544cb5b4510ef633ea3278c0e970fa8ad8141e2d4d0f9f95456c537ff05fdf9b31c15072@178.128.136.233:30303",
+	},
+}
+
+func NetworkBootnodes(network string) ([]string, error) {
+	urls, ok := networkBootnodes[network]
+
+	if !ok {
+		return nil, ErrorUnknownNetwork
+	}
+
+	return urls, nil
+}
+
+// SelectBootnodes returns the nodes given as comma separated URLs or, if
+// there are none, the bootnodes of the named network.
+func SelectBootnodes(network, urls string) ([]*Enode, error) {
+	list, err := NetworkBootnodes(network)
+
+	if urls != "" {
+		list, err = strings.Split(urls, ","), nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to select bootnodes: %w", err)
+	}
+
+	nodes, err := ParseNodes(list)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse bootnodes: %w", err)
+	}
+
+	return nodes, nil
+}
+
+// ParseNode parses a node given either as enode:// URL or as enr: text record.
+func ParseNode(nodeUrl string) (*Enode, error) {
+	if strings.HasPrefix(nodeUrl, "enr:") {
+		record, err := ParseENRURL(nodeUrl)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return EnodeFromENR(record)
+	}
+
+	return ParseEnode(nodeUrl)
+}
+
+func ParseNodes(nodeUrls []string) ([]*Enode, error) {
+	var nodes []*Enode
+
+	for _, nodeUrl := range nodeUrls {
+		node, err := ParseNode(strings.TrimSpace(nodeUrl))
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, nodeUrl)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
+
+// ParseENRURL decodes and verifies a record in its "enr:" text form, which is
+// the URL safe base64 encoding of its RLP without padding.
+func ParseENRURL(enrUrl string) (*ENR, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(enrUrl, "enr:"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := DecodeENR(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = record.Verify()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func EnodeFromENR(record *ENR) (*Enode, error) {
+	id, err := record.NodeId()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// IPv4 is preferred since more nodes can reach it.
+	if record.IP() != nil && record.UdpPort() != 0 {
+		return &Enode{
+			id:      string(id),
+			host:    record.IP().String(),
+			udpPort: strconv.Itoa(record.UdpPort()),
+			tcpPort: strconv.Itoa(record.TcpPort()),
+			record:  record,
+		}, nil
+	}
+
+	if record.IP6() != nil && record.Udp6Port() != 0 {
+		return &Enode{
+			id:      string(id),
+			host:    record.IP6().String(),
+			udpPort: strconv.Itoa(record.Udp6Port()),
+			tcpPort: strconv.Itoa(record.Tcp6Port()),
+			record:  record,
+		}, nil
+	}
+
+	return nil, ErrorInvalidENR
+}
+
+// Bootstrap pings the bootnodes concurrently and returns those that
+// responded. Responding bootnodes are added to the server's table.
+func Bootstrap(ctx context.Context, s Server, bootnodes []*Enode) ([]*Enode, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var alive []*Enode
+
+	for _, node := range bootnodes {
+		wg.Add(1)
+		go func(node *Enode) {
+			defer wg.Done()
+
+			remote, err := node.RemoteNode()
+
+			if err == nil {
+				_, err = s.Ping(ctx, remote)
+			}
+
+			if err != nil {
+				fmt.Println("Bootnode did not respond", node.host, err)
+				return
+			}
+
+			mu.Lock()
+			alive = append(alive, node)
+			mu.Unlock()
+		}(node)
+	}
+
+	wg.Wait()
+
+	if len(alive) == 0 {
+		return nil, ErrorNoBootnodes
+	}
+
+	return alive, nil
+}
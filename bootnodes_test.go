@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestNetworkBootnodes(t *testing.T) {
+	for _, network := range []string{"mainnet", "sepolia", "holesky"} {
+		urls, err := NetworkBootnodes(network)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ParseNodes(urls); err != nil {
+			t.Error("Invalid bootnode for", network, err)
+		}
+	}
+
+	if _, err := NetworkBootnodes("ropsten"); err != ErrorUnknownNetwork {
+		t.Error("Expected unknown network")
+	}
+}
+
+func TestParseENRURL(t *testing.T) {
+	// Example record from EIP-778.
+	node, err := ParseNode("enr:-IS4QHCYrYZbAKWCBRlAy5zzaDZXJBGkcnh4MHcBFZntXNFrdvJjX04jRzjzCBOonrkTfj499SZuOh8R33Ls8RRcy5wBgmlkgnY0gmlwhH8AAAGJc2VjcDI1NmsxoQPKY0yuDUmstAHYpMa2_oxVtw0RW_QAdpzBQA8yWM0xOIN1ZHCCdl8")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if node.host != "127.0.0.1" || node.udpPort != "30303" || node.record.Seq() != 1 {
+		t.Error("Unexpected node", node.host, node.udpPort)
+	}
+
+	if _, err := ParseNode("enr:-IS4QHCYrYZbAKWCBRlAy5zzaDZXJBGkcnh4MHcBFZntXNFrdvJjX04jRzjzCBOonrkTfj499SZuOh8R33Ls8RRcy5wBgmlkgnY0gmlwhH8AAAKJc2VjcDI1NmsxoQPKY0yuDUmstAHYpMa2_oxVtw0RW_QAdpzBQA8yWM0xOIN1ZHCCdl8"); err == nil {
+		t.Error("Expected record with tampered ip to fail verification")
+	}
+}
+
+func TestParseInvalidEnode(t *testing.T) {
+	if _, err := ParseNodes([]string{"enode://1234@127.0.0.1:30303"}); err == nil {
+		t.Error("Expected error for short node id")
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	alive, aliveNode := startTestServer(t)
+
+	// Nothing answers on this socket.
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer silent.Close()
+
+	deadNode, _ := NewLocalNode()
+	bootnodes := []*Enode{
+		NewEnode(aliveNode.GetId(), remoteNodeOf(alive).address, 0),
+		NewEnode(deadNode.GetId(), silent.LocalAddr().(*net.UDPAddr), 0),
+	}
+
+	localNode, _ := NewLocalNode()
+	server, err := NewServer("127.0.0.1:0", localNode, Config{Bootnodes: bootnodes})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	defer server.Close()
+
+	responded, err := Bootstrap(context.Background(), server, bootnodes)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(responded) != 1 || responded[0] != bootnodes[0] {
+		t.Error("Expected only the live bootnode to respond")
+	}
+}
+
+func TestBootnodeAdvertisedIP(t *testing.T) {
+	if _, err := advertisedIP("0.0.0.0:30301", ""); err != ErrorNoExternalIP {
+		t.Error("Expected wildcard address without --extip to be refused", err)
+	}
+
+	if _, err := advertisedIP(":30301", ""); err != ErrorNoExternalIP {
+		t.Error("Expected empty host without --extip to be refused", err)
+	}
+
+	if ip, err := advertisedIP("0.0.0.0:30301", "203.0.113.7"); err != nil || !ip.Equal(net.ParseIP("203.0.113.7")) {
+		t.Error("Unexpected external IP", ip, err)
+	}
+
+	if ip, err := advertisedIP("10.0.0.1:30301", ""); err != nil || ip != nil {
+		t.Error("Expected a specific address to be advertised as is", ip, err)
+	}
+
+	if _, err := advertisedIP("0.0.0.0:30301", "not-an-ip"); err == nil {
+		t.Error("Expected invalid --extip to be refused")
+	}
+}
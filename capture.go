@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capture directions
+const (
+	CaptureIn  = "in"
+	CaptureOut = "out"
+)
+
+// Errors
+var (
+	ErrorInvalidCapture = errors.New("Invalid capture record")
+)
+
+// CaptureRecord is one datagram sent or received by a server.
+type CaptureRecord struct {
+	Direction string         `json:"dir"`
+	Time      time.Time      `json:"time"`
+	Peer      netip.AddrPort `json:"peer"`
+	Data      []byte         `json:"data"`
+}
+
+// Capture records the raw traffic of a server to a file, one JSON record per
+// line, so that it can be inspected with `legion pcap dump` and fed back
+// into a server with `legion pcap replay`.
+type Capture struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// CreateCapture creates a capture file, replacing an existing one.
+func CreateCapture(path string) (*Capture, error) {
+	file, err := os.Create(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Capture{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (c *Capture) record(direction string, t time.Time, peer net.Addr, data []byte) {
+	udpAddr, ok := peer.(*net.UDPAddr)
+
+	if !ok {
+		return
+	}
+
+	addr := udpAddr.AddrPort()
+	record := CaptureRecord{
+		Direction: direction,
+		Time:      t,
+		Peer:      netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()),
+		Data:      data,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Losing a record must not take the server down.
+	if err := c.enc.Encode(&record); err != nil {
+		fmt.Println("Failed to write capture record", err)
+	}
+}
+
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.file.Close()
+}
+
+// LoadCapture reads all records of a capture file.
+func LoadCapture(path string) ([]CaptureRecord, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var records []CaptureRecord
+	dec := json.NewDecoder(file)
+
+	for dec.More() {
+		var record CaptureRecord
+
+		if err := dec.Decode(&record); err != nil {
+			return nil, fmt.Errorf("%w %d: %v", ErrorInvalidCapture, len(records)+1, err)
+		}
+
+		if record.Direction != CaptureIn && record.Direction != CaptureOut {
+			return nil, fmt.Errorf("%w %d: direction %q", ErrorInvalidCapture, len(records)+1, record.Direction)
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// captureTransport records everything passing through a transport.
+type captureTransport struct {
+	Transport
+	capture *Capture
+	clock   Clock
+}
+
+func (t *captureTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := t.Transport.ReadFrom(b)
+
+	if err == nil {
+		t.capture.record(CaptureIn, t.clock.Now(), addr, b[:n])
+	}
+
+	return n, addr, err
+}
+
+func (t *captureTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := t.Transport.WriteTo(b, addr)
+
+	if err == nil {
+		t.capture.record(CaptureOut, t.clock.Now(), addr, b)
+	}
+
+	return n, err
+}
+
+// ReplayTransport is a Transport that delivers the received packets of a
+// capture, in order and optionally with their original spacing. Written
+// packets are discarded.
+//
+// Its clock shows the capture time of the packet last delivered, so that a
+// server running on it judges expiration, replays and rates as it did when
+// the packets were captured.
+type ReplayTransport struct {
+	records  []CaptureRecord
+	realtime bool
+	clock    *ManualClock
+	local    *net.UDPAddr
+	done     chan struct{}
+	closed   chan struct{}
+	once     sync.Once
+	last     time.Time
+}
+
+func NewReplayTransport(records []CaptureRecord, local netip.AddrPort, realtime bool) *ReplayTransport {
+	var inbound []CaptureRecord
+	for _, record := range records {
+		if record.Direction == CaptureIn {
+			inbound = append(inbound, record)
+		}
+	}
+
+	start := time.Now()
+
+	if len(inbound) > 0 {
+		start = inbound[0].Time
+	}
+
+	return &ReplayTransport{
+		records:  inbound,
+		realtime: realtime,
+		clock:    NewManualClock(start),
+		local:    net.UDPAddrFromAddrPort(local),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Done is closed once every packet has been delivered.
+func (t *ReplayTransport) Done() <-chan struct{} { return t.done }
+
+// Clock is the capture time of the replay, see Config.Clock.
+func (t *ReplayTransport) Clock() *ManualClock { return t.clock }
+
+func (t *ReplayTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(t.records) == 0 {
+		t.once.Do(func() { close(t.done) })
+		<-t.closed
+		return 0, nil, net.ErrClosed
+	}
+
+	record := t.records[0]
+	t.records = t.records[1:]
+
+	if t.realtime && !t.last.IsZero() {
+		select {
+		case <-time.After(record.Time.Sub(t.last)):
+		case <-t.closed:
+			return 0, nil, net.ErrClosed
+		}
+	}
+
+	t.last = record.Time
+
+	if d := record.Time.Sub(t.clock.Now()); d > 0 {
+		t.clock.Advance(d)
+	}
+
+	return copy(b, record.Data), net.UDPAddrFromAddrPort(record.Peer), nil
+}
+
+func (t *ReplayTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, net.ErrClosed
+	default:
+		return len(b), nil
+	}
+}
+
+func (t *ReplayTransport) LocalAddr() net.Addr { return t.local }
+
+func (t *ReplayTransport) Close() error {
+	select {
+	case <-t.closed:
+	default:
+		close(t.closed)
+	}
+
+	return nil
+}
+
+// DescribePacket renders a datagram in readable form.
+func DescribePacket(data []byte) string {
+	packet, err := DecodePacket(data)
+
+	if err != nil {
+		return fmt.Sprintf("INVALID (%v) %d bytes %s", err, len(data), hex.EncodeToString(data))
+	}
+
+	return describeDecodedPacket(packet)
+}
+
+func describeDecodedPacket(packet *Packet[any]) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s from %x hash %x", packetTypeName(packet.header.packetType),
+		packet.header.senderId[:8], packet.header.hash[:8])
+
+	switch data := packet.data.(type) {
+	case *PingPacketData:
+		fmt.Fprintf(&sb, " version %d from %s to %s expiration %d seq %d", data.version,
+			describeEndpoint(data.from), describeEndpoint(data.to), data.expiration, data.enrSeqNum)
+	case *PongPacketData:
+		fmt.Fprintf(&sb, " to %s ping %x expiration %d seq %d", describeEndpoint(data.to),
+			data.pingHash[:8], data.expiration, data.enrSeqNum)
+	case *FindNodePacketData:
+		fmt.Fprintf(&sb, " target %x expiration %d", data.target[:8], data.expiration)
+	case *NeighborsPacketData:
+		fmt.Fprintf(&sb, " expiration %d nodes %d", data.expiration, len(data.nodes))
+
+		for _, node := range data.nodes {
+			fmt.Fprintf(&sb, "\n    %x %s tcp %d", node.id[:8],
+				netip.AddrPortFrom(node.ip, node.udpPort), node.tcpPort)
+		}
+	case *ENRRequestPacketData:
+		fmt.Fprintf(&sb, " expiration %d", data.expiration)
+	case *ENRResponsePacketData:
+		fmt.Fprintf(&sb, " request %x record %s", data.requestHash[:8], data.record.URL())
+	}
+
+	return sb.String()
+}
+
+func describeEndpoint(e Endpoint) string {
+	return fmt.Sprintf("%s tcp %d", e.UDPAddr(), e.tcpPort)
+}
+
+func packetTypeName(t PacketType) string {
+	switch t {
+	case PingPacketType:
+		return "PING"
+	case PongPacketType:
+		return "PONG"
+	case FindNodePacketType:
+		return "FINDNODE"
+	case NeighborsPacketType:
+		return "NEIGHBORS"
+	case ENRRequestPacketType:
+		return "ENRREQUEST"
+	case ENRResponsePacketType:
+		return "ENRRESPONSE"
+	}
+
+	return fmt.Sprintf("TYPE %d", t)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startCapturingServer(t *testing.T, path string) Server {
+	capture, err := CreateCapture(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localNode, _ := NewLocalNode()
+	server, err := NewServer("127.0.0.1:0", localNode, Config{Capture: capture})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	t.Cleanup(func() {
+		server.Close()
+		capture.Close()
+	})
+
+	return server
+}
+
+func TestCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	server := startCapturingServer(t, path)
+	target, _ := startTestServer(t)
+
+	if _, err := server.Ping(context.Background(), remoteNodeOf(target)); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Close()
+	records, err := LoadCapture(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := remoteNodeOf(target).address.AddrPort()
+	want := []struct{ direction, packet string }{{CaptureOut, "PING"}, {CaptureIn, "PONG"}}
+
+	// The target pings back after answering, which may follow.
+	if len(records) < len(want) {
+		t.Fatal("Expected ping and pong to be captured", records)
+	}
+
+	for i, w := range want {
+		record := records[i]
+
+		if record.Direction != w.direction || record.Peer.Port() != peer.Port() ||
+			!strings.HasPrefix(DescribePacket(record.Data), w.packet) {
+			t.Error("Unexpected record", record.Direction, record.Peer, DescribePacket(record.Data))
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	target := startCapturingServer(t, path)
+	server, _ := startTestServer(t)
+
+	if _, err := server.Ping(context.Background(), remoteNodeOf(target)); err != nil {
+		t.Fatal(err)
+	}
+
+	target.Close()
+	records, err := LoadCapture(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying the received ping into a new server makes it answer again.
+	transport := NewReplayTransport(records, netip.MustParseAddrPort("127.0.0.1:30303"), false)
+	replayPath := filepath.Join(t.TempDir(), "replay.jsonl")
+	capture, err := CreateCapture(replayPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer capture.Close()
+
+	localNode, _ := NewLocalNode()
+	replay, err := NewServerWithTransport(transport, localNode, Config{
+		Clock:   transport.Clock(),
+		Capture: capture,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replay.Start(context.Background())
+	defer replay.Close()
+	<-transport.Done()
+
+	// Records are written as packets pass, so the pong shows up in the file
+	// once it has been sent.
+	for i := 0; i < 100; i++ {
+		replayed, err := LoadCapture(replayPath)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, record := range replayed {
+			if record.Direction == CaptureOut && strings.HasPrefix(DescribePacket(record.Data), "PONG") {
+				return
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Error("Expected replayed ping to be answered")
+}
+
+func TestReplayNode(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	path := filepath.Join(t.TempDir(), "node.key")
+
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(localNode.GetPrivKeyBytes())), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A replay can run as the captured node, but does not create its key.
+	if node, err := replayNode(path); err != nil || !bytes.Equal(node.GetId(), localNode.GetId()) {
+		t.Error("Expected the captured node's key", err)
+	}
+
+	if _, err := replayNode(path + ".missing"); !os.IsNotExist(err) {
+		t.Error("Expected missing key to be an error", err)
+	}
+
+	if node, err := replayNode(""); err != nil || bytes.Equal(node.GetId(), localNode.GetId()) {
+		t.Error("Expected a new key", err)
+	}
+}
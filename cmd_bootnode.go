@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+// Errors
+var (
+	ErrorNoExternalIP = errors.New("A bootnode listening on a wildcard address needs --extip")
+)
+
+// runBootnode runs a discovery-only node with a persistent identity, meant as
+// the entry point of private networks.
+func runBootnode(args []string) error {
+	flags := flag.NewFlagSet("legion bootnode", flag.ExitOnError)
+	serverAddress := flags.String("addr", "0.0.0.0:30301", "IP:Port to listen on")
+	extIP := flags.String("extip", "", "IP address advertised to other nodes. Required with a wildcard --addr")
+	nodeKeyPath := flags.String("nodekey", "bootnode.key", "Private key file. Created if missing")
+	nodeDBPath := flags.String("nodedb", "", "Path of the node database. In-memory if empty")
+	netrestrict := flags.String("netrestrict", "", "Comma separated CIDR masks of the networks to serve")
+	capturePath := flags.String("capture", "", "File to record all traffic to")
+	discovery := flags.String("discovery", "v4", "Discovery versions to serve: v4, v5 or v4,v5")
+	flags.Parse(args)
+
+	netlist, err := ParseNetlist(*netrestrict)
+
+	if err != nil {
+		return fmt.Errorf("Invalid --netrestrict: %w", err)
+	}
+
+	externalIP, err := advertisedIP(*serverAddress, *extIP)
+
+	if err != nil {
+		return err
+	}
+
+	localNode, err := LoadOrCreateNodeKey(*nodeKeyPath)
+
+	if err != nil {
+		return fmt.Errorf("Failed to load node key: %w", err)
+	}
+
+	nodeDB, err := OpenNodeDB(*nodeDBPath, systemClock{})
+
+	if err != nil {
+		return fmt.Errorf("Failed to open node database: %w", err)
+	}
+
+	capture, err := openCapture(*capturePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer closeCapture(capture)
+
+	server, v5Server, err := newDiscoveryServers(*discovery, *serverAddress, localNode, Config{
+		ExternalIP:  externalIP,
+		NodeDB:      nodeDB,
+		NetRestrict: netlist,
+		Capture:     capture,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if server != nil {
+		server.Start(ctx)
+
+		// A bootnode has no devp2p listener, so like geth's bootnode it gives
+		// its UDP port as the enode port.
+		port := strconv.Itoa(server.GetUdpPort())
+		self := &Enode{id: string(localNode.GetId()), host: server.GetIP(), udpPort: port, tcpPort: port}
+
+		fmt.Println(self.URL())
+	}
+
+	// discv5 nodes are bootstrapped from records.
+	if v5Server != nil {
+		v5Server.Start(ctx)
+		fmt.Println(v5Server.Self().URL())
+	}
+
+	<-ctx.Done()
+	return shutdown(v5Server, server)
+}
+
+// advertisedIP parses the --extip of a bootnode. A bootnode is useless to
+// other hosts if it advertises loopback, so a wildcard listen address must
+// come with one.
+func advertisedIP(listenAddress, extIP string) (net.IP, error) {
+	if extIP != "" {
+		ip := net.ParseIP(extIP)
+
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid --extip: %s", extIP)
+		}
+
+		return ip, nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", listenAddress)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		return nil, ErrorNoExternalIP
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// Errors
+var (
+	ErrorUsage       = errors.New("Usage: legion test discv4 [flags] <enode>")
+	ErrorTestsFailed = errors.New("Conformance tests failed")
+)
+
+// runTest runs the conformance tests of a protocol against a target node.
+func runTest(args []string) error {
+	if len(args) == 0 || args[0] != "discv4" {
+		return ErrorUsage
+	}
+
+	flags := flag.NewFlagSet("legion test discv4", flag.ExitOnError)
+	timeout := flags.Duration("timeout", defaultConformanceTimeout, "How long to wait for replies")
+	flags.Parse(args[1:])
+
+	if flags.NArg() != 1 {
+		return ErrorUsage
+	}
+
+	target, err := ParseNode(flags.Arg(0))
+
+	if err != nil {
+		return fmt.Errorf("Invalid target: %w", err)
+	}
+
+	results, err := RunDiscv4Conformance(target, *timeout)
+
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", result.Name, result.Err)
+		} else {
+			fmt.Printf("PASS %s\n", result.Name)
+		}
+	}
+
+	fmt.Printf("%d/%d passed\n", len(results)-failed, len(results))
+
+	if failed > 0 {
+		return ErrorTestsFailed
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runCrawl crawls the network for a while and merges every node it reaches
+// into a JSON node set, which later runs re-check. The set always keeps every
+// node; --filter only selects what is written to --filtered-out.
+func runCrawl(args []string) error {
+	flags := flag.NewFlagSet("legion crawl", flag.ExitOnError)
+	serverAddress := flags.String("ip", "0.0.0.0:0", "IP:Port for the server")
+	outPath := flags.String("out", "nodes.json", "Node set to update")
+	duration := flags.Duration("duration", 30*time.Minute, "How long to crawl. 0 only filters the node set")
+	filter := flags.String("filter", "", "Comma separated ENR keys or key=hex values the filtered nodes must have, e.g. eth=<fork hash>")
+	filteredPath := flags.String("filtered-out", "", "Node set to write the nodes passing --filter to. Their records are printed if empty")
+	bootnodeUrls := flags.String("bootnodes", "", "Comma separated enode or ENR URLs. Overrides --network")
+	network := flags.String("network", "mainnet", "Network whose bootnodes to use: mainnet, sepolia or holesky")
+	flags.Parse(args)
+
+	check, err := ParseNodeFilter(*filter)
+
+	if err != nil {
+		return fmt.Errorf("Invalid --filter: %w", err)
+	}
+
+	nodes, err := LoadNodeSet(*outPath)
+
+	if err != nil {
+		return fmt.Errorf("Failed to load node set: %w", err)
+	}
+
+	if *duration > 0 {
+		if err := crawl(nodes, *serverAddress, *network, *bootnodeUrls, *duration); err != nil {
+			return err
+		}
+	}
+
+	if *filter == "" {
+		check = nil
+	}
+
+	return writeCrawlResults(nodes, *outPath, *filteredPath, check, os.Stdout)
+}
+
+// writeCrawlResults writes the whole node set back to outPath. If check is
+// set, the nodes passing it are also written to filteredPath, or their
+// records to w if filteredPath is empty.
+func writeCrawlResults(nodes NodeSet, outPath, filteredPath string, check func(*ENR) bool, w io.Writer) error {
+	if err := nodes.Write(outPath); err != nil {
+		return fmt.Errorf("Failed to write node set: %w", err)
+	}
+
+	fmt.Println("Wrote nodes", len(nodes))
+
+	if check == nil {
+		return nil
+	}
+
+	filtered := nodes.Filter(check)
+
+	if filteredPath == "" {
+		for _, entry := range filtered {
+			fmt.Fprintln(w, entry.Record)
+		}
+
+		return nil
+	}
+
+	if err := filtered.Write(filteredPath); err != nil {
+		return fmt.Errorf("Failed to write filtered node set: %w", err)
+	}
+
+	fmt.Println("Wrote filtered nodes", len(filtered))
+	return nil
+}
+
+func crawl(nodes NodeSet, serverAddress, network, bootnodeUrls string, duration time.Duration) error {
+	bootnodes, err := SelectBootnodes(network, bootnodeUrls)
+
+	if err != nil {
+		return err
+	}
+
+	localNode, err := NewLocalNode()
+
+	if err != nil {
+		return err
+	}
+
+	server, err := NewServer(serverAddress, localNode, Config{Bootnodes: bootnodes})
+
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server.Start(ctx)
+
+	if _, err := Bootstrap(ctx, server, bootnodes); err != nil {
+		fmt.Println("Failed to bootstrap", err)
+	}
+
+	// An interrupted crawl still writes what it found.
+	crawlCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	server.(*serverImpl).Crawl(crawlCtx, nodes)
+	return shutdown(server)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Errors
+var (
+	ErrorPcapUsage   = errors.New("Usage: legion pcap dump <file> | legion pcap replay [flags] <file>")
+	ErrorEmptyReplay = errors.New("Capture has no received packets to replay")
+)
+
+// openCapture creates a capture file, or returns nil if no path is given.
+func openCapture(path string) (*Capture, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	capture, err := CreateCapture(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create capture: %w", err)
+	}
+
+	return capture, nil
+}
+
+func closeCapture(capture *Capture) {
+	if capture == nil {
+		return
+	}
+
+	if err := capture.Close(); err != nil {
+		fmt.Println("Failed to close capture", err)
+	}
+}
+
+// runPcap inspects and replays traffic captured with --capture.
+func runPcap(args []string) error {
+	if len(args) == 0 {
+		return ErrorPcapUsage
+	}
+
+	switch args[0] {
+	case "dump":
+		return runPcapDump(args[1:])
+	case "replay":
+		return runPcapReplay(args[1:])
+	}
+
+	return ErrorPcapUsage
+}
+
+func runPcapDump(args []string) error {
+	if len(args) != 1 {
+		return ErrorPcapUsage
+	}
+
+	records, err := LoadCapture(args[0])
+
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		arrow := "<-"
+
+		if record.Direction == CaptureOut {
+			arrow = "->"
+		}
+
+		fmt.Printf("%s %s %s %s\n", record.Time.Format("15:04:05.000000"), arrow, record.Peer,
+			DescribePacket(record.Data))
+	}
+
+	return nil
+}
+
+// runPcapReplay feeds the received packets of a capture into a fresh server,
+// e.g. to reproduce a crash. Replies go nowhere, but can be recorded.
+//
+// Only received requests are handled. The server has none of the captured
+// node's requests pending, so the replies to them in the capture are dropped
+// as unsolicited. With the captured node's key the server at least signs its
+// answers the way the captured node did, which makes the two captures
+// comparable.
+func runPcapReplay(args []string) error {
+	flags := flag.NewFlagSet("legion pcap replay", flag.ExitOnError)
+	serverAddress := flags.String("addr", "127.0.0.1:30303", "Address the server pretends to listen on")
+	realtime := flags.Bool("realtime", false, "Keep the original spacing between packets")
+	capturePath := flags.String("capture", "", "File to record the replayed traffic to")
+	nodeKeyPath := flags.String("nodekey", "", "Private key file of the captured node. A new key by default")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return ErrorPcapUsage
+	}
+
+	address, err := netip.ParseAddrPort(*serverAddress)
+
+	if err != nil {
+		return fmt.Errorf("Invalid --addr: %w", err)
+	}
+
+	records, err := LoadCapture(flags.Arg(0))
+
+	if err != nil {
+		return err
+	}
+
+	transport := NewReplayTransport(records, address, *realtime)
+
+	if len(transport.records) == 0 {
+		return ErrorEmptyReplay
+	}
+
+	capture, err := openCapture(*capturePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer closeCapture(capture)
+
+	localNode, err := replayNode(*nodeKeyPath)
+
+	if err != nil {
+		return err
+	}
+
+	// The server runs at capture time, so packets that expired long ago are
+	// judged as they were when received, however fast they are replayed.
+	server, err := NewServerWithTransport(transport, localNode, Config{
+		Clock:   transport.Clock(),
+		Capture: capture,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server.Start(ctx)
+
+	select {
+	case <-transport.Done():
+		// Give the server time to handle the last packets.
+		time.Sleep(replyTimeout)
+	case <-ctx.Done():
+	}
+
+	fmt.Printf("%+v\n", server.Stats())
+	return shutdown(server)
+}
+
+// replayNode loads the key a replay runs with, or creates one if no path is
+// given.
+func replayNode(nodeKeyPath string) (LocalNode, error) {
+	if nodeKeyPath == "" {
+		return NewLocalNode()
+	}
+
+	return LoadNodeKey(nodeKeyPath)
+}
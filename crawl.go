@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Nodes checked concurrently by a crawl.
+	crawlWorkers = 8
+
+	// How long a crawl waits for the previously seen nodes before taking a
+	// node found by a lookup instead.
+	crawlMixTimeout = 100 * time.Millisecond
+)
+
+// Errors
+var (
+	ErrorInvalidNodeFilter = errors.New("Invalid node filter")
+)
+
+// crawlEntry is a node in a NodeSet. Score counts successful checks and is
+// halved by every failed one; nodes whose score drops to zero are removed.
+type crawlEntry struct {
+	Record    string    `json:"record"`
+	URL       string    `json:"url"`
+	Score     int       `json:"score"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	LastCheck time.Time `json:"lastCheck"`
+}
+
+// NodeSet is the result of a crawl, keyed by hex encoded node id. It is
+// stored as JSON so that successive crawls can build on each other.
+type NodeSet map[string]*crawlEntry
+
+// LoadNodeSet reads a node set written by Write. A missing file gives an
+// empty set.
+func LoadNodeSet(path string) (NodeSet, error) {
+	data, err := os.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return make(NodeSet), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	set := make(NodeSet)
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+func (set NodeSet) Write(path string) error {
+	data, err := json.MarshalIndent(set, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// Nodes returns the nodes of the set, least recently checked first.
+func (set NodeSet) Nodes() []*Enode {
+	ids := make([]string, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return set[ids[i]].LastCheck.Before(set[ids[j]].LastCheck)
+	})
+
+	var nodes []*Enode
+	for _, id := range ids {
+		node, err := set[id].enode()
+
+		if err == nil {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
+
+// Filter returns the nodes whose record passes check.
+func (set NodeSet) Filter(check func(*ENR) bool) NodeSet {
+	result := make(NodeSet)
+
+	for id, entry := range set {
+		if record, err := ParseENRURL(entry.Record); err == nil && check(record) {
+			result[id] = entry
+		}
+	}
+
+	return result
+}
+
+func (e *crawlEntry) enode() (*Enode, error) {
+	record, err := ParseENRURL(e.Record)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return EnodeFromENR(record)
+}
+
+// Crawl checks the nodes of the set and every node found by random lookups
+// until ctx is done, updating the set as it goes. Checking a node bonds with
+// it and requests its record.
+func (s *serverImpl) Crawl(ctx context.Context, set NodeSet) {
+	mix := NewFairMix(crawlMixTimeout, s.clock)
+	mix.AddSource(NewSliceIterator(set.Nodes()))
+	mix.AddSource(s.RandomNodes())
+
+	it := Dedup(mix)
+	defer it.Close()
+
+	// Closing the iterator unblocks Next once the crawl is over.
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			it.Close()
+		case <-done:
+		}
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan *Enode)
+
+	for i := 0; i < crawlWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for node := range queue {
+				record, err := s.checkNode(ctx, node)
+
+				// An interrupted check says nothing about the node.
+				if ctx.Err() != nil {
+					continue
+				}
+
+				mu.Lock()
+				set.update(node, record, err, s.clock.Now())
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for it.Next() {
+		queue <- it.Node()
+	}
+
+	close(queue)
+	wg.Wait()
+}
+
+func (s *serverImpl) checkNode(ctx context.Context, node *Enode) (*ENR, error) {
+	remote, err := node.RemoteNode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.ensureBond(ctx, node, remote); err != nil {
+		return nil, err
+	}
+
+	record, err := s.RequestENR(ctx, remote)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if id, _ := record.NodeId(); !bytes.Equal(id, []byte(node.id)) {
+		return nil, ErrorInvalidResponse
+	}
+
+	return record, nil
+}
+
+// update records the outcome of checking a node.
+func (set NodeSet) update(node *Enode, record *ENR, err error, now time.Time) {
+	id := hex.EncodeToString([]byte(node.id))
+	entry := set[id]
+
+	if err != nil {
+		// Nodes that never answered are not worth keeping.
+		if entry == nil {
+			return
+		}
+
+		entry.Score /= 2
+		entry.LastCheck = now
+
+		if entry.Score == 0 {
+			delete(set, id)
+		}
+
+		return
+	}
+
+	if entry == nil {
+		entry = &crawlEntry{FirstSeen: now}
+		set[id] = entry
+	}
+
+	// Prefer the endpoint the record announces over the one we reached.
+	if resolved, err := EnodeFromENR(record); err == nil {
+		node = resolved
+	}
+
+	entry.Record = record.URL()
+	entry.URL = node.URL()
+	entry.Score++
+	entry.LastSeen = now
+	entry.LastCheck = now
+}
+
+// ParseNodeFilter parses a comma separated list of record conditions, all of
+// which must hold. A condition is either a key that must be present, or
+// key=value with a hex encoded value. For the eth key the value is matched
+// against the fork hash of the announced fork id.
+func ParseNodeFilter(expr string) (func(*ENR) bool, error) {
+	var checks []func(*ENR) bool
+
+	for _, cond := range strings.Split(expr, ",") {
+		cond = strings.TrimSpace(cond)
+
+		if cond == "" {
+			continue
+		}
+
+		key, value, hasValue := strings.Cut(cond, "=")
+
+		if !hasValue {
+			checks = append(checks, func(r *ENR) bool {
+				_, ok := r.Get(key)
+				return ok
+			})
+			continue
+		}
+
+		want, err := hex.DecodeString(strings.TrimPrefix(value, "0x"))
+
+		if key == "" || err != nil {
+			return nil, ErrorInvalidNodeFilter
+		}
+
+		if key == "eth" {
+			checks = append(checks, func(r *ENR) bool {
+				return forkHash(r) == string(want)
+			})
+			continue
+		}
+
+		checks = append(checks, func(r *ENR) bool {
+			value, ok := enrValue(r, key).(string)
+			return ok && value == string(want)
+		})
+	}
+
+	return func(r *ENR) bool {
+		for _, check := range checks {
+			if !check(r) {
+				return false
+			}
+		}
+
+		return true
+	}, nil
+}
+
+// enrValue returns the value of a record key in decoded RLP form, whichever
+// way the record was created.
+func enrValue(r *ENR, key string) any {
+	value, ok := r.Get(key)
+
+	if !ok {
+		return nil
+	}
+
+	encoded, err := Encode(value)
+
+	if err != nil {
+		return nil
+	}
+
+	decoded, err := Decode(encoded)
+
+	if err != nil {
+		return nil
+	}
+
+	return decoded
+}
+
+// forkHash returns the fork hash of the first entry of a record's eth value,
+// which is a list of [forkHash, forkNext] fork ids.
+func forkHash(r *ENR) string {
+	forkIds, ok := enrValue(r, "eth").([]any)
+
+	if !ok || len(forkIds) == 0 {
+		return ""
+	}
+
+	forkId, ok := forkIds[0].([]any)
+
+	if !ok || len(forkId) == 0 {
+		return ""
+	}
+
+	hash, _ := forkId[0].(string)
+	return hash
+}
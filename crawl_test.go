@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCrawl(t *testing.T) {
+	const numNodes = 6
+
+	network := newSimNetwork(t, SimConfig{Latency: time.Millisecond, Seed: 1})
+	bootnode, bootNode := startSimServer(t, listenSim(t, network, "10.0.0.1:30303"), Config{})
+	bootEnode := NewEnode(bootNode.GetId(), remoteNodeOf(bootnode).address, 0)
+
+	for i := 2; i <= numNodes; i++ {
+		addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 30303)
+		startSimServer(t, listenSim(t, network, addr.String()), Config{Bootnodes: []*Enode{bootEnode}})
+	}
+
+	crawler, _ := startSimServer(t, listenSim(t, network, "10.0.1.1:30303"), Config{Bootnodes: []*Enode{bootEnode}})
+
+	if _, err := Bootstrap(context.Background(), crawler, []*Enode{bootEnode}); err != nil {
+		t.Fatal(err)
+	}
+
+	// With fewer nodes than a bucket every FindNode waits for the reply
+	// timeout, so the first lookup takes a few seconds.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	nodes := make(NodeSet)
+	crawler.(*serverImpl).Crawl(ctx, nodes)
+
+	if len(nodes) < numNodes/2 {
+		t.Fatal("Expected crawl to reach most nodes", len(nodes))
+	}
+
+	for id, entry := range nodes {
+		node, err := entry.enode()
+
+		if err != nil || hex.EncodeToString([]byte(node.id)) != id {
+			t.Error("Expected a valid record for", id, err)
+		}
+
+		if entry.Score != 1 || entry.FirstSeen.IsZero() || entry.LastSeen != entry.LastCheck {
+			t.Error("Unexpected entry", id, entry)
+		}
+	}
+}
+
+func TestCrawlMerge(t *testing.T) {
+	network := newSimNetwork(t, SimConfig{})
+	alive, aliveNode := startSimServer(t, listenSim(t, network, "10.0.0.1:30303"), Config{})
+	crawler, _ := startSimServer(t, listenSim(t, network, "10.0.0.2:30303"), Config{})
+
+	deadNode, _ := NewLocalNode()
+	deadRecord, err := NewENR(1, map[string]any{
+		enrKeyIp:  ipBytes(netip.MustParseAddr("10.0.0.3")),
+		enrKeyUdp: uint(30303),
+	}, deadNode.GetPrivKeyBytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstSeen := time.Now().Add(-time.Hour).UTC()
+	aliveId := hex.EncodeToString(aliveNode.GetId())
+	deadId := hex.EncodeToString(deadNode.GetId())
+
+	nodes := NodeSet{
+		aliveId: {Record: alive.(*serverImpl).record.URL(), Score: 3, FirstSeen: firstSeen},
+		deadId:  {Record: deadRecord.URL(), Score: 4, FirstSeen: firstSeen},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	crawler.(*serverImpl).Crawl(ctx, nodes)
+
+	if entry := nodes[aliveId]; entry == nil || entry.Score != 4 || !entry.FirstSeen.Equal(firstSeen) {
+		t.Error("Expected alive node to gain score and keep its first sighting", entry)
+	}
+
+	if entry := nodes[deadId]; entry == nil || entry.Score != 2 || entry.LastSeen.After(firstSeen) {
+		t.Error("Expected dead node to lose score", entry)
+	}
+}
+
+func TestNodeSetFilter(t *testing.T) {
+	nodes := make(NodeSet)
+
+	for i, pairs := range []map[string]any{
+		{"eth": []any{[]any{"\x01\x02\x03\x04", uint(0)}}, "snap": []any{}},
+		{"eth": []any{[]any{"\x05\x06\x07\x08", uint(0)}}},
+		{},
+	} {
+		localNode, _ := NewLocalNode()
+		pairs[enrKeyIp] = ipBytes(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}))
+		pairs[enrKeyUdp] = uint(30303)
+		record, err := NewENR(1, pairs, localNode.GetPrivKeyBytes())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nodes[hex.EncodeToString(localNode.GetId())] = &crawlEntry{Record: record.URL(), Score: i + 1}
+	}
+
+	path := filepath.Join(t.TempDir(), "nodes.json")
+
+	if err := nodes.Write(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadNodeSet(path)
+
+	if err != nil || len(loaded) != len(nodes) || len(loaded.Nodes()) != len(nodes) {
+		t.Fatal("Expected node set to round trip", len(loaded), err)
+	}
+
+	for expr, expected := range map[string]int{
+		"":                  3,
+		"eth":               2,
+		"eth=01020304":      1,
+		"eth=0x05060708":    1,
+		"eth=ffffffff":      0,
+		"eth,snap":          1,
+		"udp=765f":          3,
+		"eth=01020304,snap": 1,
+	} {
+		check, err := ParseNodeFilter(expr)
+
+		if err != nil {
+			t.Fatal(expr, err)
+		}
+
+		if n := len(loaded.Filter(check)); n != expected {
+			t.Error("Unexpected number of nodes for filter", expr, n)
+		}
+	}
+
+	if _, err := ParseNodeFilter("eth=xyz"); err != ErrorInvalidNodeFilter {
+		t.Error("Expected invalid filter to be rejected", err)
+	}
+}
+
+func TestWriteCrawlResults(t *testing.T) {
+	nodes := make(NodeSet)
+
+	for i, pairs := range []map[string]any{{"eth": []any{}}, {}} {
+		localNode, _ := NewLocalNode()
+		pairs[enrKeyIp] = ipBytes(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}))
+		pairs[enrKeyUdp] = uint(30303)
+		record, _ := NewENR(1, pairs, localNode.GetPrivKeyBytes())
+		nodes[hex.EncodeToString(localNode.GetId())] = &crawlEntry{Record: record.URL(), Score: i + 1}
+	}
+
+	check, _ := ParseNodeFilter("eth")
+	dir := t.TempDir()
+	outPath := filepath.Join(dir, "nodes.json")
+	filteredPath := filepath.Join(dir, "eth.json")
+
+	// Filtering must not drop nodes from the accumulated set.
+	if err := writeCrawlResults(nodes, outPath, filteredPath, check, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded, err := LoadNodeSet(outPath); err != nil || len(loaded) != 2 {
+		t.Error("Expected full node set to be kept", len(loaded), err)
+	}
+
+	if filtered, err := LoadNodeSet(filteredPath); err != nil || len(filtered) != 1 {
+		t.Error("Expected filtered node set", len(filtered), err)
+	}
+
+	var out bytes.Buffer
+
+	if err := writeCrawlResults(nodes, outPath, "", check, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Fields(out.String()); len(lines) != 1 || !strings.HasPrefix(lines[0], "enr:") {
+		t.Error("Expected the filtered record to be printed", out.String())
+	}
+}
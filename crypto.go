@@ -26,3 +26,11 @@ func Keccak256(data ...[]byte) []byte {
 func Sign(msg, key []byte) ([]byte, error) {
 	return gethCrypto.Sign(msg, key)
 }
+
+func RecoverPubkey(msg, sig []byte) ([]byte, error) {
+	return gethCrypto.RecoverPubkey(msg, sig)
+}
+
+func VerifySignature(pubkey, msg, sig []byte) bool {
+	return gethCrypto.VerifySignature(pubkey, msg, sig)
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// Default time a conformance test waits for a reply, and for making sure
+// that none arrives.
+const defaultConformanceTimeout = time.Second
+
+// Errors
+var (
+	ErrorNoReply         = errors.New("No reply")
+	ErrorUnexpectedReply = errors.New("Unexpected reply")
+)
+
+// ConformanceResult is the outcome of one conformance test. Err is nil if
+// the test passed.
+type ConformanceResult struct {
+	Name string
+	Err  error
+}
+
+// conformanceTest checks one aspect of how a node handles discv4 packets.
+// Every test talks to the target from a fresh socket and key, so the target
+// has never bonded with it.
+type conformanceTest struct {
+	name string
+	run  func(c *conformanceConn) error
+}
+
+var discv4ConformanceTests = []conformanceTest{
+	{"Ping", testPing},
+	{"PingWrongTo", testPingWrongTo},
+	{"PingWrongFrom", testPingWrongFrom},
+	{"PingExtraData", testPingExtraData},
+	{"PingExpired", testPingExpired},
+	{"PingOversized", testPingOversized},
+	{"WrongPacketType", testWrongPacketType},
+	{"FindNodeWithoutBond", testFindNodeWithoutBond},
+	{"FindNode", testFindNode},
+	{"FindNodeExtraData", testFindNodeExtraData},
+	{"UnsolicitedNeighbors", testUnsolicitedNeighbors},
+	{"ENRRequest", testENRRequest},
+}
+
+// RunDiscv4Conformance runs the discv4 conformance tests against a node.
+// Tests that expect no reply take timeout each.
+func RunDiscv4Conformance(target *Enode, timeout time.Duration) ([]ConformanceResult, error) {
+	remote, err := target.RemoteNode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var results []ConformanceResult
+
+	for _, test := range discv4ConformanceTests {
+		c, err := newConformanceConn(remote.address, []byte(target.id), timeout)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = test.run(c)
+		c.close()
+
+		results = append(results, ConformanceResult{test.name, err})
+	}
+
+	return results, nil
+}
+
+func testPing(c *conformanceConn) error {
+	hash, err := c.ping(c.localEndpoint(), c.remoteEndpoint(), c.expiration())
+
+	if err != nil {
+		return err
+	}
+
+	return c.expectPong(hash)
+}
+
+// The pong must report the address the ping came from, not the one the
+// ping claims.
+func testPingWrongTo(c *conformanceConn) error {
+	wrong := NewEndpoint(netip.MustParseAddrPort("192.0.2.1:1"), 1)
+	hash, err := c.ping(c.localEndpoint(), wrong, c.expiration())
+
+	if err != nil {
+		return err
+	}
+
+	return c.expectPong(hash)
+}
+
+func testPingWrongFrom(c *conformanceConn) error {
+	wrong := NewEndpoint(netip.MustParseAddrPort("192.0.2.1:1"), 1)
+	hash, err := c.ping(wrong, c.remoteEndpoint(), c.expiration())
+
+	if err != nil {
+		return err
+	}
+
+	return c.expectPong(hash)
+}
+
+// EIP-8 requires nodes to accept unknown versions and extra list elements.
+func testPingExtraData(c *conformanceConn) error {
+	hash, err := c.write(PingPacketType, []any{uint64(555), c.localEndpoint().toList(),
+		c.remoteEndpoint().toList(), c.expiration(), "extra", []any{"more", "data"}})
+
+	if err != nil {
+		return err
+	}
+
+	return c.expectPong(hash)
+}
+
+func testPingExpired(c *conformanceConn) error {
+	expiration := uint64(time.Now().Add(-time.Minute).Unix())
+
+	if _, err := c.ping(c.localEndpoint(), c.remoteEndpoint(), expiration); err != nil {
+		return err
+	}
+
+	return c.expectNothing()
+}
+
+// Datagrams above maxDatagramSize are truncated by the reader and must not
+// be answered.
+func testPingOversized(c *conformanceConn) error {
+	padding := make([]byte, maxDatagramSize)
+	_, err := c.write(PingPacketType, []any{uint64(4), c.localEndpoint().toList(),
+		c.remoteEndpoint().toList(), c.expiration(), string(padding)})
+
+	if err != nil {
+		return err
+	}
+
+	return c.expectNothing()
+}
+
+func testWrongPacketType(c *conformanceConn) error {
+	if _, err := c.write(PacketType(0x7f), []any{c.expiration()}); err != nil {
+		return err
+	}
+
+	return c.expectNothing()
+}
+
+// Answering unbonded nodes would make the target an amplifier for spoofed
+// requests.
+func testFindNodeWithoutBond(c *conformanceConn) error {
+	if _, err := c.write(FindNodePacketType, []any{string(c.remoteId), c.expiration()}); err != nil {
+		return err
+	}
+
+	return c.expectNothing()
+}
+
+func testFindNode(c *conformanceConn) error {
+	if err := c.bond(); err != nil {
+		return err
+	}
+
+	if _, err := c.write(FindNodePacketType, []any{string(c.remoteId), c.expiration()}); err != nil {
+		return err
+	}
+
+	_, err := c.expectNeighbors()
+	return err
+}
+
+func testFindNodeExtraData(c *conformanceConn) error {
+	if err := c.bond(); err != nil {
+		return err
+	}
+
+	_, err := c.write(FindNodePacketType, []any{string(c.remoteId), c.expiration(), "extra"})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = c.expectNeighbors()
+	return err
+}
+
+// Neighbors nobody asked for must not make it into the target's table.
+func testUnsolicitedNeighbors(c *conformanceConn) error {
+	if err := c.bond(); err != nil {
+		return err
+	}
+
+	var fake NeighborNode
+	rand.Read(fake.id[:])
+	fake.ip = netip.MustParseAddr("10.0.0.1")
+	fake.udpPort = 30303
+	fake.tcpPort = 30303
+
+	packet, _, err := NewNeighborsPacket([]NeighborNode{fake}, c.expiration(), c.key.GetPrivKeyBytes())
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.socket.WriteToUDP(packet, c.remote); err != nil {
+		return err
+	}
+
+	if _, err := c.write(FindNodePacketType, []any{string(fake.id[:]), c.expiration()}); err != nil {
+		return err
+	}
+
+	nodes, err := c.expectNeighbors()
+
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		if node.id == fake.id {
+			return fmt.Errorf("%w: unsolicited neighbor was added", ErrorUnexpectedReply)
+		}
+	}
+
+	return nil
+}
+
+func testENRRequest(c *conformanceConn) error {
+	if err := c.bond(); err != nil {
+		return err
+	}
+
+	hash, err := c.write(ENRRequestPacketType, []any{c.expiration()})
+
+	if err != nil {
+		return err
+	}
+
+	packet, err := c.expect(ENRResponsePacketType)
+
+	if err != nil {
+		return err
+	}
+
+	response := packet.data.(*ENRResponsePacketData)
+
+	if !bytes.Equal(response.requestHash, hash) {
+		return fmt.Errorf("%w: wrong request hash", ErrorUnexpectedReply)
+	}
+
+	if err := response.record.Verify(); err != nil {
+		return err
+	}
+
+	if id, err := response.record.NodeId(); err != nil || !bytes.Equal(id, c.remoteId) {
+		return fmt.Errorf("%w: record of another node", ErrorUnexpectedReply)
+	}
+
+	return nil
+}
+
+// conformanceConn is a socket speaking raw discv4 to the target, so that
+// tests can send packets a Server never would.
+type conformanceConn struct {
+	socket   *net.UDPConn
+	key      LocalNode
+	remote   *net.UDPAddr
+	remoteId []byte
+	timeout  time.Duration
+}
+
+func newConformanceConn(remote *net.UDPAddr, remoteId []byte, timeout time.Duration) (*conformanceConn, error) {
+	// Dialing picks the local address the target will see packets from.
+	probe, err := net.DialUDP("udp", nil, remote)
+
+	if err != nil {
+		return nil, err
+	}
+
+	local := probe.LocalAddr().(*net.UDPAddr)
+	probe.Close()
+
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := NewLocalNode()
+
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+
+	return &conformanceConn{socket, key, remote, remoteId, timeout}, nil
+}
+
+func (c *conformanceConn) close() { c.socket.Close() }
+
+func (c *conformanceConn) localEndpoint() Endpoint {
+	addr := c.socket.LocalAddr().(*net.UDPAddr).AddrPort()
+	return NewEndpoint(netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()), 0)
+}
+
+func (c *conformanceConn) remoteEndpoint() Endpoint {
+	addr := c.remote.AddrPort()
+	return NewEndpoint(netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()), 0)
+}
+
+// write signs and sends a packet with the given payload, which may be
+// anything the RLP encoder accepts, and returns the packet hash.
+func (c *conformanceConn) write(t PacketType, payload []any) ([]byte, error) {
+	data, err := Encode(payload)
+
+	if err != nil {
+		return nil, err
+	}
+
+	packet, hash, err := wrapInPacket(data, t, c.key.GetPrivKeyBytes())
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.socket.WriteToUDP(packet, c.remote)
+	return hash, err
+}
+
+// expiration is the expiration of packets sent now. The target judges it by
+// its own clock, so this uses the system clock.
+func (c *conformanceConn) expiration() uint64 {
+	return uint64(time.Now().Add(packetExpiration).Unix())
+}
+
+func (c *conformanceConn) ping(from, to Endpoint, expiration uint64) ([]byte, error) {
+	return c.write(PingPacketType, []any{uint64(4), from.toList(), to.toList(), expiration})
+}
+
+// read returns the next valid packet from the target, or ErrorNoReply once
+// deadline has passed.
+func (c *conformanceConn) read(deadline time.Time) (*Packet[any], error) {
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		c.socket.SetReadDeadline(deadline)
+		n, from, err := c.socket.ReadFromUDP(buf)
+
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, ErrorNoReply
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !sameAddress(from, c.remote) {
+			continue
+		}
+
+		packet, err := DecodePacket(buf[:n])
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrorUnexpectedReply, err)
+		}
+
+		if !bytes.Equal(packet.header.senderId, c.remoteId) {
+			return nil, fmt.Errorf("%w: wrong sender", ErrorUnexpectedReply)
+		}
+
+		return packet, nil
+	}
+}
+
+// expect waits for a packet of the given type. Pings, which the target
+// sends to check our endpoint, are answered on the way.
+func (c *conformanceConn) expect(t PacketType) (*Packet[any], error) {
+	deadline := time.Now().Add(c.timeout)
+
+	for {
+		packet, err := c.read(deadline)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if packet.header.packetType == t {
+			return packet, nil
+		}
+
+		if packet.header.packetType == PingPacketType {
+			if err := c.pong(packet); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// expectNothing checks that the target sends nothing but pings.
+func (c *conformanceConn) expectNothing() error {
+	deadline := time.Now().Add(c.timeout)
+
+	for {
+		packet, err := c.read(deadline)
+
+		if err == ErrorNoReply {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if packet.header.packetType != PingPacketType {
+			return fmt.Errorf("%w: packet type %d", ErrorUnexpectedReply, packet.header.packetType)
+		}
+	}
+}
+
+func (c *conformanceConn) expectPong(pingHash []byte) error {
+	packet, err := c.expect(PongPacketType)
+
+	if err != nil {
+		return err
+	}
+
+	pong := packet.data.(*PongPacketData)
+
+	if !bytes.Equal(pong.pingHash, pingHash) {
+		return fmt.Errorf("%w: wrong ping hash", ErrorUnexpectedReply)
+	}
+
+	if pong.to.UDPAddr() != c.localEndpoint().UDPAddr() {
+		return fmt.Errorf("%w: pong to %v, expected %v", ErrorUnexpectedReply,
+			pong.to.UDPAddr(), c.localEndpoint().UDPAddr())
+	}
+
+	if pong.expiration < uint64(time.Now().Unix()) {
+		return fmt.Errorf("%w: pong expired", ErrorUnexpectedReply)
+	}
+
+	return nil
+}
+
+// expectNeighbors collects the neighbors of one find node request, which
+// may span several packets.
+func (c *conformanceConn) expectNeighbors() ([]NeighborNode, error) {
+	packet, err := c.expect(NeighborsPacketType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := packet.data.(*NeighborsPacketData).nodes
+
+	// Only a full packet may be followed by more.
+	for last := len(nodes); last == maxNeighbors; {
+		packet, err := c.expect(NeighborsPacketType)
+
+		if err == ErrorNoReply {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		last = len(packet.data.(*NeighborsPacketData).nodes)
+		nodes = append(nodes, packet.data.(*NeighborsPacketData).nodes...)
+	}
+
+	return nodes, nil
+}
+
+func (c *conformanceConn) pong(ping *Packet[any]) error {
+	packet, _, err := NewPongPacket(c.remoteEndpoint(), ping.header.hash, c.expiration(),
+		0, c.key.GetPrivKeyBytes())
+
+	if err != nil {
+		return err
+	}
+
+	_, err = c.socket.WriteToUDP(packet, c.remote)
+	return err
+}
+
+// bond completes the endpoint proof in both directions: the target answers
+// our ping and we answer the target's ping back.
+func (c *conformanceConn) bond() error {
+	hash, err := c.ping(c.localEndpoint(), c.remoteEndpoint(), c.expiration())
+
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(c.timeout)
+	gotPong, gotPing := false, false
+
+	for !gotPong || !gotPing {
+		packet, err := c.read(deadline)
+
+		if err != nil {
+			return fmt.Errorf("Bond failed: %w", err)
+		}
+
+		switch packet.header.packetType {
+		case PongPacketType:
+			gotPong = gotPong || bytes.Equal(packet.data.(*PongPacketData).pingHash, hash)
+		case PingPacketType:
+			gotPing = true
+
+			if err := c.pong(packet); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Give the target time to process our pong.
+	time.Sleep(c.timeout / 10)
+	return nil
+}
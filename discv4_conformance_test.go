@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiscv4Conformance(t *testing.T) {
+	server, localNode := startTestServer(t)
+	target := NewEnode(localNode.GetId(), remoteNodeOf(server).address, 0)
+
+	results, err := RunDiscv4Conformance(target, 300*time.Millisecond)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(discv4ConformanceTests) {
+		t.Fatal("Expected a result for every test", len(results))
+	}
+
+	for _, result := range results {
+		if result.Err != nil {
+			t.Error(result.Name, result.Err)
+		}
+	}
+}
@@ -4,17 +4,21 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"net"
+	"net/netip"
 )
 
 type PacketType byte
 
 // Packet types
 const (
-	InvalidPacketType   PacketType = 0x00
-	PingPacketType      PacketType = 0x01
-	PongPacketType      PacketType = 0x02
-	FindNodePacketType  PacketType = 0x03
-	NeighborsPacketType PacketType = 0x04
+	InvalidPacketType     PacketType = 0x00
+	PingPacketType        PacketType = 0x01
+	PongPacketType        PacketType = 0x02
+	FindNodePacketType    PacketType = 0x03
+	NeighborsPacketType   PacketType = 0x04
+	ENRRequestPacketType  PacketType = 0x05
+	ENRResponsePacketType PacketType = 0x06
 )
 
 // Errors
@@ -23,18 +27,29 @@ var (
 	ErrorInvalidHash        = errors.New("Invalid hash")
 	ErrorInvalidPacketType  = errors.New("Invalid packet type")
 	ErrorInvalidPacketShape = errors.New("Invalid packet shape")
+	ErrorInvalidSignature   = errors.New("Invalid signature")
+	ErrorInvalidInteger     = errors.New("Invalid integer")
+	ErrorInvalidIPLength    = errors.New("Invalid IP length")
+	ErrorInvalidPort        = errors.New("Invalid port")
+	ErrorInvalidNodeId      = errors.New("Invalid node id")
+	ErrorInvalidHashLength  = errors.New("Invalid hash length")
 )
 
 const (
 	hashLength      = 32
 	signatureLength = 65
 	headerSize      = hashLength + signatureLength + 1
+
+	// Number of neighbors that fit in one packet below maxDatagramSize.
+	maxNeighbors = 12
 )
 
 type PacketHeader struct {
 	hash       []byte
+	signedHash []byte
 	signature  []byte
 	packetType PacketType
+	senderId   []byte
 }
 
 type Packet[PacketData any] struct {
@@ -42,37 +57,56 @@ type Packet[PacketData any] struct {
 	data   PacketData
 }
 
+// Endpoint is the address of a node as carried in ping and pong packets.
 type Endpoint struct {
-	ip      string
-	udpPort int
-	tcpPort int
+	ip      netip.Addr
+	udpPort uint16
+	tcpPort uint16
+}
+
+func NewEndpoint(addr netip.AddrPort, tcpPort uint16) Endpoint {
+	return Endpoint{addr.Addr().Unmap(), addr.Port(), tcpPort}
+}
+
+func (e Endpoint) UDPAddr() netip.AddrPort {
+	return netip.AddrPortFrom(e.ip, e.udpPort)
+}
+
+func (e Endpoint) toList() []any {
+	return []any{ipBytes(e.ip), uint64(e.udpPort), uint64(e.tcpPort)}
+}
+
+// ipBytes returns an IP as sent on the wire: 4 bytes for IPv4 addresses and
+// 16 bytes for IPv6 addresses.
+func ipBytes(ip netip.Addr) string {
+	return string(ip.Unmap().AsSlice())
 }
 
 type PingPacketData struct {
-	version    int
+	version    uint
 	from       Endpoint
 	to         Endpoint
 	expiration uint64
-	enrSeqNum  int
+	enrSeqNum  uint64
 }
 
 type PongPacketData struct {
 	to         Endpoint
 	pingHash   []byte
 	expiration uint64
-	enrSeqNum  int
+	enrSeqNum  uint64
 }
 
 type FindNodePacketData struct {
-	target     string
+	target     NodeID
 	expiration uint64
 }
 
 type NeighborNode struct {
-	ip      string
-	udpPort uint64
-	tcpPort uint64
-	nodeId  string
+	ip      netip.Addr
+	udpPort uint16
+	tcpPort uint16
+	id      NodeID
 }
 
 type NeighborsPacketData struct {
@@ -80,26 +114,58 @@ type NeighborsPacketData struct {
 	expiration uint64
 }
 
+type ENRRequestPacketData struct {
+	expiration uint64
+}
+
+type ENRResponsePacketData struct {
+	requestHash []byte
+	record      *ENR
+}
+
+// The ENR sequence number is optional and, as in other clients, left out
+// when zero.
+
 func (p *PingPacketData) ToRLP() ([]byte, error) {
-	return Encode([]any{
-		p.version,
-		[]any{p.from.ip, p.from.udpPort, p.from.tcpPort},
-		[]any{p.to.ip, p.to.udpPort, p.to.tcpPort},
-		p.expiration,
-		p.enrSeqNum})
+	list := []any{uint64(p.version), p.from.toList(), p.to.toList(), p.expiration}
+
+	if p.enrSeqNum != 0 {
+		list = append(list, p.enrSeqNum)
+	}
+
+	return Encode(list)
 }
 
 func (p *PongPacketData) ToRLP() ([]byte, error) {
-	return Encode([]any{
-		[]any{p.to.ip, p.to.udpPort, p.to.tcpPort},
-		p.pingHash,
-		p.expiration,
-		p.enrSeqNum,
-	})
+	list := []any{p.to.toList(), string(p.pingHash), p.expiration}
+
+	if p.enrSeqNum != 0 {
+		list = append(list, p.enrSeqNum)
+	}
+
+	return Encode(list)
 }
 
 func (p *FindNodePacketData) ToRLP() ([]byte, error) {
-	return Encode([]any{p.target, p.expiration})
+	return Encode([]any{string(p.target[:]), p.expiration})
+}
+
+func (p *NeighborsPacketData) ToRLP() ([]byte, error) {
+	nodes := []any{}
+
+	for _, node := range p.nodes {
+		nodes = append(nodes, []any{ipBytes(node.ip), uint64(node.udpPort), uint64(node.tcpPort), string(node.id[:])})
+	}
+
+	return Encode([]any{nodes, p.expiration})
+}
+
+func (p *ENRRequestPacketData) ToRLP() ([]byte, error) {
+	return Encode([]any{p.expiration})
+}
+
+func (p *ENRResponsePacketData) ToRLP() ([]byte, error) {
+	return Encode([]any{p.requestHash, p.record.toList()})
 }
 
 func DecodePacket(data []byte) (*Packet[any], error) {
@@ -122,8 +188,14 @@ func DecodePacket(data []byte) (*Packet[any], error) {
 		packetData, err = decodePingPacketData(packetDataBytes)
 	case PongPacketType:
 		packetData, err = decodePongPacketData(packetDataBytes)
+	case FindNodePacketType:
+		packetData, err = decodeFindNodePacketData(packetDataBytes)
 	case NeighborsPacketType:
 		packetData, err = decodeNeighborsPacketData(packetDataBytes)
+	case ENRRequestPacketType:
+		packetData, err = decodeENRRequestPacketData(packetDataBytes)
+	case ENRResponsePacketType:
+		packetData, err = decodeENRResponsePacketData(packetDataBytes)
 	default:
 		err = ErrorInvalidPacketType
 	}
@@ -157,7 +229,7 @@ func wrapInPacket(packetData []byte, pType PacketType, privKey []byte) ([]byte,
 	return packetBytes, hash, nil
 }
 
-func NewPingPacket(version int, from, to Endpoint, expiration uint64, enrSeqNum int, privKey []byte) ([]byte, []byte, error) {
+func NewPingPacket(version uint, from, to Endpoint, expiration uint64, enrSeqNum uint64, privKey []byte) ([]byte, []byte, error) {
 	packetData := PingPacketData{
 		version,
 		from,
@@ -175,7 +247,7 @@ func NewPingPacket(version int, from, to Endpoint, expiration uint64, enrSeqNum
 	return wrapInPacket(encodedPacketData, PingPacketType, privKey)
 }
 
-func NewPongPacket(to Endpoint, pingHash []byte, expiration uint64, enrSeqNum int, privKey []byte) ([]byte, []byte, error) {
+func NewPongPacket(to Endpoint, pingHash []byte, expiration uint64, enrSeqNum uint64, privKey []byte) ([]byte, []byte, error) {
 	packetData := PongPacketData{
 		to,
 		pingHash,
@@ -192,8 +264,8 @@ func NewPongPacket(to Endpoint, pingHash []byte, expiration uint64, enrSeqNum in
 	return wrapInPacket(encodedPacketData, PongPacketType, privKey)
 }
 
-func NewFindNodePacket(target []byte, expiration uint64, privKey []byte) ([]byte, []byte, error) {
-	packetData := FindNodePacketData{string(target), expiration}
+func NewFindNodePacket(target NodeID, expiration uint64, privKey []byte) ([]byte, []byte, error) {
+	packetData := FindNodePacketData{target, expiration}
 	encodedPacketData, err := packetData.ToRLP()
 
 	if err != nil {
@@ -203,12 +275,124 @@ func NewFindNodePacket(target []byte, expiration uint64, privKey []byte) ([]byte
 	return wrapInPacket(encodedPacketData, FindNodePacketType, privKey)
 }
 
-func decodeEndpoint(data []any) Endpoint {
-	return Endpoint{
-		ip:      data[0].(string),
-		udpPort: int(decodeUInt64([]byte(data[1].(string)))),
-		tcpPort: int(decodeUInt64([]byte(data[2].(string)))),
+func NewNeighborsPacket(nodes []NeighborNode, expiration uint64, privKey []byte) ([]byte, []byte, error) {
+	packetData := NeighborsPacketData{nodes, expiration}
+	encodedPacketData, err := packetData.ToRLP()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return wrapInPacket(encodedPacketData, NeighborsPacketType, privKey)
+}
+
+func NewENRRequestPacket(expiration uint64, privKey []byte) ([]byte, []byte, error) {
+	packetData := ENRRequestPacketData{expiration}
+	encodedPacketData, err := packetData.ToRLP()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return wrapInPacket(encodedPacketData, ENRRequestPacketType, privKey)
+}
+
+func NewENRResponsePacket(requestHash []byte, record *ENR, privKey []byte) ([]byte, []byte, error) {
+	packetData := ENRResponsePacketData{requestHash, record}
+	encodedPacketData, err := packetData.ToRLP()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return wrapInPacket(encodedPacketData, ENRResponsePacketType, privKey)
+}
+
+// Decoders read the fields they know and ignore any further list elements,
+// which EIP-8 reserves for future versions of the protocol. For the same
+// reason the ping version is not checked. Every field is validated, since
+// packets come straight from the network.
+
+// decodeUint decodes an unsigned integer of at most size bytes.
+func decodeUint(item any, size int) (uint64, error) {
+	s, ok := item.(string)
+
+	if !ok || len(s) > size {
+		return 0, ErrorInvalidInteger
+	}
+
+	return decodeUInt64([]byte(s)), nil
+}
+
+func decodePort(item any) (uint16, error) {
+	port, err := decodeUint(item, 2)
+
+	if err != nil {
+		return 0, ErrorInvalidPort
+	}
+
+	return uint16(port), nil
+}
+
+func decodeIP(item any) (netip.Addr, error) {
+	ip, ok := item.(string)
+
+	if !ok || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return netip.Addr{}, ErrorInvalidIPLength
+	}
+
+	addr, _ := netip.AddrFromSlice([]byte(ip))
+	return addr.Unmap(), nil
+}
+
+func decodeHash(item any) ([]byte, error) {
+	hash, ok := item.(string)
+
+	if !ok || len(hash) != hashLength {
+		return nil, ErrorInvalidHashLength
+	}
+
+	return []byte(hash), nil
+}
+
+func decodeNodeId(item any) (NodeID, error) {
+	var id NodeID
+	s, ok := item.(string)
+
+	if !ok || len(s) != nodeIdLength {
+		return id, ErrorInvalidNodeId
+	}
+
+	copy(id[:], s)
+	return id, nil
+}
+
+func decodeEndpoint(item any) (Endpoint, error) {
+	data, ok := item.([]any)
+
+	if !ok || len(data) < 3 {
+		return Endpoint{}, ErrorInvalidPacketShape
+	}
+
+	ip, err := decodeIP(data[0])
+
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	udpPort, err := decodePort(data[1])
+
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	tcpPort, err := decodePort(data[2])
+
+	if err != nil {
+		return Endpoint{}, err
 	}
+
+	return Endpoint{ip, udpPort, tcpPort}, nil
 }
 
 func decodePingPacketData(data []byte) (*PingPacketData, error) {
@@ -218,17 +402,47 @@ func decodePingPacketData(data []byte) (*PingPacketData, error) {
 		return nil, err
 	}
 
-	decodedList := decoded.([]any)
-	versionString := decodedList[0].(string)
+	decodedList, b := decoded.([]any)
+	if !b || len(decodedList) < 4 {
+		return nil, ErrorInvalidPacketShape
+	}
+
+	version, err := decodeUint(decodedList[0], 4)
+
+	if err != nil {
+		return nil, err
+	}
 
-	version := int(decodeUInt64([]byte(versionString)))
-	from := decodeEndpoint(decodedList[1].([]any))
-	to := decodeEndpoint(decodedList[2].([]any))
-	expiration := decodeUInt64([]byte(decodedList[3].(string)))
-	enrSeqNum := int(decodeUInt64([]byte(decodedList[4].(string))))
+	from, err := decodeEndpoint(decodedList[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := decodeEndpoint(decodedList[2])
+
+	if err != nil {
+		return nil, err
+	}
+
+	expiration, err := decodeUint(decodedList[3], 8)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The ENR sequence number was added by EIP-868 and is optional.
+	var enrSeqNum uint64
+	if len(decodedList) > 4 {
+		enrSeqNum, err = decodeUint(decodedList[4], 8)
+
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return &PingPacketData{
-		version,
+		uint(version),
 		from,
 		to,
 		expiration,
@@ -246,6 +460,10 @@ func decodePacketType(t byte) PacketType {
 		return FindNodePacketType
 	case 0x04:
 		return NeighborsPacketType
+	case 0x05:
+		return ENRRequestPacketType
+	case 0x06:
+		return ENRResponsePacketType
 	default:
 		return InvalidPacketType
 	}
@@ -263,9 +481,21 @@ func decodePacketHeader(packet []byte) (*PacketHeader, error) {
 
 	if err != nil {
 		return nil, err
-	} else {
-		return &header, nil
 	}
+
+	// The signature is malleable, so the outer hash can differ between
+	// copies of the same signed packet. Replays are matched on this instead.
+	header.signedHash = Keccak256(packet[headerSize-1:])
+	pubkey, err := RecoverPubkey(header.signedHash, header.signature)
+
+	if err != nil {
+		return nil, ErrorInvalidSignature
+	}
+
+	// Index 0 is the uncompressed serialized flag. Not part of the id.
+	header.senderId = pubkey[1:]
+
+	return &header, nil
 }
 
 func validateHeader(header PacketHeader, expectedHash []byte) error {
@@ -287,23 +517,116 @@ func decodePongPacketData(data []byte) (*PongPacketData, error) {
 		return nil, err
 	}
 
-	decodedList := decoded.([]any)
+	decodedList, b := decoded.([]any)
+	if !b || len(decodedList) < 3 {
+		return nil, ErrorInvalidPacketShape
+	}
+
+	to, err := decodeEndpoint(decodedList[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	pingHash, err := decodeHash(decodedList[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	expiration, err := decodeUint(decodedList[2], 8)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var enrSeqNum uint64
+	if len(decodedList) > 3 {
+		enrSeqNum, err = decodeUint(decodedList[3], 8)
+
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return &PongPacketData{
-		to:         decodeEndpoint(decodedList[0].([]any)),
-		pingHash:   []byte(decodedList[1].(string)),
-		expiration: decodeUInt64([]byte(decodedList[2].(string))),
-		enrSeqNum:  int(decodeUInt64([]byte(decodedList[3].(string)))),
+		to:         to,
+		pingHash:   pingHash,
+		expiration: expiration,
+		enrSeqNum:  enrSeqNum,
 	}, nil
 }
 
-func decodeNeighborNode(data []any) NeighborNode {
-	return NeighborNode{
-		ip:      data[0].(string),
-		udpPort: decodeUInt64([]byte(data[1].(string))),
-		tcpPort: decodeUInt64([]byte(data[2].(string))),
-		nodeId:  data[3].(string),
+func decodeFindNodePacketData(data []byte) (*FindNodePacketData, error) {
+	decoded, err := Decode(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	decodedList, b := decoded.([]any)
+	if !b || len(decodedList) < 2 {
+		return nil, ErrorInvalidPacketShape
 	}
+
+	target, err := decodeNodeId(decodedList[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	expiration, err := decodeUint(decodedList[1], 8)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &FindNodePacketData{target, expiration}, nil
+}
+
+// asList converts a decoded RLP item to a list. Empty lists decode as an
+// empty byte slice.
+func asList(item any) ([]any, bool) {
+	if b, ok := item.([]byte); ok && len(b) == 0 {
+		return []any{}, true
+	}
+
+	list, ok := item.([]any)
+	return list, ok
+}
+
+func decodeNeighborNode(item any) (NeighborNode, error) {
+	data, ok := item.([]any)
+
+	if !ok || len(data) < 4 {
+		return NeighborNode{}, ErrorInvalidPacketShape
+	}
+
+	ip, err := decodeIP(data[0])
+
+	if err != nil {
+		return NeighborNode{}, err
+	}
+
+	udpPort, err := decodePort(data[1])
+
+	if err != nil {
+		return NeighborNode{}, err
+	}
+
+	tcpPort, err := decodePort(data[2])
+
+	if err != nil {
+		return NeighborNode{}, err
+	}
+
+	nodeId, err := decodeNodeId(data[3])
+
+	if err != nil {
+		return NeighborNode{}, err
+	}
+
+	return NeighborNode{ip, udpPort, tcpPort, nodeId}, nil
 }
 
 func decodeNeighborsPacketData(data []byte) (*NeighborsPacketData, error) {
@@ -314,40 +637,126 @@ func decodeNeighborsPacketData(data []byte) (*NeighborsPacketData, error) {
 	}
 
 	decodedList, b := decoded.([]any)
-	if !b {
+	if !b || len(decodedList) < 2 {
 		return nil, ErrorInvalidPacketShape
 	}
 
-	nodes, b := decodedList[0].([]any)
+	nodes, b := asList(decodedList[0])
 	if !b {
 		return nil, ErrorInvalidPacketShape
 	}
 
 	var packetData NeighborsPacketData
 
-	for _, node := range nodes {
-		packetData.nodes = append(packetData.nodes, decodeNeighborNode(node.([]any)))
+	for _, item := range nodes {
+		node, err := decodeNeighborNode(item)
+
+		if err != nil {
+			return nil, err
+		}
+
+		packetData.nodes = append(packetData.nodes, node)
+	}
+
+	packetData.expiration, err = decodeUint(decodedList[1], 8)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &packetData, nil
+}
+
+func decodeENRRequestPacketData(data []byte) (*ENRRequestPacketData, error) {
+	decoded, err := Decode(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	decodedList, b := decoded.([]any)
+	if !b || len(decodedList) < 1 {
+		return nil, ErrorInvalidPacketShape
+	}
+
+	expiration, err := decodeUint(decodedList[0], 8)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ENRRequestPacketData{expiration}, nil
+}
+
+func decodeENRResponsePacketData(data []byte) (*ENRResponsePacketData, error) {
+	decoded, err := Decode(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	decodedList, b := decoded.([]any)
+	if !b || len(decodedList) < 2 {
+		return nil, ErrorInvalidPacketShape
 	}
 
-	expiration, b := decodedList[1].(string)
+	requestHash, err := decodeHash(decodedList[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	recordList, b := decodedList[1].([]any)
 	if !b {
 		return nil, ErrorInvalidPacketShape
 	}
 
-	packetData.expiration = decodeUInt64([]byte(expiration))
+	record, err := decodeENRList(recordList)
 
-	return &packetData, nil
+	if err != nil {
+		return nil, err
+	}
+
+	return &ENRResponsePacketData{requestHash, record}, nil
 }
 
-func decodeUInt64(data []byte) uint64 {
-	if len(data) == 1 {
-		if data[0] == 0x80 {
-			return 0
-		} else {
-			return uint64(data[0])
-		}
+// expirationOf returns the expiration timestamp of decoded packet data. Not
+// every packet type carries one.
+func expirationOf(data any) (uint64, bool) {
+	switch d := data.(type) {
+	case *PingPacketData:
+		return d.expiration, true
+	case *PongPacketData:
+		return d.expiration, true
+	case *FindNodePacketData:
+		return d.expiration, true
+	case *NeighborsPacketData:
+		return d.expiration, true
+	case *ENRRequestPacketData:
+		return d.expiration, true
+	default:
+		return 0, false
 	}
+}
 
+// setExpiration changes the expiration timestamp of decoded packet data, if
+// it carries one.
+func setExpiration(data any, expiration uint64) {
+	switch d := data.(type) {
+	case *PingPacketData:
+		d.expiration = expiration
+	case *PongPacketData:
+		d.expiration = expiration
+	case *FindNodePacketData:
+		d.expiration = expiration
+	case *NeighborsPacketData:
+		d.expiration = expiration
+	case *ENRRequestPacketData:
+		d.expiration = expiration
+	}
+}
+
+func decodeUInt64(data []byte) uint64 {
 	buf := new(bytes.Buffer)
 
 	for i := 0; i < 8-len(data); i++ {
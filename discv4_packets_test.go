@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func mustHex(s string) string {
+	b, err := hex.DecodeString(s)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return string(b)
+}
+
+func mustNodeID(s string) NodeID {
+	return nodeIDFrom([]byte(mustHex(s)))
+}
+
+// EIP-8 test vectors. They carry extra list elements and trailing data that
+// a decoder has to ignore.
+var eip8Packets = []struct {
+	name  string
+	input string
+	want  any
+}{
+	{
+		name:  "ping without ENR sequence",
+		input: "71dbda3a79554728d4f94411e42ee1f8b0d561c10e1e5f5893367948c6a7d70bb87b235fa28a77070271b6c164a2dce8c7e13a5739b53b5e96f2e5acb0e458a02902f5965d55ecbeb2ebb6cabb8b2b232896a36b737666c55265ad0a68412f250001ea04cb847f000001820cfa8215a8d790000000000000000000000000000000018208ae820d058443b9a355",
+		want: &PingPacketData{
+			version:    4,
+			from:       Endpoint{netip.MustParseAddr("127.0.0.1"), 3322, 5544},
+			to:         Endpoint{netip.MustParseAddr("::1"), 2222, 3333},
+			expiration: 1136239445,
+		},
+	},
+	{
+		name:  "ping with extra elements",
+		input: "e9614ccfd9fc3e74360018522d30e1419a143407ffcce748de3e22116b7e8dc92ff74788c0b6663aaa3d67d641936511c8f8d6ad8698b820a7cf9e1be7155e9a241f556658c55428ec0563514365799a4be2be5a685a80971ddcfa80cb422cdd0101ec04cb847f000001820cfa8215a8d790000000000000000000000000000000018208ae820d058443b9a3550102",
+		want: &PingPacketData{
+			version:    4,
+			from:       Endpoint{netip.MustParseAddr("127.0.0.1"), 3322, 5544},
+			to:         Endpoint{netip.MustParseAddr("::1"), 2222, 3333},
+			expiration: 1136239445,
+			enrSeqNum:  1,
+		},
+	},
+	{
+		name:  "find node with extra elements",
+		input: "c7c44041b9f7c7e41934417ebac9a8e1a4c6298f74553f2fcfdcae6ed6fe53163eb3d2b52e39fe91831b8a927bf4fc222c3902202027e5e9eb812195f95d20061ef5cd31d502e47ecb61183f74a504fe04c51e73df81f25c4d506b26db4517490103f84eb840ca634cae0d49acb401d8a4c6b6fe8c55b70d115bf400769cc1400f3258cd31387574077f301b421bc84df7266c44e9e6d569fc56be00812904767bf5ccd1fc7f8443b9a35582999983999999280dc62cc8255c73471e0a61da0c89acdc0e035e260add7fc0c04ad9ebf3919644c91cb247affc82b69bd2ca235c71eab8e49737c937a2c396",
+		want: &FindNodePacketData{
+			target:     mustNodeID("ca634cae0d49acb401d8a4c6b6fe8c55b70d115bf400769cc1400f3258cd31387574077f301b421bc84df7266c44e9e6d569fc56be00812904767bf5ccd1fc7f"),
+			expiration: 1136239445,
+		},
+	},
+	{
+		name:  "neighbors with extra elements and trailing data",
+		input: "c679fc8fe0b8b12f06577f2e802d34f6fa257e6137a995f6f4cbfc9ee50ed3710faf6e66f932c4c8d81d64343f429651328758b47d3dbc02c4042f0fff6946a50f4a49037a72bb550f3a7872363a83e1b9ee6469856c24eb4ef80b7535bcf99c0004f9015bf90150f84d846321163782115c82115db8403155e1427f85f10a5c9a7755877748041af1bcd8d474ec065eb33df57a97babf54bfd2103575fa829115d224c523596b401065a97f74010610fce76382c0bf32f84984010203040101b840312c55512422cf9b8a4097e9a6ad79402e87a15ae909a4bfefa22398f03d20951933beea1e4dfa6f968212385e829f04c2d314fc2d4e255e0d3bc08792b069dbf8599020010db83c4d001500000000abcdef12820d05820d05b84038643200b172dcfef857492156971f0e6aa2c538d8b74010f8e140811d53b98c765dd2d96126051913f44582e8c199ad7c6d6819e9a56483f637feaac9448aacf8599020010db885a308d313198a2e037073488203e78203e8b8408dcab8618c3253b558d459da53bd8fa68935a719aff8b811197101a4b2b47dd2d47295286fc00cc081bb542d760717d1bdd6bec2c37cd72eca367d6dd3b9df738443b9a355010203b525a138aa34383fec3d2719a0",
+		want: &NeighborsPacketData{
+			nodes: []NeighborNode{
+				{netip.MustParseAddr("99.33.22.55"), 4444, 4445, mustNodeID("3155e1427f85f10a5c9a7755877748041af1bcd8d474ec065eb33df57a97babf54bfd2103575fa829115d224c523596b401065a97f74010610fce76382c0bf32")},
+				{netip.MustParseAddr("1.2.3.4"), 1, 1, mustNodeID("312c55512422cf9b8a4097e9a6ad79402e87a15ae909a4bfefa22398f03d20951933beea1e4dfa6f968212385e829f04c2d314fc2d4e255e0d3bc08792b069db")},
+				{netip.MustParseAddr("2001:db8:3c4d:15::abcd:ef12"), 3333, 3333, mustNodeID("38643200b172dcfef857492156971f0e6aa2c538d8b74010f8e140811d53b98c765dd2d96126051913f44582e8c199ad7c6d6819e9a56483f637feaac9448aac")},
+				{netip.MustParseAddr("2001:db8:85a3:8d3:1319:8a2e:370:7348"), 999, 1000, mustNodeID("8dcab8618c3253b558d459da53bd8fa68935a719aff8b811197101a4b2b47dd2d47295286fc00cc081bb542d760717d1bdd6bec2c37cd72eca367d6dd3b9df73")},
+			},
+			expiration: 1136239445,
+		},
+	},
+}
+
+func TestEIP8ForwardCompatibility(t *testing.T) {
+	key, _ := hex.DecodeString("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	wantSender := NewLocalNodeFromKey(key).GetId()
+
+	for _, test := range eip8Packets {
+		input, _ := hex.DecodeString(test.input)
+		packet, err := DecodePacket(input)
+
+		if err != nil {
+			t.Errorf("%s: packet not accepted: %v", test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(packet.data, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, packet.data, test.want)
+		}
+
+		if !bytes.Equal(packet.header.senderId, wantSender) {
+			t.Errorf("%s: unexpected sender %x", test.name, packet.header.senderId)
+		}
+	}
+}
+
+func TestPingAnyVersion(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	endpoint := Endpoint{netip.MustParseAddr("127.0.0.1"), 30303, 30303}
+	packet, _, err := NewPingPacket(555, endpoint, endpoint, testExpiration(), 1, localNode.GetPrivKeyBytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodePacket(packet)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version := decoded.data.(*PingPacketData).version; version != 555 {
+		t.Error("Unexpected version", version)
+	}
+}
+
+func TestDecodeMalformedPackets(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	ip := ipBytes(netip.MustParseAddr("1.2.3.4"))
+	id := string(localNode.GetId())
+	hash := string(make([]byte, hashLength))
+	exp := testExpiration()
+
+	tests := []struct {
+		name       string
+		packetType PacketType
+		payload    any
+		want       error
+	}{
+		{"short ping", PingPacketType, []any{4, []any{ip, 1, 1}}, ErrorInvalidPacketShape},
+		{"ping with 5 byte IP", PingPacketType, []any{4, []any{"12345", 1, 1}, []any{ip, 1, 1}, exp}, ErrorInvalidIPLength},
+		{"ping with 3 byte port", PingPacketType, []any{4, []any{ip, 1 << 16, 1}, []any{ip, 1, 1}, exp}, ErrorInvalidPort},
+		{"ping with list version", PingPacketType, []any{[]any{4}, []any{ip, 1, 1}, []any{ip, 1, 1}, exp}, ErrorInvalidInteger},
+		{"ping with endpoint string", PingPacketType, []any{4, ip, []any{ip, 1, 1}, exp}, ErrorInvalidPacketShape},
+		{"pong with short hash", PongPacketType, []any{[]any{ip, 1, 1}, hash[1:], exp}, ErrorInvalidHashLength},
+		{"find node with short target", FindNodePacketType, []any{id[1:], exp}, ErrorInvalidNodeId},
+		{"find node with long expiration", FindNodePacketType, []any{id, hash[:9]}, ErrorInvalidInteger},
+		{"neighbor with short id", NeighborsPacketType, []any{[]any{[]any{ip, 1, 1, id[1:]}}, exp}, ErrorInvalidNodeId},
+		{"neighbor without id", NeighborsPacketType, []any{[]any{[]any{ip, 1, 1}}, exp}, ErrorInvalidPacketShape},
+		{"ENR response with short hash", ENRResponsePacketType, []any{hash[1:], []any{}}, ErrorInvalidHashLength},
+		{"not a list", ENRRequestPacketType, exp, ErrorInvalidPacketShape},
+	}
+
+	for _, test := range tests {
+		payload, err := Encode(test.payload)
+
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+
+		packet, _, err := wrapInPacket(payload, test.packetType, localNode.GetPrivKeyBytes())
+
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+
+		if _, err := DecodePacket(packet); err != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestDecodeTruncatedPacket(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	payload, _ := Encode([]any{testExpiration()})
+
+	// Claims a list longer than the packet.
+	payload[0] += 4
+
+	packet, _, err := wrapInPacket(payload, ENRRequestPacketType, localNode.GetPrivKeyBytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := DecodePacket(packet); err != ErrorRLPTooShort {
+		t.Error("Expected truncated packet to be rejected", err)
+	}
+}
+
+func FuzzDecodePacket(f *testing.F) {
+	for _, test := range eip8Packets {
+		input, _ := hex.DecodeString(test.input)
+		f.Add(input)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		DecodePacket(data)
+	})
+}
+
+// FuzzDecodePacketPayload signs every input so that it gets past the hash
+// and signature checks to the payload decoders.
+func FuzzDecodePacketPayload(f *testing.F) {
+	for _, test := range eip8Packets {
+		input, _ := hex.DecodeString(test.input)
+		f.Add(input[headerSize-1], input[headerSize:])
+	}
+
+	key, _ := hex.DecodeString("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+
+	f.Fuzz(func(t *testing.T, packetType byte, payload []byte) {
+		packet, _, err := wrapInPacket(payload, PacketType(packetType), key)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		DecodePacket(packet)
+	})
+}
+
+func TestCanonicalEncoding(t *testing.T) {
+	// The first EIP-8 ping has no extra elements, so encoding the decoded
+	// packet must give back the exact payload.
+	input, _ := hex.DecodeString(eip8Packets[0].input)
+	packet, err := DecodePacket(input)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := packet.data.(*PingPacketData).ToRLP()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(encoded, input[headerSize:]) {
+		t.Errorf("got %x, want %x", encoded, input[headerSize:])
+	}
+
+	localNode, _ := NewLocalNode()
+	nodes := eip8Packets[3].want.(*NeighborsPacketData).nodes
+	neighbors, _, err := NewNeighborsPacket(nodes, 1136239445, localNode.GetPrivKeyBytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodePacket(neighbors)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded.data, &NeighborsPacketData{nodes, 1136239445}) {
+		t.Errorf("Neighbors changed in round trip: %+v", decoded.data)
+	}
+}
@@ -0,0 +1,1050 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+const (
+	// A request may need a handshake first, which takes another round trip.
+	v5RequestTimeout = 2 * replyTimeout
+
+	// Records answering one FINDNODE, split into messages small enough for
+	// a packet.
+	v5MaxNodes         = bucketSize
+	v5NodesPerMessage  = 3
+	v5MaxNodesMessages = (v5MaxNodes + v5NodesPerMessage - 1) / v5NodesPerMessage
+
+	// Distances asked for in one lookup query.
+	v5LookupDistances = 3
+)
+
+// Errors
+var (
+	ErrorV5HandshakeFailed  = errors.New("discv5 handshake failed")
+	ErrorV5UnexpectedRecord = errors.New("Unexpected record in discv5 response")
+	ErrorV5RateLimited      = errors.New("discv5 request over the rate limit")
+)
+
+// V5Server speaks the Node Discovery Protocol v5.1. Nodes are addressed by
+// Enode like in discv4, since the id is all that is needed for a handshake.
+type V5Server interface {
+	GetIP() string
+	GetUdpPort() int
+	Self() *ENR
+	Start(context.Context)
+	Close() error
+	Ping(context.Context, *Enode) (*PongMessage, error)
+	FindNode(ctx context.Context, node *Enode, distances []uint) ([]*Enode, error)
+	RequestENR(context.Context, *Enode) (*ENR, error)
+	Lookup(ctx context.Context, target []byte) []*Enode
+	RegisterTalkHandler(protocol string, handler TalkHandler)
+	TalkRequest(ctx context.Context, node *Enode, protocol string, payload []byte) ([]byte, error)
+}
+
+// TalkHandler answers a TALKREQ of the protocol it is registered for. nodeID
+// is the discv5 id of the requesting node. The returned payload is sent back
+// in a TALKRESP.
+type TalkHandler func(nodeID []byte, from *net.UDPAddr, payload []byte) []byte
+
+type v5TalkHandler struct {
+	handle      TalkHandler
+	rateLimiter *ipRateLimiter
+}
+
+// v5Call is a request waiting for its responses. nonce is that of the last
+// packet sent for it, which a WHOAREYOU refers to. A call starting the
+// handshake with its node closes handshakeDone when it completes.
+type v5Call struct {
+	node          *Enode
+	nodeID        []byte
+	addr          *net.UDPAddr
+	request       V5Message
+	nonce         []byte
+	handshake     bool
+	handshakeDone chan struct{}
+	responses     chan V5Message
+	failed        chan error
+}
+
+type v5ServerImpl struct {
+	localNode LocalNode
+	id        []byte
+	transport Transport
+	ip        string
+	udpPort   int
+	record    *ENR
+	config    Config
+	clock     Clock
+	table     *Table
+	sessions  *v5SessionCache
+	queue     chan inboundPacket
+	writer    *packetWriter
+
+	// rateLimiter limits the requests of every IP, including the packets we
+	// challenge with a WHOAREYOU.
+	rateLimiter *ipRateLimiter
+
+	mu           sync.Mutex
+	calls        map[string]*v5Call
+	handshakes   map[string]chan struct{}
+	talkHandlers map[string]*v5TalkHandler
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func NewV5Server(localAddress string, localNode LocalNode, config Config) (V5Server, error) {
+	socket, err := net.ListenPacket("udp", localAddress)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewV5ServerWithTransport(socket, localNode, config)
+}
+
+// NewV5ServerWithTransport creates a discv5 server on transport, which it
+// takes ownership of.
+func NewV5ServerWithTransport(transport Transport, localNode LocalNode, config Config) (V5Server, error) {
+	uaddr, ok := transport.LocalAddr().(*net.UDPAddr)
+
+	if !ok {
+		return nil, ErrorUnsupportedAddress
+	}
+
+	config, err := config.withDefaults()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ip, record, err := localRecord(localNode, uaddr, config.ExternalIP, config.TCPPort)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Capture != nil {
+		transport = &captureTransport{transport, config.Capture, config.Clock}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &v5ServerImpl{
+		localNode: localNode,
+		id:        v5NodeID(localNode.GetId()),
+		transport: transport,
+		ip:        ip,
+		udpPort:   uaddr.Port,
+		record:    record,
+		config:    config,
+		clock:     config.Clock,
+		table:     NewTable(localNode.GetId(), config.Clock),
+		sessions:  newV5SessionCache(maxV5Sessions, config.Clock),
+		queue:     make(chan inboundPacket, config.QueueSize),
+		writer: newPacketWriter(transport, config.WriteQueueSize,
+			config.EgressPacketRate, config.EgressByteRate, nil),
+		rateLimiter:  newIPRateLimiter(config.RequestRate, config.RequestBurst, config.Clock),
+		calls:        make(map[string]*v5Call),
+		handshakes:   make(map[string]chan struct{}),
+		talkHandlers: make(map[string]*v5TalkHandler),
+		ctx:          ctx,
+		cancel:       cancel,
+		closed:       make(chan struct{}),
+	}, nil
+}
+
+func (s *v5ServerImpl) GetIP() string   { return s.ip }
+func (s *v5ServerImpl) GetUdpPort() int { return s.udpPort }
+func (s *v5ServerImpl) Self() *ENR      { return s.record }
+
+func (s *v5ServerImpl) Start(ctx context.Context) {
+	fmt.Println("discv5 server starting.", s.ip, s.udpPort)
+
+	for _, node := range s.config.Bootnodes {
+		s.table.AddSeen(node)
+	}
+
+	for i := 0; i < s.config.Workers; i++ {
+		s.spawn(s.worker)
+	}
+
+	s.spawn(s.readLoop)
+	s.spawn(s.writer.loop)
+	s.spawn(s.revalidateLoop)
+	s.spawn(s.refreshLoop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.closed:
+		}
+	}()
+}
+
+func (s *v5ServerImpl) spawn(loop func()) {
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+		loop()
+	}()
+}
+
+// Close stops the server. Requests in flight fail with ErrorServerClosed.
+func (s *v5ServerImpl) Close() error {
+	s.closeOnce.Do(func() {
+		fmt.Println("discv5 server closing.", s.ip, s.udpPort)
+
+		s.cancel()
+		close(s.closed)
+		s.writer.close()
+		s.transport.Close()
+		s.wg.Wait()
+	})
+
+	return nil
+}
+
+func (s *v5ServerImpl) readLoop() {
+	defer close(s.queue)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		numBytes, addr, err := s.transport.ReadFrom(buf)
+
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+
+		if err != nil {
+			fmt.Println("Error reading packet", err)
+
+			select {
+			case <-s.clock.After(readErrorDelay):
+			case <-s.closed:
+				return
+			}
+
+			continue
+		}
+
+		if !s.receive(buf[:numBytes], addr) {
+			packetHandled(s.transport)
+		}
+	}
+}
+
+// receive queues a packet for the workers and reports whether it did.
+func (s *v5ServerImpl) receive(data []byte, addr net.Addr) bool {
+	from, ok := addr.(*net.UDPAddr)
+
+	if !ok {
+		return false
+	}
+
+	packet := inboundPacket{make([]byte, len(data)), from}
+	copy(packet.data, data)
+
+	select {
+	case s.queue <- packet:
+		return true
+	default:
+		fmt.Println("Dropping discv5 packet, queue full", from)
+		return false
+	}
+}
+
+func (s *v5ServerImpl) worker() {
+	for packet := range s.queue {
+		s.handlePacket(packet.data, packet.from)
+		packetHandled(s.transport)
+	}
+}
+
+func (s *v5ServerImpl) handlePacket(data []byte, from *net.UDPAddr) {
+	if !netlistContains(s.config.NetRestrict, from.IP) {
+		fmt.Println("Dropping packet from restricted address", from.IP)
+		return
+	}
+
+	header, headerData, message, err := decodeV5Packet(s.id, data)
+
+	if err == nil {
+		switch header.flag {
+		case v5FlagMessage:
+			err = s.handleMessagePacket(header, headerData, message, from)
+		case v5FlagWhoareyou:
+			err = s.handleWhoareyou(header, headerData, from)
+		case v5FlagHandshake:
+			err = s.handleHandshake(header, headerData, message, from)
+		}
+	}
+
+	if err != nil {
+		fmt.Println("Error handling discv5 packet", err)
+	}
+}
+
+// handleMessagePacket decrypts a message with the session of its sender. A
+// sender without a session, or with one we do not share, is challenged to a
+// handshake.
+func (s *v5ServerImpl) handleMessagePacket(header *v5Header, headerData, message []byte, from *net.UDPAddr) error {
+	srcID := header.authData
+	session := s.sessions.get(srcID, from)
+
+	if session == nil {
+		return s.challenge(srcID, from, header.nonce, nil)
+	}
+
+	plaintext, err := decryptV5Message(session.readKey, header.nonce, message, headerData)
+
+	if err != nil {
+		return s.challenge(srcID, from, header.nonce, session.record)
+	}
+
+	msg, err := decodeV5Message(plaintext)
+
+	if err != nil {
+		return err
+	}
+
+	s.handleMessage(msg, srcID, from)
+	return nil
+}
+
+// challenge answers a packet we cannot decrypt with a WHOAREYOU. The packet
+// usually carries a request and a handshake is costly, so it counts towards
+// the sender's request rate.
+func (s *v5ServerImpl) challenge(destID []byte, to *net.UDPAddr, nonce []byte, record *ENR) error {
+	if !s.rateLimiter.allow(to.IP) {
+		return ErrorV5RateLimited
+	}
+
+	return s.sendWhoareyou(destID, to, nonce, record)
+}
+
+// sendWhoareyou challenges a node to prove its identity. The record sequence
+// number tells it whether to include its record in the handshake.
+func (s *v5ServerImpl) sendWhoareyou(destID []byte, to *net.UDPAddr, nonce []byte, record *ENR) error {
+	whoareyou := &v5Whoareyou{idNonce: randomBytes(v5IDNonceSize)}
+
+	if record != nil {
+		whoareyou.enrSeq = record.Seq()
+	}
+
+	header := newV5Header(v5FlagWhoareyou, nonce, whoareyou.encode())
+	s.sessions.storeChallenge(destID, to, &v5Challenge{header.encode(), s.clock.Now(), record})
+
+	packet, err := encodeV5Packet(destID, header, nil, nil)
+
+	if err != nil {
+		return err
+	}
+
+	return s.writer.write(s.ctx, priorityReply, packet, to)
+}
+
+// handleWhoareyou answers a challenge to one of our requests with a
+// handshake, which carries the request again.
+func (s *v5ServerImpl) handleWhoareyou(header *v5Header, challenge []byte, from *net.UDPAddr) error {
+	whoareyou := decodeV5Whoareyou(header.authData)
+
+	s.mu.Lock()
+	var call *v5Call
+	for _, c := range s.calls {
+		if bytes.Equal(c.nonce, header.nonce) && c.addr.String() == from.String() {
+			call = c
+		}
+	}
+
+	if call == nil {
+		s.mu.Unlock()
+		return nil
+	}
+
+	// A second challenge means the node did not accept our handshake.
+	if call.handshake {
+		s.mu.Unlock()
+		call.fail(ErrorV5HandshakeFailed)
+		return nil
+	}
+
+	call.handshake = true
+	s.mu.Unlock()
+
+	packet, err := s.makeHandshake(call, challenge, whoareyou)
+
+	if err != nil {
+		call.fail(err)
+		return err
+	}
+
+	return s.writer.write(s.ctx, priorityRequest, packet, call.addr)
+}
+
+func (s *v5ServerImpl) makeHandshake(call *v5Call, challenge []byte, whoareyou *v5Whoareyou) ([]byte, error) {
+	pubkey, err := parseV5Pubkey([]byte(call.node.id))
+
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralKey, err := secp256k1.GeneratePrivateKey()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralPrivKey := ephemeralKey.Key.Bytes()
+	ephemeral := ephemeralKey.PubKey().SerializeCompressed()
+	secret := v5ECDH(ephemeralPrivKey[:], pubkey)
+	initiatorKey, recipientKey := deriveV5Keys(secret, s.id, call.nodeID, challenge)
+
+	signature, err := makeV5IDSignature(s.localNode.GetPrivKeyBytes(), challenge, ephemeral, call.nodeID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &v5Handshake{srcID: s.id, signature: signature, ephemeral: ephemeral}
+
+	if whoareyou.enrSeq < s.record.Seq() {
+		if auth.record, err = s.record.ToRLP(); err != nil {
+			return nil, err
+		}
+	}
+
+	plaintext, err := encodeV5Message(call.request)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.sessions.store(call.nodeID, call.addr, &v5Session{initiatorKey, recipientKey, call.node.record})
+
+	nonce := randomBytes(v5NonceSize)
+	s.mu.Lock()
+	call.nonce = nonce
+	s.mu.Unlock()
+
+	return encodeV5Packet(call.nodeID, newV5Header(v5FlagHandshake, nonce, auth.encode()), initiatorKey, plaintext)
+}
+
+// handleHandshake completes a handshake started by our WHOAREYOU and handles
+// the message it carries. Verifying a handshake is costly, so it counts
+// towards the sender's request rate in place of the message.
+func (s *v5ServerImpl) handleHandshake(header *v5Header, headerData, message []byte, from *net.UDPAddr) error {
+	if !s.rateLimiter.allow(from.IP) {
+		return ErrorV5RateLimited
+	}
+
+	auth, err := decodeV5Handshake(header.authData)
+
+	if err != nil {
+		return err
+	}
+
+	challenge := s.sessions.takeChallenge(auth.srcID, from)
+
+	if challenge == nil {
+		return ErrorV5HandshakeFailed
+	}
+
+	record := challenge.record
+
+	if len(auth.record) > 0 {
+		if record, err = DecodeENR(auth.record); err != nil {
+			return err
+		}
+
+		if err := record.Verify(); err != nil {
+			return err
+		}
+	}
+
+	if record == nil {
+		return ErrorV5HandshakeFailed
+	}
+
+	id, err := record.NodeId()
+
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(v5NodeID(id), auth.srcID) {
+		return ErrorV5HandshakeFailed
+	}
+
+	pubkey, err := parseV5Pubkey(id)
+
+	if err != nil {
+		return err
+	}
+
+	err = verifyV5IDSignature(pubkey, auth.signature, challenge.data, auth.ephemeral, s.id)
+
+	if err != nil {
+		return err
+	}
+
+	if len(auth.ephemeral) != v5PubkeySize {
+		return ErrorV5InvalidPubkey
+	}
+
+	ephemeral, err := parseV5Pubkey(auth.ephemeral)
+
+	if err != nil {
+		return err
+	}
+
+	secret := v5ECDH(s.localNode.GetPrivKeyBytes(), ephemeral)
+	initiatorKey, recipientKey := deriveV5Keys(secret, auth.srcID, s.id, challenge.data)
+	plaintext, err := decryptV5Message(initiatorKey, header.nonce, message, headerData)
+
+	if err != nil {
+		return err
+	}
+
+	msg, err := decodeV5Message(plaintext)
+
+	if err != nil {
+		return err
+	}
+
+	s.sessions.store(auth.srcID, from, &v5Session{recipientKey, initiatorKey, record})
+	s.table.AddSeen(v5Enode(id, from, record))
+
+	s.dispatchMessage(msg, auth.srcID, from)
+	return nil
+}
+
+// v5Enode returns a node at the address it was seen at.
+func v5Enode(id []byte, addr *net.UDPAddr, record *ENR) *Enode {
+	node := NewEnode(id, addr, record.TcpPort())
+	node.record = record
+	return node
+}
+
+func (s *v5ServerImpl) handleMessage(msg V5Message, srcID []byte, from *net.UDPAddr) {
+	// Responses to our own requests are not limited.
+	switch msg.(type) {
+	case *PingMessage, *FindNodeMessage, *TalkReqMessage:
+		if !s.rateLimiter.allow(from.IP) {
+			fmt.Println("Dropping discv5 request over the rate limit from", from.IP)
+			return
+		}
+	}
+
+	s.dispatchMessage(msg, srcID, from)
+}
+
+func (s *v5ServerImpl) dispatchMessage(msg V5Message, srcID []byte, from *net.UDPAddr) {
+	switch m := msg.(type) {
+	case *PingMessage:
+		s.handlePing(m, srcID, from)
+	case *FindNodeMessage:
+		s.handleFindNode(m, srcID, from)
+	case *TalkReqMessage:
+		s.handleTalkReq(m, srcID, from)
+	default:
+		s.handleResponse(msg, srcID, from)
+	}
+}
+
+func (s *v5ServerImpl) handlePing(m *PingMessage, srcID []byte, from *net.UDPAddr) {
+	addr := from.AddrPort()
+
+	s.reply(srcID, from, &PongMessage{
+		requestID: m.requestID,
+		enrSeq:    s.record.Seq(),
+		ip:        addr.Addr().Unmap(),
+		port:      addr.Port(),
+	})
+}
+
+func (s *v5ServerImpl) handleFindNode(m *FindNodeMessage, srcID []byte, from *net.UDPAddr) {
+	var records []*ENR
+	seen := map[uint]bool{}
+
+	for _, d := range m.distances {
+		if seen[d] || len(records) >= v5MaxNodes {
+			continue
+		}
+
+		seen[d] = true
+
+		if d == 0 {
+			records = append(records, s.record)
+			continue
+		}
+
+		for _, node := range s.table.AtDistance(int(d), v5MaxNodes-len(records)) {
+			if node.record != nil {
+				records = append(records, node.record)
+			}
+		}
+	}
+
+	// An empty answer is still one message.
+	total := (len(records) + v5NodesPerMessage - 1) / v5NodesPerMessage
+
+	if total == 0 {
+		total = 1
+	}
+
+	for i := 0; i < total; i++ {
+		end := (i + 1) * v5NodesPerMessage
+
+		if end > len(records) {
+			end = len(records)
+		}
+
+		s.reply(srcID, from, &NodesMessage{m.requestID, uint(total), records[i*v5NodesPerMessage : end]})
+	}
+}
+
+// handleTalkReq passes a request to the handler of its protocol. Handlers
+// run in their own goroutine, so that they may block or send requests of
+// their own. Requests of unknown protocols get an empty response.
+func (s *v5ServerImpl) handleTalkReq(m *TalkReqMessage, srcID []byte, from *net.UDPAddr) {
+	s.mu.Lock()
+	handler := s.talkHandlers[m.protocol]
+	s.mu.Unlock()
+
+	if handler == nil {
+		s.reply(srcID, from, &TalkRespMessage{requestID: m.requestID})
+		return
+	}
+
+	if handler.rateLimiter != nil && !handler.rateLimiter.allow(from.IP) {
+		return
+	}
+
+	s.spawn(func() {
+		payload := handler.handle(srcID, from, m.payload)
+		s.reply(srcID, from, &TalkRespMessage{m.requestID, payload})
+	})
+}
+
+// reply sends a message within the session with a node.
+func (s *v5ServerImpl) reply(destID []byte, to *net.UDPAddr, msg V5Message) {
+	session := s.sessions.get(destID, to)
+
+	if session == nil {
+		return
+	}
+
+	plaintext, err := encodeV5Message(msg)
+
+	if err == nil {
+		header := newV5Header(v5FlagMessage, randomBytes(v5NonceSize), s.id)
+		var packet []byte
+
+		if packet, err = encodeV5Packet(destID, header, session.writeKey, plaintext); err == nil {
+			err = s.writer.write(s.ctx, priorityReply, packet, to)
+		}
+	}
+
+	if err != nil {
+		fmt.Println("Failed to send discv5 reply", err)
+	}
+}
+
+// handleResponse passes a response to the request it answers.
+func (s *v5ServerImpl) handleResponse(msg V5Message, srcID []byte, from *net.UDPAddr) {
+	s.mu.Lock()
+	call := s.calls[string(msg.RequestID())]
+	s.mu.Unlock()
+
+	if call == nil || !bytes.Equal(call.nodeID, srcID) || call.addr.String() != from.String() {
+		return
+	}
+
+	select {
+	case call.responses <- msg:
+	default:
+	}
+}
+
+func (c *v5Call) fail(err error) {
+	select {
+	case c.failed <- err:
+	default:
+	}
+}
+
+// request sends a request and passes the responses of the expected type to
+// handle until it reports that the request is complete.
+func (s *v5ServerImpl) request(ctx context.Context, node *Enode, request V5Message,
+	expect V5MessageType, handle func(V5Message) bool) error {
+	remote, err := node.RemoteNode()
+
+	if err != nil {
+		return err
+	}
+
+	call := &v5Call{
+		node:      node,
+		nodeID:    v5NodeID([]byte(node.id)),
+		addr:      remote.address,
+		request:   request,
+		responses: make(chan V5Message, v5MaxNodesMessages),
+		failed:    make(chan error, 1),
+	}
+
+	s.mu.Lock()
+	s.calls[string(request.RequestID())] = call
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.calls, string(request.RequestID()))
+
+		if call.handshakeDone != nil {
+			delete(s.handshakes, v5SessionKey(call.nodeID, call.addr))
+			close(call.handshakeDone)
+		}
+
+		s.mu.Unlock()
+	}()
+
+	if err := s.send(ctx, call); err != nil {
+		return err
+	}
+
+	timeout := s.clock.After(v5RequestTimeout)
+
+	for {
+		select {
+		case msg := <-call.responses:
+			if msg.Type() == expect && handle(msg) {
+				return nil
+			}
+		case err := <-call.failed:
+			return err
+		case <-timeout:
+			return ErrorTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.closed:
+			return ErrorServerClosed
+		}
+	}
+}
+
+// send writes a request within the session with its node. Without a session
+// a packet the node cannot decrypt starts the handshake. Only one handshake
+// with a node is started at a time, as the node keeps one challenge for us;
+// other requests wait for its session.
+func (s *v5ServerImpl) send(ctx context.Context, call *v5Call) error {
+	session := s.sessions.get(call.nodeID, call.addr)
+
+	for session == nil && call.handshakeDone == nil {
+		key := v5SessionKey(call.nodeID, call.addr)
+
+		s.mu.Lock()
+		pending := s.handshakes[key]
+
+		if pending == nil {
+			call.handshakeDone = make(chan struct{})
+			s.handshakes[key] = call.handshakeDone
+		}
+
+		s.mu.Unlock()
+
+		if pending == nil {
+			break
+		}
+
+		select {
+		case <-pending:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.closed:
+			return ErrorServerClosed
+		}
+
+		session = s.sessions.get(call.nodeID, call.addr)
+	}
+
+	nonce := randomBytes(v5NonceSize)
+	header := newV5Header(v5FlagMessage, nonce, s.id)
+
+	var packet []byte
+	var err error
+
+	if session == nil {
+		packet, err = encodeV5Packet(call.nodeID, header, nil, randomBytes(v5RandomMessageSize))
+	} else {
+		var plaintext []byte
+
+		if plaintext, err = encodeV5Message(call.request); err == nil {
+			packet, err = encodeV5Packet(call.nodeID, header, session.writeKey, plaintext)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// The nonce must be known before a WHOAREYOU can refer to it.
+	s.mu.Lock()
+	call.nonce = nonce
+	s.mu.Unlock()
+
+	return s.writer.write(ctx, priorityRequest, packet, call.addr)
+}
+
+func newV5RequestID() []byte {
+	id := make([]byte, v5MaxRequestIDSize)
+	rand.Read(id)
+	return id
+}
+
+func (s *v5ServerImpl) Ping(ctx context.Context, node *Enode) (*PongMessage, error) {
+	var pong *PongMessage
+
+	err := s.request(ctx, node, &PingMessage{newV5RequestID(), s.record.Seq()}, V5PongMessageType,
+		func(msg V5Message) bool {
+			pong = msg.(*PongMessage)
+			return true
+		})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Only nodes with a current record can be handed out to others.
+	if node.record == nil || node.record.Seq() < pong.enrSeq {
+		if record, err := s.RequestENR(ctx, node); err == nil {
+			remote, _ := node.RemoteNode()
+			node = v5Enode([]byte(node.id), remote.address, record)
+		}
+	}
+
+	s.table.AddVerified(node)
+	return pong, nil
+}
+
+// FindNode asks a node for the records at the given log distances from it,
+// where distance 0 is the node itself. Records at other distances are
+// dropped.
+func (s *v5ServerImpl) FindNode(ctx context.Context, node *Enode, distances []uint) ([]*Enode, error) {
+	nodeID := v5NodeID([]byte(node.id))
+	var nodes []*Enode
+	seen := map[string]bool{}
+	received := 0
+
+	err := s.request(ctx, node, &FindNodeMessage{newV5RequestID(), distances}, V5NodesMessageType,
+		func(msg V5Message) bool {
+			m := msg.(*NodesMessage)
+			received++
+
+			for _, record := range m.records {
+				found, err := s.checkRecord(nodeID, distances, record)
+
+				if err != nil {
+					fmt.Println("Dropping record", err)
+					continue
+				}
+
+				if !seen[found.id] {
+					seen[found.id] = true
+					nodes = append(nodes, found)
+				}
+			}
+
+			return received >= int(m.total) || received >= v5MaxNodesMessages
+		})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// checkRecord validates a record returned by the node with id nodeID for a
+// FINDNODE request.
+func (s *v5ServerImpl) checkRecord(nodeID []byte, distances []uint, record *ENR) (*Enode, error) {
+	id, err := recordNodeID(record)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d := uint(logDistance(nodeID, id))
+	requested := false
+
+	for _, distance := range distances {
+		requested = requested || distance == d
+	}
+
+	if !requested {
+		return nil, ErrorV5UnexpectedRecord
+	}
+
+	node, err := EnodeFromENR(record)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(node.host); !netlistContains(s.config.NetRestrict, ip) {
+		return nil, ErrorRestrictedIP
+	}
+
+	return node, nil
+}
+
+// RequestENR fetches the current record of a node.
+func (s *v5ServerImpl) RequestENR(ctx context.Context, node *Enode) (*ENR, error) {
+	nodes, err := s.FindNode(ctx, node, []uint{0})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nodes) == 0 {
+		return nil, ErrorV5UnexpectedRecord
+	}
+
+	return nodes[0].record, nil
+}
+
+// Lookup finds the nodes closest to target, asking each node for the
+// distances around that of target from it.
+func (s *v5ServerImpl) Lookup(ctx context.Context, target []byte) []*Enode {
+	targetID := v5NodeID(target)
+
+	return lookup(ctx, s.table, s.localNode.GetId(), target, func(ctx context.Context, node *Enode) []*Enode {
+		nodes, err := s.FindNode(ctx, node, lookupDistances(targetID, v5NodeID([]byte(node.id))))
+
+		if err != nil && ctx.Err() == nil && err != ErrorServerClosed {
+			fmt.Println("Lookup query failed", err)
+		}
+
+		return nodes
+	})
+}
+
+// RegisterTalkHandler sets the handler of a TALKREQ protocol, replacing an
+// earlier one. Protocols with an entry in Config.TalkRateLimits are rate
+// limited on their own as well.
+func (s *v5ServerImpl) RegisterTalkHandler(protocol string, handler TalkHandler) {
+	var rateLimiter *ipRateLimiter
+
+	if limit, ok := s.config.TalkRateLimits[protocol]; ok {
+		rateLimiter = newIPRateLimiter(limit.Rate, limit.Burst, s.clock)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.talkHandlers[protocol] = &v5TalkHandler{handler, rateLimiter}
+}
+
+// TalkRequest sends a request of an application protocol to a node and
+// returns its response. It fails with ErrorTimeout if the node does not
+// answer in time; ctx may set a shorter deadline. Payloads that do not fit a
+// packet fail with ErrorV5PacketTooLarge.
+func (s *v5ServerImpl) TalkRequest(ctx context.Context, node *Enode, protocol string, payload []byte) ([]byte, error) {
+	var response []byte
+
+	err := s.request(ctx, node, &TalkReqMessage{newV5RequestID(), protocol, payload}, V5TalkRespMessageType,
+		func(msg V5Message) bool {
+			response = msg.(*TalkRespMessage).payload
+			return true
+		})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// lookupDistances returns the distance of target from a node and the ones
+// next to it, where the nodes closest to target are most likely found.
+func lookupDistances(target, nodeID []byte) []uint {
+	d := logDistance(target, nodeID)
+	distances := []uint{uint(d)}
+
+	for i := 1; len(distances) < v5LookupDistances && i < hashLength*8; i++ {
+		if d+i <= hashLength*8 {
+			distances = append(distances, uint(d+i))
+		}
+
+		if d-i > 0 {
+			distances = append(distances, uint(d-i))
+		}
+	}
+
+	return distances
+}
+
+// revalidateLoop pings the least recently seen node of a random bucket,
+// like its discv4 counterpart.
+func (s *v5ServerImpl) revalidateLoop() {
+	for {
+		delay := revalidateDelay(s.config.RevalidateInterval)
+
+		select {
+		case <-s.clock.After(delay):
+		case <-s.closed:
+			return
+		}
+
+		node := s.table.nodeToRevalidate()
+
+		if node == nil {
+			continue
+		}
+
+		_, err := s.Ping(s.ctx, node)
+
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		s.table.revalidated(node, err == nil)
+	}
+}
+
+// refreshLoop looks up our own id and a random target, falling back to the
+// bootnodes when the table is empty.
+func (s *v5ServerImpl) refreshLoop() {
+	for {
+		if s.table.Len() == 0 {
+			for _, node := range s.config.Bootnodes {
+				s.table.AddSeen(node)
+			}
+		}
+
+		s.Lookup(s.ctx, s.localNode.GetId())
+
+		target := make([]byte, nodeIdLength)
+		rand.Read(target)
+		s.Lookup(s.ctx, target)
+
+		select {
+		case <-s.clock.After(s.config.RefreshInterval):
+		case <-s.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Above this many sessions the oldest are forgotten, which costs the
+	// node a new handshake.
+	maxV5Sessions = 1024
+
+	// How long a WHOAREYOU challenge may be answered.
+	v5ChallengeTimeout = time.Second
+)
+
+// v5Session holds the keys agreed on in a handshake with a node at an
+// address, and the node's record if it is known.
+type v5Session struct {
+	writeKey []byte
+	readKey  []byte
+	record   *ENR
+}
+
+// v5Challenge is a WHOAREYOU we sent, waiting for the handshake answering it.
+type v5Challenge struct {
+	data   []byte
+	sentAt time.Time
+	record *ENR
+}
+
+// v5SessionCache keeps the sessions and outstanding challenges of a server.
+// Both are keyed by node id and address, so that a node moving to another
+// address has to repeat the handshake.
+type v5SessionCache struct {
+	mu         sync.Mutex
+	clock      Clock
+	limit      int
+	sessions   map[string]*v5Session
+	order      []string
+	challenges map[string]*v5Challenge
+}
+
+func newV5SessionCache(limit int, clock Clock) *v5SessionCache {
+	return &v5SessionCache{
+		clock:      clock,
+		limit:      limit,
+		sessions:   make(map[string]*v5Session),
+		challenges: make(map[string]*v5Challenge),
+	}
+}
+
+func v5SessionKey(id []byte, addr *net.UDPAddr) string {
+	return string(id) + addr.String()
+}
+
+func (c *v5SessionCache) get(id []byte, addr *net.UDPAddr) *v5Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.sessions[v5SessionKey(id, addr)]
+}
+
+// store adds or replaces the session with a node.
+func (c *v5SessionCache) store(id []byte, addr *net.UDPAddr, session *v5Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := v5SessionKey(id, addr)
+
+	if _, ok := c.sessions[key]; !ok {
+		if len(c.order) >= c.limit {
+			delete(c.sessions, c.order[0])
+			c.order = c.order[1:]
+		}
+
+		c.order = append(c.order, key)
+	}
+
+	c.sessions[key] = session
+}
+
+// storeChallenge remembers a WHOAREYOU sent to a node, replacing an earlier
+// one. Expired challenges make room once there are as many as sessions.
+func (c *v5SessionCache) storeChallenge(id []byte, addr *net.UDPAddr, challenge *v5Challenge) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.challenges) >= c.limit {
+		now := c.clock.Now()
+
+		for key, ch := range c.challenges {
+			if now.Sub(ch.sentAt) > v5ChallengeTimeout {
+				delete(c.challenges, key)
+			}
+		}
+
+		if len(c.challenges) >= c.limit {
+			return
+		}
+	}
+
+	c.challenges[v5SessionKey(id, addr)] = challenge
+}
+
+// takeChallenge removes and returns the challenge sent to a node, or nil if
+// there is none or it has expired.
+func (c *v5SessionCache) takeChallenge(id []byte, addr *net.UDPAddr) *v5Challenge {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := v5SessionKey(id, addr)
+	challenge := c.challenges[key]
+	delete(c.challenges, key)
+
+	if challenge == nil || c.clock.Now().Sub(challenge.sentAt) > v5ChallengeTimeout {
+		return nil
+	}
+
+	return challenge
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+)
+
+func startV5TestServer(t *testing.T, bootnodes ...*Enode) (V5Server, *Enode) {
+	return startV5TestServerWithConfig(t, Config{Bootnodes: bootnodes})
+}
+
+func startV5TestServerWithConfig(t *testing.T, config Config) (V5Server, *Enode) {
+	localNode, err := NewLocalNode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewV5Server("127.0.0.1:0", localNode, config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	t.Cleanup(func() { server.Close() })
+
+	address := &net.UDPAddr{IP: net.ParseIP(server.GetIP()), Port: server.GetUdpPort()}
+	return server, NewEnode(localNode.GetId(), address, 0)
+}
+
+func TestV5Ping(t *testing.T) {
+	a, aNode := startV5TestServer(t)
+	b, bNode := startV5TestServer(t)
+
+	// The first ping needs a handshake, the second one uses the session.
+	for i := 0; i < 2; i++ {
+		pong, err := a.Ping(context.Background(), bNode)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pong.Addr().Port() != uint16(a.GetUdpPort()) || pong.EnrSeq() != b.Self().Seq() {
+			t.Error("Unexpected pong", pong.Addr(), pong.EnrSeq())
+		}
+	}
+
+	// B learned A's record in the handshake and can ping back within the
+	// same session.
+	if _, err := b.Ping(context.Background(), aNode); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestV5RequestENR(t *testing.T) {
+	a, _ := startV5TestServer(t)
+	b, bNode := startV5TestServer(t)
+
+	record, err := a.RequestENR(context.Background(), bNode)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.URL() != b.Self().URL() {
+		t.Error("Unexpected record", record.URL())
+	}
+}
+
+func TestV5FindNode(t *testing.T) {
+	a, aNode := startV5TestServer(t)
+	_, bNode := startV5TestServer(t)
+
+	// Nodes pinging B end up in its table together with their records. This
+	// includes A, which takes part in the handshake of its first request.
+	distances := map[uint]bool{}
+	ids := map[string]bool{}
+
+	for i := 0; i < 4; i++ {
+		c, cNode := a, aNode
+
+		if i > 0 {
+			c, cNode = startV5TestServer(t)
+		}
+
+		if _, err := c.Ping(context.Background(), bNode); err != nil {
+			t.Fatal(err)
+		}
+
+		ids[cNode.id] = true
+		distances[uint(logDistance(v5NodeID([]byte(bNode.id)), v5NodeID([]byte(cNode.id))))] = true
+	}
+
+	var query []uint
+	for d := range distances {
+		query = append(query, d)
+	}
+
+	nodes, err := a.FindNode(context.Background(), bNode, query)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range nodes {
+		if !ids[node.id] || node.record == nil {
+			t.Error("Unexpected node", node.URL())
+		}
+
+		delete(ids, node.id)
+	}
+
+	if len(ids) != 0 {
+		t.Error("Expected all nodes pinging B", len(ids))
+	}
+
+	// Distance 0 is B itself.
+	nodes, err = a.FindNode(context.Background(), bNode, []uint{0})
+
+	if err != nil || len(nodes) != 1 || nodes[0].id != bNode.id {
+		t.Error("Expected B's own record", nodes, err)
+	}
+}
+
+func TestV5Lookup(t *testing.T) {
+	_, bootNode := startV5TestServer(t)
+
+	var others []*Enode
+	for i := 0; i < 3; i++ {
+		server, node := startV5TestServer(t)
+
+		if _, err := server.Ping(context.Background(), bootNode); err != nil {
+			t.Fatal(err)
+		}
+
+		others = append(others, node)
+	}
+
+	server, _ := startV5TestServer(t, bootNode)
+
+	// Looking up a node's id asks the bootnode for the distance the node is
+	// at, which finds it.
+	for _, other := range others {
+		found := false
+
+		for _, node := range server.Lookup(context.Background(), []byte(other.id)) {
+			found = found || (node.id == other.id && bytes.Equal([]byte(node.host), []byte(other.host)))
+		}
+
+		if !found {
+			t.Error("Expected lookup to find node", other.URL())
+		}
+	}
+}
+
+func TestV5TalkRequest(t *testing.T) {
+	a, aNode := startV5TestServer(t)
+	b, bNode := startV5TestServer(t)
+
+	b.RegisterTalkHandler("echo", func(nodeID []byte, from *net.UDPAddr, payload []byte) []byte {
+		if !bytes.Equal(nodeID, v5NodeID([]byte(aNode.id))) || from.Port != a.GetUdpPort() {
+			t.Error("Unexpected requester", nodeID, from)
+		}
+
+		return append([]byte("echo "), payload...)
+	})
+
+	response, err := a.TalkRequest(context.Background(), bNode, "echo", []byte("hello"))
+
+	if err != nil || string(response) != "echo hello" {
+		t.Error("Unexpected response", string(response), err)
+	}
+
+	// Unknown protocols are answered with an empty response.
+	response, err = a.TalkRequest(context.Background(), bNode, "unknown", []byte("hello"))
+
+	if err != nil || len(response) != 0 {
+		t.Error("Expected empty response", response, err)
+	}
+
+	if _, err := a.TalkRequest(context.Background(), bNode, "echo", make([]byte, maxDatagramSize)); err != ErrorV5PacketTooLarge {
+		t.Error("Expected payload to be too large", err)
+	}
+}
+
+func TestV5TalkRateLimit(t *testing.T) {
+	a, _ := startV5TestServer(t)
+	b, bNode := startV5TestServerWithConfig(t, Config{
+		TalkRateLimits: map[string]RateLimit{"limited": {Rate: 0.001, Burst: 2}},
+	})
+
+	handler := func(nodeID []byte, from *net.UDPAddr, payload []byte) []byte { return payload }
+	b.RegisterTalkHandler("limited", handler)
+	b.RegisterTalkHandler("other", handler)
+
+	for i := 0; i < 2; i++ {
+		if _, err := a.TalkRequest(context.Background(), bNode, "limited", []byte{1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := a.TalkRequest(context.Background(), bNode, "limited", []byte{1}); err != ErrorTimeout {
+		t.Error("Expected request above the limit to time out", err)
+	}
+
+	// Other protocols have limits of their own.
+	if _, err := a.TalkRequest(context.Background(), bNode, "other", []byte{1}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestV5HandshakeRateLimit(t *testing.T) {
+	a, _ := startV5TestServer(t)
+	_, bNode := startV5TestServerWithConfig(t, Config{RequestRate: 0.001, RequestBurst: 1})
+
+	// The challenge takes the only request, so the handshake answering it
+	// is dropped before it is verified.
+	if _, err := a.Ping(context.Background(), bNode); err != ErrorTimeout {
+		t.Error("Expected handshake above the limit to time out", err)
+	}
+}
+
+func TestV5RequestRateLimit(t *testing.T) {
+	a, _ := startV5TestServer(t)
+	_, bNode := startV5TestServerWithConfig(t, Config{RequestRate: 0.001, RequestBurst: 4})
+
+	// The first ping is challenged, carried by the handshake and followed by
+	// a request for B's record, which takes three of the four requests. The
+	// second ping takes the last one.
+	for i := 0; i < 2; i++ {
+		if _, err := a.Ping(context.Background(), bNode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := a.Ping(context.Background(), bNode); err != ErrorTimeout {
+		t.Error("Expected ping above the limit to time out", err)
+	}
+
+	// Another node on the same IP is not even challenged.
+	c, _ := startV5TestServer(t)
+
+	if _, err := c.Ping(context.Background(), bNode); err != ErrorTimeout {
+		t.Error("Expected handshake above the limit to time out", err)
+	}
+}
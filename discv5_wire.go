@@ -0,0 +1,697 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Packet flags
+const (
+	v5FlagMessage   byte = 0
+	v5FlagWhoareyou byte = 1
+	v5FlagHandshake byte = 2
+)
+
+type V5MessageType byte
+
+// Message types
+const (
+	V5PingMessageType     V5MessageType = 0x01
+	V5PongMessageType     V5MessageType = 0x02
+	V5FindNodeMessageType V5MessageType = 0x03
+	V5NodesMessageType    V5MessageType = 0x04
+	V5TalkReqMessageType  V5MessageType = 0x05
+	V5TalkRespMessageType V5MessageType = 0x06
+)
+
+const (
+	v5ProtocolID = "discv5"
+	v5Version    = 1
+
+	v5MaskingIVSize    = 16
+	v5StaticHeaderSize = 23
+	v5NonceSize        = 12
+	v5IDNonceSize      = 16
+	v5NodeIDSize       = 32
+	v5KeySize          = 16
+	v5GCMTagSize       = 16
+	v5SignatureSize    = 64
+	v5PubkeySize       = 33
+
+	// Smallest packet the protocol produces, a WHOAREYOU.
+	v5MinPacketSize = v5MaskingIVSize + v5StaticHeaderSize + v5IDNonceSize + 8
+
+	// Sizes of the authdata of WHOAREYOU packets and of the fixed part of
+	// handshake packets.
+	v5WhoareyouAuthSize = v5IDNonceSize + 8
+	v5HandshakeHeadSize = v5NodeIDSize + 2
+
+	// Message of a packet sent before a session exists, which the recipient
+	// cannot decrypt and answers with a WHOAREYOU.
+	v5RandomMessageSize = 20
+
+	v5MaxRequestIDSize = 8
+
+	v5KeyAgreementInfo = "discovery v5 key agreement"
+	v5IDProofText      = "discovery v5 identity proof"
+)
+
+// Errors
+var (
+	ErrorV5PacketTooSmall     = errors.New("discv5 packet too small")
+	ErrorV5PacketTooLarge     = errors.New("discv5 packet too large")
+	ErrorV5InvalidHeader      = errors.New("Invalid discv5 header")
+	ErrorV5InvalidFlag        = errors.New("Invalid discv5 packet flag")
+	ErrorV5InvalidAuthData    = errors.New("Invalid discv5 authdata")
+	ErrorV5DecryptionFailed   = errors.New("discv5 message decryption failed")
+	ErrorV5InvalidMessage     = errors.New("Invalid discv5 message")
+	ErrorV5InvalidMessageType = errors.New("Invalid discv5 message type")
+	ErrorV5InvalidRequestID   = errors.New("Invalid discv5 request id")
+	ErrorV5InvalidPubkey      = errors.New("Invalid discv5 public key")
+	ErrorV5InvalidIDSignature = errors.New("Invalid discv5 id signature")
+)
+
+// v5NodeID returns the discv5 id of a node, the keccak256 hash of its 64 byte
+// public key, which is also its key in the table.
+func v5NodeID(id []byte) []byte {
+	return Keccak256(id)
+}
+
+// v5Header is the unmasked header of a packet.
+type v5Header struct {
+	maskingIV []byte
+	flag      byte
+	nonce     []byte
+	authData  []byte
+}
+
+func newV5Header(flag byte, nonce, authData []byte) *v5Header {
+	return &v5Header{randomBytes(v5MaskingIVSize), flag, nonce, authData}
+}
+
+// encode returns masking-iv || static-header || authdata. This is the
+// additional data of the message encryption and, for WHOAREYOU packets, the
+// challenge-data of the handshake.
+func (h *v5Header) encode() []byte {
+	buf := make([]byte, 0, v5MaskingIVSize+v5StaticHeaderSize+len(h.authData))
+	buf = append(buf, h.maskingIV...)
+	buf = append(buf, v5ProtocolID...)
+	buf = binary.BigEndian.AppendUint16(buf, v5Version)
+	buf = append(buf, h.flag)
+	buf = append(buf, h.nonce...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(h.authData)))
+	return append(buf, h.authData...)
+}
+
+// maskV5Header encrypts everything after the masking IV of an encoded header
+// with the first 16 bytes of the destination id.
+func maskV5Header(destID, header []byte) []byte {
+	masked := make([]byte, len(header))
+	copy(masked, header[:v5MaskingIVSize])
+	maskingStream(destID, header[:v5MaskingIVSize]).
+		XORKeyStream(masked[v5MaskingIVSize:], header[v5MaskingIVSize:])
+	return masked
+}
+
+func maskingStream(id, iv []byte) cipher.Stream {
+	block, _ := aes.NewCipher(id[:v5KeySize])
+	return cipher.NewCTR(block, iv)
+}
+
+// encodeV5Packet builds a packet, encrypting the message with key. Packets
+// without a message, i.e. WHOAREYOU, pass nil for both.
+func encodeV5Packet(destID []byte, header *v5Header, key, message []byte) ([]byte, error) {
+	encoded := header.encode()
+	packet := maskV5Header(destID, encoded)
+
+	if key == nil {
+		packet = append(packet, message...)
+	} else {
+		ciphertext, err := encryptV5Message(key, header.nonce, message, encoded)
+
+		if err != nil {
+			return nil, err
+		}
+
+		packet = append(packet, ciphertext...)
+	}
+
+	if len(packet) > maxDatagramSize {
+		return nil, ErrorV5PacketTooLarge
+	}
+
+	return packet, nil
+}
+
+// decodeV5Packet unmasks the header of a packet addressed to localID. It
+// returns the header, the header in encoded form and the still encrypted
+// message.
+func decodeV5Packet(localID, data []byte) (*v5Header, []byte, []byte, error) {
+	if len(data) < v5MinPacketSize {
+		return nil, nil, nil, ErrorV5PacketTooSmall
+	}
+
+	iv := data[:v5MaskingIVSize]
+	stream := maskingStream(localID, iv)
+
+	static := make([]byte, v5StaticHeaderSize)
+	stream.XORKeyStream(static, data[v5MaskingIVSize:v5MaskingIVSize+v5StaticHeaderSize])
+
+	if string(static[:len(v5ProtocolID)]) != v5ProtocolID ||
+		binary.BigEndian.Uint16(static[6:8]) != v5Version {
+		return nil, nil, nil, ErrorV5InvalidHeader
+	}
+
+	authSize := int(binary.BigEndian.Uint16(static[21:23]))
+	authStart := v5MaskingIVSize + v5StaticHeaderSize
+
+	if authStart+authSize > len(data) {
+		return nil, nil, nil, ErrorV5InvalidHeader
+	}
+
+	authData := make([]byte, authSize)
+	stream.XORKeyStream(authData, data[authStart:authStart+authSize])
+
+	header := &v5Header{
+		maskingIV: append([]byte{}, iv...),
+		flag:      static[8],
+		nonce:     static[9:21],
+		authData:  authData,
+	}
+
+	message := data[authStart+authSize:]
+
+	switch header.flag {
+	case v5FlagMessage:
+		if authSize != v5NodeIDSize {
+			return nil, nil, nil, ErrorV5InvalidAuthData
+		}
+	case v5FlagWhoareyou:
+		if authSize != v5WhoareyouAuthSize || len(message) != 0 {
+			return nil, nil, nil, ErrorV5InvalidAuthData
+		}
+	case v5FlagHandshake:
+		if authSize < v5HandshakeHeadSize {
+			return nil, nil, nil, ErrorV5InvalidAuthData
+		}
+	default:
+		return nil, nil, nil, ErrorV5InvalidFlag
+	}
+
+	return header, header.encode(), message, nil
+}
+
+// v5Whoareyou is the authdata of a WHOAREYOU packet.
+type v5Whoareyou struct {
+	idNonce []byte
+	enrSeq  uint64
+}
+
+func (w *v5Whoareyou) encode() []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, w.idNonce...), w.enrSeq)
+}
+
+func decodeV5Whoareyou(authData []byte) *v5Whoareyou {
+	return &v5Whoareyou{
+		idNonce: authData[:v5IDNonceSize],
+		enrSeq:  binary.BigEndian.Uint64(authData[v5IDNonceSize:]),
+	}
+}
+
+// v5Handshake is the authdata of a handshake packet. The record is only sent
+// when the recipient's copy is out of date.
+type v5Handshake struct {
+	srcID     []byte
+	signature []byte
+	ephemeral []byte
+	record    []byte
+}
+
+func (h *v5Handshake) encode() []byte {
+	buf := append([]byte{}, h.srcID...)
+	buf = append(buf, byte(len(h.signature)), byte(len(h.ephemeral)))
+	buf = append(buf, h.signature...)
+	buf = append(buf, h.ephemeral...)
+	return append(buf, h.record...)
+}
+
+func decodeV5Handshake(authData []byte) (*v5Handshake, error) {
+	sigSize := int(authData[v5NodeIDSize])
+	keySize := int(authData[v5NodeIDSize+1])
+	rest := authData[v5HandshakeHeadSize:]
+
+	if len(rest) < sigSize+keySize {
+		return nil, ErrorV5InvalidAuthData
+	}
+
+	return &v5Handshake{
+		srcID:     authData[:v5NodeIDSize],
+		signature: rest[:sigSize],
+		ephemeral: rest[sigSize : sigSize+keySize],
+		record:    rest[sigSize+keySize:],
+	}, nil
+}
+
+func encryptV5Message(key, nonce, plaintext, ad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func decryptV5Message(key, nonce, ciphertext, ad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, ad)
+
+	if err != nil {
+		return nil, ErrorV5DecryptionFailed
+	}
+
+	return plaintext, nil
+}
+
+// parseV5Pubkey parses a compressed public key, or a 64 byte node id.
+func parseV5Pubkey(key []byte) (*secp256k1.PublicKey, error) {
+	if len(key) == nodeIdLength {
+		key = append([]byte{0x04}, key...)
+	}
+
+	pubkey, err := secp256k1.ParsePubKey(key)
+
+	if err != nil {
+		return nil, ErrorV5InvalidPubkey
+	}
+
+	return pubkey, nil
+}
+
+// v5ECDH returns the shared secret of a key exchange as a compressed point.
+func v5ECDH(privKey []byte, pubkey *secp256k1.PublicKey) []byte {
+	var k secp256k1.ModNScalar
+	k.SetByteSlice(privKey)
+
+	var point, shared secp256k1.JacobianPoint
+	pubkey.AsJacobian(&point)
+	secp256k1.ScalarMultNonConst(&k, &point, &shared)
+	shared.ToAffine()
+
+	return secp256k1.NewPublicKey(&shared.X, &shared.Y).SerializeCompressed()
+}
+
+// deriveV5Keys derives the session keys of a handshake between initiator A
+// and recipient B from the shared secret and the challenge-data of the
+// WHOAREYOU packet.
+func deriveV5Keys(secret, idA, idB, challenge []byte) (initiatorKey, recipientKey []byte) {
+	info := append([]byte(v5KeyAgreementInfo), idA...)
+	info = append(info, idB...)
+
+	keys := make([]byte, 2*v5KeySize)
+	io.ReadFull(hkdf.New(sha256.New, secret, challenge, info), keys)
+
+	return keys[:v5KeySize], keys[v5KeySize:]
+}
+
+func v5IDSignatureHash(challenge, ephemeral, destID []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(v5IDProofText))
+	h.Write(challenge)
+	h.Write(ephemeral)
+	h.Write(destID)
+	return h.Sum(nil)
+}
+
+// makeV5IDSignature proves that the sender of a handshake holds its static
+// key.
+func makeV5IDSignature(privKey, challenge, ephemeral, destID []byte) ([]byte, error) {
+	sig, err := Sign(v5IDSignatureHash(challenge, ephemeral, destID), privKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The recovery id is not part of the signature.
+	return sig[:v5SignatureSize], nil
+}
+
+func verifyV5IDSignature(pubkey *secp256k1.PublicKey, sig, challenge, ephemeral, destID []byte) error {
+	if len(sig) != v5SignatureSize ||
+		!VerifySignature(pubkey.SerializeCompressed(), v5IDSignatureHash(challenge, ephemeral, destID), sig) {
+		return ErrorV5InvalidIDSignature
+	}
+
+	return nil
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// V5Message is a decrypted discv5 message.
+type V5Message interface {
+	Type() V5MessageType
+	RequestID() []byte
+	toList() []any
+}
+
+type PingMessage struct {
+	requestID []byte
+	enrSeq    uint64
+}
+
+type PongMessage struct {
+	requestID []byte
+	enrSeq    uint64
+	ip        netip.Addr
+	port      uint16
+}
+
+type FindNodeMessage struct {
+	requestID []byte
+	distances []uint
+}
+
+// NodesMessage is one of total messages answering a FindNodeMessage.
+type NodesMessage struct {
+	requestID []byte
+	total     uint
+	records   []*ENR
+}
+
+// TalkReqMessage carries a request of an application protocol.
+type TalkReqMessage struct {
+	requestID []byte
+	protocol  string
+	payload   []byte
+}
+
+// TalkRespMessage answers a TalkReqMessage. The payload is empty if the
+// protocol is unknown to the node.
+type TalkRespMessage struct {
+	requestID []byte
+	payload   []byte
+}
+
+func (m *PingMessage) Type() V5MessageType     { return V5PingMessageType }
+func (m *PongMessage) Type() V5MessageType     { return V5PongMessageType }
+func (m *FindNodeMessage) Type() V5MessageType { return V5FindNodeMessageType }
+func (m *NodesMessage) Type() V5MessageType    { return V5NodesMessageType }
+func (m *TalkReqMessage) Type() V5MessageType  { return V5TalkReqMessageType }
+func (m *TalkRespMessage) Type() V5MessageType { return V5TalkRespMessageType }
+
+func (m *PingMessage) RequestID() []byte     { return m.requestID }
+func (m *PongMessage) RequestID() []byte     { return m.requestID }
+func (m *FindNodeMessage) RequestID() []byte { return m.requestID }
+func (m *NodesMessage) RequestID() []byte    { return m.requestID }
+func (m *TalkReqMessage) RequestID() []byte  { return m.requestID }
+func (m *TalkRespMessage) RequestID() []byte { return m.requestID }
+
+// EnrSeq is the record sequence number of the node that sent the pong.
+func (m *PongMessage) EnrSeq() uint64 { return m.enrSeq }
+
+// Addr is the address the pong's sender saw the ping coming from.
+func (m *PongMessage) Addr() netip.AddrPort { return netip.AddrPortFrom(m.ip, m.port) }
+
+func (m *PingMessage) toList() []any {
+	return []any{string(m.requestID), m.enrSeq}
+}
+
+func (m *PongMessage) toList() []any {
+	return []any{string(m.requestID), m.enrSeq, ipBytes(m.ip), uint(m.port)}
+}
+
+func (m *FindNodeMessage) toList() []any {
+	distances := []any{}
+	for _, d := range m.distances {
+		distances = append(distances, d)
+	}
+
+	return []any{string(m.requestID), distances}
+}
+
+func (m *NodesMessage) toList() []any {
+	records := []any{}
+	for _, record := range m.records {
+		records = append(records, record.toList())
+	}
+
+	return []any{string(m.requestID), m.total, records}
+}
+
+func (m *TalkReqMessage) toList() []any {
+	return []any{string(m.requestID), m.protocol, string(m.payload)}
+}
+
+func (m *TalkRespMessage) toList() []any {
+	return []any{string(m.requestID), string(m.payload)}
+}
+
+// encodeV5Message returns the plaintext of a message, its type followed by
+// its RLP.
+func encodeV5Message(m V5Message) ([]byte, error) {
+	data, err := Encode(m.toList())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{byte(m.Type())}, data...), nil
+}
+
+// Like the discv4 decoders, message decoders ignore trailing list elements.
+func decodeV5Message(data []byte) (V5Message, error) {
+	if len(data) < 2 {
+		return nil, ErrorV5InvalidMessage
+	}
+
+	decoded, err := Decode(data[1:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := decoded.([]any)
+
+	if !ok || len(list) < 1 {
+		return nil, ErrorV5InvalidMessage
+	}
+
+	requestID, ok := list[0].(string)
+
+	if !ok || len(requestID) > v5MaxRequestIDSize {
+		return nil, ErrorV5InvalidRequestID
+	}
+
+	switch V5MessageType(data[0]) {
+	case V5PingMessageType:
+		return decodeV5Ping([]byte(requestID), list)
+	case V5PongMessageType:
+		return decodeV5Pong([]byte(requestID), list)
+	case V5FindNodeMessageType:
+		return decodeV5FindNode([]byte(requestID), list)
+	case V5NodesMessageType:
+		return decodeV5Nodes([]byte(requestID), list)
+	case V5TalkReqMessageType:
+		return decodeV5TalkReq([]byte(requestID), list)
+	case V5TalkRespMessageType:
+		return decodeV5TalkResp([]byte(requestID), list)
+	}
+
+	return nil, ErrorV5InvalidMessageType
+}
+
+func decodeV5Ping(requestID []byte, list []any) (*PingMessage, error) {
+	if len(list) < 2 {
+		return nil, ErrorV5InvalidMessage
+	}
+
+	enrSeq, err := decodeUint(list[1], 8)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &PingMessage{requestID, enrSeq}, nil
+}
+
+func decodeV5Pong(requestID []byte, list []any) (*PongMessage, error) {
+	if len(list) < 4 {
+		return nil, ErrorV5InvalidMessage
+	}
+
+	enrSeq, err := decodeUint(list[1], 8)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := decodeIP(list[2])
+
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := decodePort(list[3])
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &PongMessage{requestID, enrSeq, ip, port}, nil
+}
+
+func decodeV5FindNode(requestID []byte, list []any) (*FindNodeMessage, error) {
+	if len(list) < 2 {
+		return nil, ErrorV5InvalidMessage
+	}
+
+	items, ok := asList(list[1])
+
+	if !ok {
+		return nil, ErrorV5InvalidMessage
+	}
+
+	var distances []uint
+	for _, item := range items {
+		d, err := decodeUint(item, 2)
+
+		if err != nil || d > hashLength*8 {
+			return nil, ErrorV5InvalidMessage
+		}
+
+		distances = append(distances, uint(d))
+	}
+
+	return &FindNodeMessage{requestID, distances}, nil
+}
+
+func decodeV5Nodes(requestID []byte, list []any) (*NodesMessage, error) {
+	if len(list) < 3 {
+		return nil, ErrorV5InvalidMessage
+	}
+
+	total, err := decodeUint(list[1], 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	items, ok := asList(list[2])
+
+	if !ok {
+		return nil, ErrorV5InvalidMessage
+	}
+
+	var records []*ENR
+	for _, item := range items {
+		record, err := decodeV5Record(item)
+
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	return &NodesMessage{requestID, uint(total), records}, nil
+}
+
+func decodeV5TalkReq(requestID []byte, list []any) (*TalkReqMessage, error) {
+	if len(list) < 3 {
+		return nil, ErrorV5InvalidMessage
+	}
+
+	protocol, ok := list[1].(string)
+
+	if !ok {
+		return nil, ErrorV5InvalidMessage
+	}
+
+	payload, ok := list[2].(string)
+
+	if !ok {
+		return nil, ErrorV5InvalidMessage
+	}
+
+	return &TalkReqMessage{requestID, protocol, []byte(payload)}, nil
+}
+
+func decodeV5TalkResp(requestID []byte, list []any) (*TalkRespMessage, error) {
+	if len(list) < 2 {
+		return nil, ErrorV5InvalidMessage
+	}
+
+	payload, ok := list[1].(string)
+
+	if !ok {
+		return nil, ErrorV5InvalidMessage
+	}
+
+	return &TalkRespMessage{requestID, []byte(payload)}, nil
+}
+
+// decodeV5Record decodes and verifies a record embedded in a message.
+func decodeV5Record(item any) (*ENR, error) {
+	list, ok := item.([]any)
+
+	if !ok {
+		return nil, ErrorInvalidENR
+	}
+
+	record, err := decodeENRList(list)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if encoded, err := record.ToRLP(); err != nil || len(encoded) > maxENRSize {
+		return nil, ErrorENRTooBig
+	}
+
+	if err := record.Verify(); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// recordNodeID returns the discv5 id of a record's node.
+func recordNodeID(record *ENR) ([]byte, error) {
+	id, err := record.NodeId()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return v5NodeID(id), nil
+}
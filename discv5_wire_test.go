@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// Test vectors of the discv5.1 wire specification.
+
+var (
+	v5TestKeyA      = mustDecodeHex("eef77acb6c6a6eebc5b363a475ac583ec7eccdb42b6481424c60f59aa326547f")
+	v5TestKeyB      = mustDecodeHex("66fb62bfbd66b9177a138c1e5cddbe4f7c30c343e94e68df8769459cb1cde628")
+	v5TestEph       = mustDecodeHex("fb757dc581730490a1d7a00deea65e9b1936924caaea8f44d476014856b68736")
+	v5TestIDA       = mustDecodeHex("aaaa8419e9f49d0083561b48287df592939a8d19947d8c0ef88f2a4856a69fbb")
+	v5TestIDB       = mustDecodeHex("bbbb9d047f0488c0b5a93c1c3f2d8bafc7c8ff337024a55434a0d0555de64db9")
+	v5TestChallenge = mustDecodeHex("000000000000000000000000000000006469736376350001010102030405060708090a0b0c00180102030405060708090a0b0c0d0e0f100000000000000000")
+)
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+func TestV5NodeIDs(t *testing.T) {
+	if !bytes.Equal(v5NodeID(NewLocalNodeFromKey(v5TestKeyA).GetId()), v5TestIDA) ||
+		!bytes.Equal(v5NodeID(NewLocalNodeFromKey(v5TestKeyB).GetId()), v5TestIDB) {
+		t.Error("Unexpected node ids")
+	}
+}
+
+func TestV5ECDH(t *testing.T) {
+	pubkey, err := parseV5Pubkey(mustDecodeHex("039961e4c2356d61bedb83052c115d311acb3a96f5777296dcf297351130266231"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := mustDecodeHex("033b11a2a1f214567e1537ce5e509ffd9b21373247f2a3ff6841f4976f53165e7e")
+
+	if secret := v5ECDH(v5TestEph, pubkey); !bytes.Equal(secret, want) {
+		t.Errorf("Unexpected shared secret %x", secret)
+	}
+}
+
+func TestV5KeyDerivation(t *testing.T) {
+	destKey, _ := parseV5Pubkey(NewLocalNodeFromKey(v5TestKeyB).GetId())
+	initiatorKey, recipientKey := deriveV5Keys(v5ECDH(v5TestEph, destKey), v5TestIDA, v5TestIDB, v5TestChallenge)
+
+	if !bytes.Equal(initiatorKey, mustDecodeHex("dccc82d81bd610f4f76d3ebe97a40571")) {
+		t.Errorf("Unexpected initiator key %x", initiatorKey)
+	}
+
+	if !bytes.Equal(recipientKey, mustDecodeHex("ac74bb8773749920b0d3a8881c173ec5")) {
+		t.Errorf("Unexpected recipient key %x", recipientKey)
+	}
+}
+
+func TestV5IDSignature(t *testing.T) {
+	ephemeral := mustDecodeHex("039961e4c2356d61bedb83052c115d311acb3a96f5777296dcf297351130266231")
+	sig, err := makeV5IDSignature(v5TestEph, v5TestChallenge, ephemeral, v5TestIDB)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := mustDecodeHex("94852a1e2318c4e5e9d422c98eaf19d1d90d876b29cd06ca7cb7546d0fff7b48" +
+		"4fe86c09a064fe72bdbef73ba8e9c34df0cd2b53e9d65528c2c7f336d5dfc6e6")
+
+	if !bytes.Equal(sig, want) {
+		t.Errorf("Unexpected signature %x", sig)
+	}
+
+	pubkey, _ := parseV5Pubkey(NewLocalNodeFromKey(v5TestEph).GetId())
+
+	if err := verifyV5IDSignature(pubkey, sig, v5TestChallenge, ephemeral, v5TestIDB); err != nil {
+		t.Error(err)
+	}
+
+	if err := verifyV5IDSignature(pubkey, sig, v5TestChallenge, ephemeral, v5TestIDA); err != ErrorV5InvalidIDSignature {
+		t.Error("Expected signature for another node to fail", err)
+	}
+}
+
+func TestV5DecodePingMessage(t *testing.T) {
+	packet := mustDecodeHex(`
+		00000000000000000000000000000000088b3d4342774649325f313964a39e55
+		ea96c005ad52be8c7560413a7008f16c9e6d2f43bbea8814a546b7409ce783d3
+		4c4f53245d08dab84102ed931f66d1492acb308fa1c6715b9d139b81acbdcc`)
+
+	header, headerData, message, err := decodeV5Packet(v5TestIDB, packet)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.flag != v5FlagMessage || !bytes.Equal(header.authData, v5TestIDA) ||
+		!bytes.Equal(header.nonce, mustDecodeHex("ffffffffffffffffffffffff")) {
+		t.Fatal("Unexpected header", header)
+	}
+
+	plaintext, err := decryptV5Message(make([]byte, v5KeySize), header.nonce, message, headerData)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := decodeV5Message(plaintext)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ping, ok := msg.(*PingMessage)
+
+	if !ok || !bytes.Equal(ping.requestID, []byte{0, 0, 0, 1}) || ping.enrSeq != 2 {
+		t.Error("Unexpected message", msg)
+	}
+
+	// Encoding the same header and message gives the same packet.
+	encoded, err := encodeV5Packet(v5TestIDB, header, make([]byte, v5KeySize), plaintext)
+
+	if err != nil || !bytes.Equal(encoded, packet) {
+		t.Errorf("Unexpected encoding %x %v", encoded, err)
+	}
+}
+
+func TestV5DecodeWhoareyou(t *testing.T) {
+	packet := mustDecodeHex(`
+		00000000000000000000000000000000088b3d434277464933a1ccc59f5967ad
+		1d6035f15e528627dde75cd68292f9e6c27d6b66c8100a873fcbaed4e16b8d`)
+
+	header, challenge, _, err := decodeV5Packet(v5TestIDB, packet)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	whoareyou := decodeV5Whoareyou(header.authData)
+
+	if header.flag != v5FlagWhoareyou || !bytes.Equal(header.nonce, mustDecodeHex("0102030405060708090a0b0c")) ||
+		!bytes.Equal(whoareyou.idNonce, mustDecodeHex("0102030405060708090a0b0c0d0e0f10")) || whoareyou.enrSeq != 0 {
+		t.Error("Unexpected whoareyou", header, whoareyou)
+	}
+
+	if !bytes.Equal(challenge, v5TestChallenge) {
+		t.Errorf("Unexpected challenge data %x", challenge)
+	}
+
+	// Packets addressed to another node do not unmask.
+	if _, _, _, err := decodeV5Packet(v5TestIDA, packet); err != ErrorV5InvalidHeader {
+		t.Error("Expected invalid header", err)
+	}
+}
+
+func TestV5Messages(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	record, _ := NewENR(3, map[string]any{enrKeyUdp: 30303}, localNode.GetPrivKeyBytes())
+
+	messages := []V5Message{
+		&PingMessage{[]byte{1}, 7},
+		&PongMessage{[]byte{1, 2}, 7, netip.MustParseAddr("10.0.0.1"), 30303},
+		&FindNodeMessage{[]byte{3}, []uint{0, 1, 256}},
+		&FindNodeMessage{[]byte{3}, nil},
+		&NodesMessage{[]byte{4}, 2, []*ENR{record}},
+		&TalkReqMessage{[]byte{5}, "test", []byte{1, 2, 3}},
+		&TalkReqMessage{[]byte{5}, "", nil},
+		&TalkRespMessage{[]byte{6}, []byte{4, 5}},
+		&TalkRespMessage{[]byte{6}, nil},
+	}
+
+	for _, m := range messages {
+		plaintext, err := encodeV5Message(m)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := decodeV5Message(plaintext)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reencoded, _ := encodeV5Message(decoded)
+
+		if decoded.Type() != m.Type() || !bytes.Equal(reencoded, plaintext) {
+			t.Errorf("Unexpected round trip %x %x", plaintext, reencoded)
+		}
+	}
+
+	if _, err := decodeV5Message(append([]byte{byte(V5PingMessageType)},
+		mustDecodeHex("cb89010203040506070809 01")...)); err != ErrorV5InvalidRequestID {
+		t.Error("Expected long request id to be rejected", err)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// Node lists published in DNS as ENR trees (EIP-1459). A tree's root TXT
+// record, signed by the publisher, points at a subtree of node records and a
+// subtree of links to other trees. Subtree entries are found at the hash of
+// their text, so the signature covers the whole tree.
+
+const (
+	dnsRootPrefix   = "enrtree-root:v1"
+	dnsBranchPrefix = "enrtree-branch:"
+	dnsLinkPrefix   = "enrtree://"
+	dnsENRPrefix    = "enr:"
+
+	// Subdomain hashes are truncated keccak256 hashes of the entry text.
+	minDNSHashSize = 10
+	maxDNSHashSize = 32
+
+	defaultDNSTimeout    = 5 * time.Second
+	defaultDNSCacheLimit = 1000
+)
+
+// Errors
+var (
+	ErrorInvalidENRTreeURL = errors.New("Invalid enrtree URL")
+	ErrorNoDNSRoot         = errors.New("No ENR tree root found")
+	ErrorInvalidDNSRoot    = errors.New("Invalid ENR tree root")
+	ErrorInvalidDNSSig     = errors.New("Invalid ENR tree root signature")
+	ErrorInvalidDNSEntry   = errors.New("Invalid ENR tree entry")
+	ErrorDNSHashMismatch   = errors.New("No ENR tree entry matches hash")
+	ErrorUnexpectedDNSLeaf = errors.New("Unexpected leaf in ENR tree subtree")
+)
+
+var dnsHashEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Resolver looks up TXT records. It is implemented by *net.Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// ENRTreeLink is a tree, given by its domain and the compressed public key of
+// its publisher, in the form enrtree://<base32 key>@<domain>.
+type ENRTreeLink struct {
+	domain string
+	pubkey []byte
+}
+
+// ParseENRTreeURL parses a link to an ENR tree.
+func ParseENRTreeURL(url string) (*ENRTreeLink, error) {
+	key, domain, found := strings.Cut(strings.TrimPrefix(url, dnsLinkPrefix), "@")
+
+	if !strings.HasPrefix(url, dnsLinkPrefix) || !found || domain == "" {
+		return nil, ErrorInvalidENRTreeURL
+	}
+
+	pubkey, err := dnsHashEncoding.DecodeString(key)
+
+	if err != nil {
+		return nil, ErrorInvalidENRTreeURL
+	}
+
+	if _, err := secp256k1.ParsePubKey(pubkey); err != nil || len(pubkey) != v5PubkeySize {
+		return nil, ErrorInvalidENRTreeURL
+	}
+
+	return &ENRTreeLink{domain, pubkey}, nil
+}
+
+func (l *ENRTreeLink) String() string {
+	return dnsLinkPrefix + dnsHashEncoding.EncodeToString(l.pubkey) + "@" + l.domain
+}
+
+// dnsRoot is the root entry of a tree, holding the hashes of its subtrees.
+type dnsRoot struct {
+	enrRoot  string
+	linkRoot string
+	seq      uint64
+	sig      []byte
+}
+
+func (r *dnsRoot) signedText() string {
+	return fmt.Sprintf("%s e=%s l=%s seq=%d", dnsRootPrefix, r.enrRoot, r.linkRoot, r.seq)
+}
+
+func (r *dnsRoot) String() string {
+	return r.signedText() + " sig=" + base64.RawURLEncoding.EncodeToString(r.sig)
+}
+
+// parseDNSRoot parses a root entry and verifies that it is signed by pubkey.
+func parseDNSRoot(text string, pubkey []byte) (*dnsRoot, error) {
+	var root dnsRoot
+	var sig string
+
+	_, err := fmt.Sscanf(text, dnsRootPrefix+" e=%s l=%s seq=%d sig=%s", &root.enrRoot, &root.linkRoot, &root.seq, &sig)
+
+	if err != nil || !isDNSHash(root.enrRoot) || !isDNSHash(root.linkRoot) {
+		return nil, ErrorInvalidDNSRoot
+	}
+
+	if root.sig, err = base64.RawURLEncoding.DecodeString(sig); err != nil || len(root.sig) != signatureLength {
+		return nil, ErrorInvalidDNSSig
+	}
+
+	if !VerifySignature(pubkey, Keccak256([]byte(root.signedText())), root.sig[:64]) {
+		return nil, ErrorInvalidDNSSig
+	}
+
+	return &root, nil
+}
+
+// dnsBranch is an inner node of a subtree, listing the hashes of its children.
+type dnsBranch struct {
+	children []string
+}
+
+// parseDNSEntry parses a subtree entry, which is a *dnsBranch, an *ENR or an
+// *ENRTreeLink.
+func parseDNSEntry(text string) (any, error) {
+	switch {
+	case strings.HasPrefix(text, dnsBranchPrefix):
+		children := strings.Split(strings.TrimPrefix(text, dnsBranchPrefix), ",")
+
+		if len(children) == 1 && children[0] == "" {
+			children = nil
+		}
+
+		for _, child := range children {
+			if !isDNSHash(child) {
+				return nil, ErrorInvalidDNSEntry
+			}
+		}
+
+		return &dnsBranch{children}, nil
+	case strings.HasPrefix(text, dnsENRPrefix):
+		return ParseENRURL(text)
+	case strings.HasPrefix(text, dnsLinkPrefix):
+		return ParseENRTreeURL(text)
+	}
+
+	return nil, ErrorInvalidDNSEntry
+}
+
+func isDNSHash(hash string) bool {
+	decoded, err := dnsHashEncoding.DecodeString(hash)
+	return err == nil && len(decoded) >= minDNSHashSize && len(decoded) <= maxDNSHashSize
+}
+
+// dnsHash returns the subdomain of an entry.
+func dnsHash(text string) string {
+	return dnsHashEncoding.EncodeToString(Keccak256([]byte(text))[:16])
+}
+
+// DNSConfig configures a DNSClient. Zero values select the defaults.
+type DNSConfig struct {
+	// Resolver defaults to the system resolver.
+	Resolver Resolver
+
+	// Timeout limits every single lookup.
+	Timeout time.Duration
+
+	// CacheLimit is the number of entries kept. Above it the oldest entries
+	// are forgotten.
+	CacheLimit int
+}
+
+func (c DNSConfig) withDefaults() DNSConfig {
+	if c.Resolver == nil {
+		c.Resolver = net.DefaultResolver
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = defaultDNSTimeout
+	}
+
+	if c.CacheLimit == 0 {
+		c.CacheLimit = defaultDNSCacheLimit
+	}
+
+	return c
+}
+
+// DNSClient resolves ENR trees. Entries below the root never change, since
+// they are named by their hash, and are cached across iterators. Roots are
+// looked up again every time a tree is walked.
+type DNSClient struct {
+	config DNSConfig
+
+	mu      sync.Mutex
+	entries map[string]any
+	order   []string
+}
+
+func NewDNSClient(config DNSConfig) *DNSClient {
+	return &DNSClient{config: config.withDefaults(), entries: make(map[string]any)}
+}
+
+func (c *DNSClient) lookupTXT(ctx context.Context, name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+
+	return c.config.Resolver.LookupTXT(ctx, name)
+}
+
+// resolveRoot looks up and verifies the root of a tree.
+func (c *DNSClient) resolveRoot(ctx context.Context, link *ENRTreeLink) (*dnsRoot, error) {
+	texts, err := c.lookupTXT(ctx, link.domain)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, text := range texts {
+		if strings.HasPrefix(text, dnsRootPrefix) {
+			return parseDNSRoot(text, link.pubkey)
+		}
+	}
+
+	return nil, ErrorNoDNSRoot
+}
+
+// resolveEntry looks up the subtree entry at hash, checking that its text
+// hashes to it.
+func (c *DNSClient) resolveEntry(ctx context.Context, domain, hash string) (any, error) {
+	name := hash + "." + domain
+
+	c.mu.Lock()
+	entry, ok := c.entries[name]
+	c.mu.Unlock()
+
+	if ok {
+		return entry, nil
+	}
+
+	texts, err := c.lookupTXT(ctx, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	want, _ := dnsHashEncoding.DecodeString(hash)
+
+	for _, text := range texts {
+		if !bytes.HasPrefix(Keccak256([]byte(text)), want) {
+			continue
+		}
+
+		if entry, err = parseDNSEntry(text); err != nil {
+			return nil, err
+		}
+
+		c.store(name, entry)
+		return entry, nil
+	}
+
+	return nil, ErrorDNSHashMismatch
+}
+
+func (c *DNSClient) store(name string, entry any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[name]; ok {
+		return
+	}
+
+	if len(c.order) >= c.config.CacheLimit {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+
+	c.order = append(c.order, name)
+	c.entries[name] = entry
+}
+
+// NewIterator returns an iterator over the nodes of the trees at urls and of
+// the trees they link to, each tree walked once. Entries that fail to
+// resolve are skipped together with their subtree.
+func (c *DNSClient) NewIterator(urls ...string) (Iterator, error) {
+	it := &dnsIterator{client: c, visited: make(map[string]bool)}
+
+	for _, url := range urls {
+		link, err := ParseENRTreeURL(url)
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, url)
+		}
+
+		it.follow(link)
+	}
+
+	it.ctx, it.cancel = context.WithCancel(context.Background())
+	return it, nil
+}
+
+// Nodes returns up to limit nodes of the trees at urls, see NewIterator.
+func (c *DNSClient) Nodes(urls []string, limit int) ([]*Enode, error) {
+	it, err := c.NewIterator(urls...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer it.Close()
+
+	var nodes []*Enode
+	for len(nodes) < limit && it.Next() {
+		nodes = append(nodes, it.Node())
+	}
+
+	return nodes, nil
+}
+
+// dnsWalkItem is an entry of a tree still to be resolved: its root if hash
+// is empty. links tells the subtrees apart, as each holds only one kind of
+// leaf.
+type dnsWalkItem struct {
+	link  *ENRTreeLink
+	hash  string
+	links bool
+}
+
+type dnsIterator struct {
+	client  *DNSClient
+	ctx     context.Context
+	cancel  context.CancelFunc
+	queue   []dnsWalkItem
+	visited map[string]bool
+	node    *Enode
+}
+
+// follow queues the root of a tree unless it was seen before, which also
+// ends link cycles.
+func (it *dnsIterator) follow(link *ENRTreeLink) {
+	if !it.visited[link.domain] {
+		it.visited[link.domain] = true
+		it.queue = append(it.queue, dnsWalkItem{link: link})
+	}
+}
+
+func (it *dnsIterator) Next() bool {
+	for len(it.queue) > 0 && it.ctx.Err() == nil {
+		item := it.queue[0]
+		it.queue = it.queue[1:]
+
+		node, err := it.resolve(item)
+
+		if err != nil {
+			if it.ctx.Err() == nil {
+				fmt.Println("Skipping ENR tree entry", item.link.domain, item.hash, err)
+			}
+
+			continue
+		}
+
+		if node != nil {
+			it.node = node
+			return true
+		}
+	}
+
+	it.node = nil
+	return false
+}
+
+// resolve handles an entry, queueing its children. It returns the node of a
+// record leaf.
+func (it *dnsIterator) resolve(item dnsWalkItem) (*Enode, error) {
+	if item.hash == "" {
+		root, err := it.client.resolveRoot(it.ctx, item.link)
+
+		if err != nil {
+			return nil, err
+		}
+
+		it.queue = append(it.queue,
+			dnsWalkItem{link: item.link, hash: root.enrRoot},
+			dnsWalkItem{link: item.link, hash: root.linkRoot, links: true})
+		return nil, nil
+	}
+
+	entry, err := it.client.resolveEntry(it.ctx, item.link.domain, item.hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch e := entry.(type) {
+	case *dnsBranch:
+		for _, child := range e.children {
+			it.queue = append(it.queue, dnsWalkItem{item.link, child, item.links})
+		}
+	case *ENR:
+		if item.links {
+			return nil, ErrorUnexpectedDNSLeaf
+		}
+
+		return EnodeFromENR(e)
+	case *ENRTreeLink:
+		if !item.links {
+			return nil, ErrorUnexpectedDNSLeaf
+		}
+
+		it.follow(e)
+	}
+
+	return nil, nil
+}
+
+func (it *dnsIterator) Node() *Enode { return it.node }
+func (it *dnsIterator) Close()       { it.cancel() }
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// testZone is an in-memory DNS zone of TXT records. It counts lookups per
+// name.
+type testZone struct {
+	mu      sync.Mutex
+	records map[string]string
+	lookups map[string]int
+}
+
+func newTestZone() *testZone {
+	return &testZone{records: make(map[string]string), lookups: make(map[string]int)}
+}
+
+func (z *testZone) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	z.lookups[name]++
+	text, ok := z.records[name]
+
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	return []string{text}, nil
+}
+
+// addEntry publishes an entry of the tree at domain and returns its hash.
+func (z *testZone) addEntry(domain, text string) string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	hash := dnsHash(text)
+	z.records[hash+"."+domain] = text
+	return hash
+}
+
+// addTree publishes a tree signed by key with the given records and links,
+// each subtree a branch above its leaves. It returns the tree's URL.
+func (z *testZone) addTree(t *testing.T, key []byte, domain string, records []*ENR, links []string) string {
+	var enrLeaves, linkLeaves []string
+
+	for _, record := range records {
+		enrLeaves = append(enrLeaves, z.addEntry(domain, record.URL()))
+	}
+
+	for _, link := range links {
+		linkLeaves = append(linkLeaves, z.addEntry(domain, link))
+	}
+
+	root := &dnsRoot{
+		enrRoot:  z.addEntry(domain, dnsBranchPrefix+strings.Join(enrLeaves, ",")),
+		linkRoot: z.addEntry(domain, dnsBranchPrefix+strings.Join(linkLeaves, ",")),
+		seq:      1,
+	}
+
+	sig, err := Sign(Keccak256([]byte(root.signedText())), key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root.sig = sig
+
+	z.mu.Lock()
+	z.records[domain] = root.String()
+	z.mu.Unlock()
+
+	pubkey := secp256k1.PrivKeyFromBytes(key).PubKey().SerializeCompressed()
+	return (&ENRTreeLink{domain, pubkey}).String()
+}
+
+func newTestRecords(t *testing.T, n int) []*ENR {
+	var records []*ENR
+
+	for i := 0; i < n; i++ {
+		localNode, err := NewLocalNode()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		record, err := NewENR(1, map[string]any{
+			enrKeyIp:  net.IPv4(10, 0, 0, byte(i+1)).To4(),
+			enrKeyUdp: 30303,
+		}, localNode.GetPrivKeyBytes())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func newTestTreeKey(t *testing.T) []byte {
+	localNode, err := NewLocalNode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return localNode.GetPrivKeyBytes()
+}
+
+// iterateAll returns the URLs of all nodes an iterator yields.
+func iterateAll(t *testing.T, client *DNSClient, urls ...string) map[string]bool {
+	it, err := client.NewIterator(urls...)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer it.Close()
+
+	found := map[string]bool{}
+	for it.Next() {
+		found[it.Node().record.URL()] = true
+	}
+
+	return found
+}
+
+func TestParseENRTreeURL(t *testing.T) {
+	url := "enrtree://AKA3AM6LPBYEUDMVNU3BSVQJ5AD45Y7YPOHJLEF6W26QOE4VTUDPE@all.mainnet.ethdisco.net"
+	link, err := ParseENRTreeURL(url)
+
+	if err != nil || link.domain != "all.mainnet.ethdisco.net" || link.String() != url {
+		t.Error("Unexpected link", link, err)
+	}
+
+	for _, invalid := range []string{
+		"enrtree://all.mainnet.ethdisco.net",
+		"enrtree://AKA3AM6LPBYEUDMVNU3BSVQJ5AD45Y7YPOHJLEF6W26QOE4VTUDPE@",
+		"enrtree://AAAA@all.mainnet.ethdisco.net",
+		"enode://AKA3AM6LPBYEUDMVNU3BSVQJ5AD45Y7YPOHJLEF6W26QOE4VTUDPE@all.mainnet.ethdisco.net",
+	} {
+		if _, err := ParseENRTreeURL(invalid); err != ErrorInvalidENRTreeURL {
+			t.Error("Expected invalid URL", invalid, err)
+		}
+	}
+}
+
+func TestDNSIterator(t *testing.T) {
+	zone := newTestZone()
+	records := newTestRecords(t, 5)
+
+	// The first tree links to the second, which links back to the first.
+	secondKey := newTestTreeKey(t)
+	first := zone.addTree(t, newTestTreeKey(t), "first.example.org", records[:2],
+		[]string{zone.addTree(t, secondKey, "second.example.org", records[2:], nil)})
+	zone.addTree(t, secondKey, "second.example.org", records[2:], []string{first})
+
+	client := NewDNSClient(DNSConfig{Resolver: zone})
+	found := iterateAll(t, client, first)
+
+	if len(found) != len(records) {
+		t.Error("Expected all records of both trees", len(found))
+	}
+
+	for _, record := range records {
+		if !found[record.URL()] {
+			t.Error("Missing record", record.URL())
+		}
+	}
+
+	// Walking the trees again only looks up their roots.
+	lookups := len(zone.lookups)
+	iterateAll(t, client, first)
+
+	for name, n := range zone.lookups {
+		if n > 1 && name != "first.example.org" && name != "second.example.org" {
+			t.Error("Expected entry to be cached", name, n)
+		}
+	}
+
+	if len(zone.lookups) != lookups {
+		t.Error("Unexpected lookups", len(zone.lookups), lookups)
+	}
+}
+
+func TestDNSRootSignature(t *testing.T) {
+	zone := newTestZone()
+	url := zone.addTree(t, newTestTreeKey(t), "example.org", newTestRecords(t, 1), nil)
+
+	// A tree published by another key is not trusted.
+	link, _ := ParseENRTreeURL(url)
+	other := zone.addTree(t, newTestTreeKey(t), "other.example.org", nil, nil)
+	otherLink, _ := ParseENRTreeURL(other)
+	link.pubkey = otherLink.pubkey
+
+	client := NewDNSClient(DNSConfig{Resolver: zone})
+
+	if _, err := client.resolveRoot(context.Background(), link); err != ErrorInvalidDNSSig {
+		t.Error("Expected invalid signature", err)
+	}
+
+	if found := iterateAll(t, client, link.String()); len(found) != 0 {
+		t.Error("Expected no records from an untrusted tree", len(found))
+	}
+
+	if found := iterateAll(t, client, url); len(found) != 1 {
+		t.Error("Expected the record of the trusted tree", len(found))
+	}
+}
+
+func TestDNSHashMismatch(t *testing.T) {
+	zone := newTestZone()
+	records := newTestRecords(t, 2)
+	url := zone.addTree(t, newTestTreeKey(t), "example.org", records, nil)
+
+	// Replacing a leaf breaks its hash, which drops it but not its siblings.
+	replaced := dnsHash(records[0].URL()) + ".example.org"
+	zone.records[replaced] = newTestRecords(t, 1)[0].URL()
+
+	client := NewDNSClient(DNSConfig{Resolver: zone})
+
+	if _, err := client.resolveEntry(context.Background(), "example.org", dnsHash(records[0].URL())); err != ErrorDNSHashMismatch {
+		t.Error("Expected hash mismatch", err)
+	}
+
+	found := iterateAll(t, client, url)
+
+	if len(found) != 1 || !found[records[1].URL()] {
+		t.Error("Expected only the intact record", found)
+	}
+}
+
+func TestDNSUnexpectedLeaf(t *testing.T) {
+	zone := newTestZone()
+	records := newTestRecords(t, 1)
+
+	// A record in the link subtree is not a node of the tree.
+	url := zone.addTree(t, newTestTreeKey(t), "example.org", nil, []string{records[0].URL()})
+
+	if found := iterateAll(t, NewDNSClient(DNSConfig{Resolver: zone}), url); len(found) != 0 {
+		t.Error("Expected record in link subtree to be skipped", found)
+	}
+}
+
+func TestDNSRootVector(t *testing.T) {
+	// The root of the example tree of EIP-1459, as signed in go-ethereum's
+	// tests.
+	link, err := ParseENRTreeURL("enrtree://AKPYQIUQIL7PSIACI32J7FGZW56E5FKHEFCCOFHILBIMW3M6LWXS2@nodes.example.org")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := parseDNSRoot("enrtree-root:v1 e=JWXYDBPXYWG6FX3GMDIBFA6CJ4 l=C7HRFPF3BLGF3YR4DY5KX3SMBE seq=1 "+
+		"sig=o908WmNp7LibOfPsr4btQwatZJ5URBr2ZAuxvK4UWHlsB9sUOTJQaGAlLPVAhM__XJesCHxLISo94z5Z2a463gA", link.pubkey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if root.enrRoot != "JWXYDBPXYWG6FX3GMDIBFA6CJ4" || root.linkRoot != "C7HRFPF3BLGF3YR4DY5KX3SMBE" || root.seq != 1 {
+		t.Error("Unexpected root", root)
+	}
+
+	if _, err := parseDNSRoot(strings.Replace(root.String(), "seq=1", "seq=2", 1), link.pubkey); err != ErrorInvalidDNSSig {
+		t.Error("Expected changed root to fail verification", err)
+	}
+
+	entry, err := parseDNSEntry("enrtree-branch:2XS2367YHAXJFGLZHVAWLQD4ZY,H4FHT4B454P6UXFD7JCYQ5PWDY,MHTDO6TMUBRIA2XWG5LUDACK24")
+
+	if branch, ok := entry.(*dnsBranch); err != nil || !ok || len(branch.children) != 3 {
+		t.Error("Unexpected branch", entry, err)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"sort"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// ENR keys
+const (
+	enrKeyId        = "id"
+	enrKeySecp256k1 = "secp256k1"
+	enrKeyIp        = "ip"
+	enrKeyUdp       = "udp"
+	enrKeyTcp       = "tcp"
+	enrKeyIp6       = "ip6"
+	enrKeyUdp6      = "udp6"
+	enrKeyTcp6      = "tcp6"
+)
+
+const (
+	enrIdentityScheme = "v4"
+	enrSignatureSize  = 64
+	maxENRSize        = 300
+)
+
+// Errors
+var (
+	ErrorInvalidENR                  = errors.New("Invalid ENR")
+	ErrorInvalidENRSignature         = errors.New("Invalid ENR signature")
+	ErrorUnsupportedIdentityScheme   = errors.New("Unsupported ENR identity scheme")
+	ErrorENRTooBig                   = errors.New("ENR too big")
+	ErrorENRKeysNotSortedOrDuplicate = errors.New("ENR keys not sorted or duplicate")
+)
+
+type enrPair struct {
+	key   string
+	value any
+}
+
+// ENR is an Ethereum Node Record as described in EIP-778. Values are kept in
+// their decoded RLP form so that a record can be re-encoded byte for byte.
+type ENR struct {
+	seq       uint64
+	pairs     []enrPair
+	signature []byte
+}
+
+// NewENR creates a record signed with the "v4" identity scheme. The id and
+// secp256k1 keys are derived from privKey and must not be part of pairs.
+func NewENR(seq uint64, pairs map[string]any, privKey []byte) (*ENR, error) {
+	pubkey := secp256k1.PrivKeyFromBytes(privKey).PubKey()
+
+	record := ENR{seq: seq}
+	record.pairs = append(record.pairs,
+		enrPair{enrKeyId, enrIdentityScheme},
+		enrPair{enrKeySecp256k1, string(pubkey.SerializeCompressed())})
+
+	for key, value := range pairs {
+		record.pairs = append(record.pairs, enrPair{key, value})
+	}
+
+	sort.Slice(record.pairs, func(i, j int) bool {
+		return record.pairs[i].key < record.pairs[j].key
+	})
+
+	content, err := Encode(record.contentList())
+
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := Sign(Keccak256(content), privKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The recovery id is not part of the v4 signature.
+	record.signature = sig[:enrSignatureSize]
+
+	encoded, err := record.ToRLP()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(encoded) > maxENRSize {
+		return nil, ErrorENRTooBig
+	}
+
+	return &record, nil
+}
+
+func (r *ENR) contentList() []any {
+	list := []any{r.seq}
+
+	for _, pair := range r.pairs {
+		list = append(list, pair.key, pair.value)
+	}
+
+	return list
+}
+
+func (r *ENR) toList() []any {
+	return append([]any{string(r.signature)}, r.contentList()...)
+}
+
+func (r *ENR) ToRLP() ([]byte, error) {
+	return Encode(r.toList())
+}
+
+func (r *ENR) Seq() uint64 { return r.seq }
+
+// URL returns the record in its "enr:" text form, see ParseENRURL.
+func (r *ENR) URL() string {
+	data, _ := r.ToRLP()
+	return "enr:" + base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (r *ENR) Get(key string) (any, bool) {
+	for _, pair := range r.pairs {
+		if pair.key == key {
+			return pair.value, true
+		}
+	}
+
+	return nil, false
+}
+
+func (r *ENR) getString(key string) (string, bool) {
+	value, ok := r.Get(key)
+
+	if !ok {
+		return "", false
+	}
+
+	s, ok := value.(string)
+	return s, ok
+}
+
+func (r *ENR) IP() net.IP {
+	ip, ok := r.getString(enrKeyIp)
+
+	if !ok || len(ip) != net.IPv4len {
+		return nil
+	}
+
+	return net.IP(ip)
+}
+
+func (r *ENR) IP6() net.IP {
+	ip, ok := r.getString(enrKeyIp6)
+
+	if !ok || len(ip) != net.IPv6len {
+		return nil
+	}
+
+	return net.IP(ip)
+}
+
+func (r *ENR) UdpPort() int {
+	port, _ := r.getString(enrKeyUdp)
+	return int(decodeUInt64([]byte(port)))
+}
+
+func (r *ENR) TcpPort() int {
+	port, _ := r.getString(enrKeyTcp)
+	return int(decodeUInt64([]byte(port)))
+}
+
+// Udp6Port and Tcp6Port return the IPv6 ports, which default to the IPv4
+// ports when not given.
+func (r *ENR) Udp6Port() int {
+	if port, ok := r.getString(enrKeyUdp6); ok {
+		return int(decodeUInt64([]byte(port)))
+	}
+
+	return r.UdpPort()
+}
+
+func (r *ENR) Tcp6Port() int {
+	if port, ok := r.getString(enrKeyTcp6); ok {
+		return int(decodeUInt64([]byte(port)))
+	}
+
+	return r.TcpPort()
+}
+
+// NodeId returns the 64 byte node id derived from the record's public key.
+func (r *ENR) NodeId() ([]byte, error) {
+	compressed, ok := r.getString(enrKeySecp256k1)
+
+	if !ok {
+		return nil, ErrorInvalidENR
+	}
+
+	pubkey, err := secp256k1.ParsePubKey([]byte(compressed))
+
+	if err != nil {
+		return nil, ErrorInvalidENR
+	}
+
+	// Index 0 is the uncrompressed serialized flag. Not needed.
+	return pubkey.SerializeUncompressed()[1:], nil
+}
+
+// Verify checks the record signature using the "v4" identity scheme.
+func (r *ENR) Verify() error {
+	scheme, _ := r.getString(enrKeyId)
+
+	if scheme != enrIdentityScheme {
+		return ErrorUnsupportedIdentityScheme
+	}
+
+	pubkey, ok := r.getString(enrKeySecp256k1)
+
+	if !ok {
+		return ErrorInvalidENR
+	}
+
+	content, err := Encode(r.contentList())
+
+	if err != nil {
+		return err
+	}
+
+	if !VerifySignature([]byte(pubkey), Keccak256(content), r.signature) {
+		return ErrorInvalidENRSignature
+	}
+
+	return nil
+}
+
+func DecodeENR(data []byte) (*ENR, error) {
+	if len(data) > maxENRSize {
+		return nil, ErrorENRTooBig
+	}
+
+	decoded, err := Decode(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	decodedList, b := decoded.([]any)
+	if !b {
+		return nil, ErrorInvalidENR
+	}
+
+	return decodeENRList(decodedList)
+}
+
+func decodeENRList(data []any) (*ENR, error) {
+	// Signature, sequence number and an even number of key/value items.
+	if len(data) < 2 || len(data)%2 != 0 {
+		return nil, ErrorInvalidENR
+	}
+
+	signature, b := data[0].(string)
+	if !b {
+		return nil, ErrorInvalidENR
+	}
+
+	seq, b := data[1].(string)
+	if !b {
+		return nil, ErrorInvalidENR
+	}
+
+	record := ENR{
+		seq:       decodeUInt64([]byte(seq)),
+		signature: []byte(signature),
+	}
+
+	for i := 2; i < len(data); i += 2 {
+		key, b := data[i].(string)
+		if !b {
+			return nil, ErrorInvalidENR
+		}
+
+		if len(record.pairs) > 0 && record.pairs[len(record.pairs)-1].key >= key {
+			return nil, ErrorENRKeysNotSortedOrDuplicate
+		}
+
+		record.pairs = append(record.pairs, enrPair{key, data[i+1]})
+	}
+
+	return &record, nil
+}
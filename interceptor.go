@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Interceptor hooks into the packets of a server, for tests and debugging.
+// Inbound sees every packet after it has been decoded and before it is
+// handled, Outbound every datagram before it is written. Both return the
+// packet to continue with, which may be modified, or nil to drop it. Either
+// may be nil.
+//
+// Interceptors run on the goroutines handling and writing packets, so one
+// that blocks, e.g. to delay a packet, holds up the packets behind it.
+type Interceptor struct {
+	Inbound  func(packet *Packet[any], from *net.UDPAddr) *Packet[any]
+	Outbound func(data []byte, to *net.UDPAddr) []byte
+}
+
+// interceptInbound runs a packet through the inbound hooks in order.
+func interceptInbound(interceptors []Interceptor, packet *Packet[any], from *net.UDPAddr) *Packet[any] {
+	for _, interceptor := range interceptors {
+		if interceptor.Inbound == nil {
+			continue
+		}
+
+		if packet = interceptor.Inbound(packet, from); packet == nil {
+			return nil
+		}
+	}
+
+	return packet
+}
+
+// interceptOutbound runs a datagram through the outbound hooks in order.
+func interceptOutbound(interceptors []Interceptor, data []byte, to *net.UDPAddr) []byte {
+	for _, interceptor := range interceptors {
+		if interceptor.Outbound == nil {
+			continue
+		}
+
+		if data = interceptor.Outbound(data, to); data == nil {
+			return nil
+		}
+	}
+
+	return data
+}
+
+// outboundPacketType reads the type of an encoded packet without decoding
+// it.
+func outboundPacketType(data []byte) PacketType {
+	if len(data) < headerSize {
+		return InvalidPacketType
+	}
+
+	return PacketType(data[headerSize-1])
+}
+
+// LogInterceptor writes a line for every packet to w.
+func LogInterceptor(w io.Writer) Interceptor {
+	var mu sync.Mutex
+
+	return Interceptor{
+		Inbound: func(packet *Packet[any], from *net.UDPAddr) *Packet[any] {
+			mu.Lock()
+			defer mu.Unlock()
+
+			fmt.Fprintf(w, "<- %s %s\n", from, describeDecodedPacket(packet))
+			return packet
+		},
+		Outbound: func(data []byte, to *net.UDPAddr) []byte {
+			mu.Lock()
+			defer mu.Unlock()
+
+			fmt.Fprintf(w, "-> %s %s\n", to, DescribePacket(data))
+			return data
+		},
+	}
+}
+
+// PacketMetrics counts the packets passing through its interceptor by type
+// and direction.
+type PacketMetrics struct {
+	mu  sync.Mutex
+	in  map[PacketType]uint64
+	out map[PacketType]uint64
+}
+
+func NewPacketMetrics() *PacketMetrics {
+	return &PacketMetrics{
+		in:  make(map[PacketType]uint64),
+		out: make(map[PacketType]uint64),
+	}
+}
+
+func (m *PacketMetrics) Interceptor() Interceptor {
+	return Interceptor{
+		Inbound: func(packet *Packet[any], from *net.UDPAddr) *Packet[any] {
+			m.count(m.in, packet.header.packetType)
+			return packet
+		},
+		Outbound: func(data []byte, to *net.UDPAddr) []byte {
+			m.count(m.out, outboundPacketType(data))
+			return data
+		},
+	}
+}
+
+func (m *PacketMetrics) count(counts map[PacketType]uint64, t PacketType) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts[t]++
+}
+
+// Inbound returns the number of received packets of a type.
+func (m *PacketMetrics) Inbound(t PacketType) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.in[t]
+}
+
+// Outbound returns the number of sent packets of a type.
+func (m *PacketMetrics) Outbound(t PacketType) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.out[t]
+}
+
+// LossInterceptor drops packets in both directions with probability rate.
+// The seed makes the losses repeatable for the same sequence of packets.
+func LossInterceptor(rate float64, seed int64) Interceptor {
+	var mu sync.Mutex
+	rand := mrand.New(mrand.NewSource(seed))
+
+	lose := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return rand.Float64() < rate
+	}
+
+	return Interceptor{
+		Inbound: func(packet *Packet[any], from *net.UDPAddr) *Packet[any] {
+			if lose() {
+				return nil
+			}
+
+			return packet
+		},
+		Outbound: func(data []byte, to *net.UDPAddr) []byte {
+			if lose() {
+				return nil
+			}
+
+			return data
+		},
+	}
+}
+
+// Faults configures FaultInterceptor. Rates are probabilities per packet.
+type Faults struct {
+	// Types restricts the faults to packets of these types. All packets are
+	// affected if empty.
+	Types []PacketType
+
+	// DelayRate of the packets in either direction are held back by Delay.
+	DelayRate float64
+	Delay     time.Duration
+
+	// CorruptRate of the outbound packets get a random bit flipped, which
+	// breaks their hash or signature.
+	CorruptRate float64
+
+	// ExpireRate of the inbound packets have their expiration set in the
+	// past.
+	ExpireRate float64
+
+	Seed int64
+}
+
+// FaultInterceptor injects the configured faults.
+func FaultInterceptor(faults Faults) Interceptor {
+	var mu sync.Mutex
+	rand := mrand.New(mrand.NewSource(faults.Seed))
+
+	affects := func(t PacketType) bool {
+		if len(faults.Types) == 0 {
+			return true
+		}
+
+		for _, ft := range faults.Types {
+			if ft == t {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	roll := func(rate float64) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return rate > 0 && rand.Float64() < rate
+	}
+
+	return Interceptor{
+		Inbound: func(packet *Packet[any], from *net.UDPAddr) *Packet[any] {
+			if !affects(packet.header.packetType) {
+				return packet
+			}
+
+			if roll(faults.ExpireRate) {
+				setExpiration(packet.data, 0)
+			}
+
+			if roll(faults.DelayRate) {
+				time.Sleep(faults.Delay)
+			}
+
+			return packet
+		},
+		Outbound: func(data []byte, to *net.UDPAddr) []byte {
+			if !affects(outboundPacketType(data)) {
+				return data
+			}
+
+			if roll(faults.CorruptRate) {
+				mu.Lock()
+				bit := rand.Intn(len(data) * 8)
+				mu.Unlock()
+
+				// The writer's caller still owns data.
+				corrupted := make([]byte, len(data))
+				copy(corrupted, data)
+				corrupted[bit/8] ^= 1 << (bit % 8)
+				data = corrupted
+			}
+
+			if roll(faults.DelayRate) {
+				time.Sleep(faults.Delay)
+			}
+
+			return data
+		},
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func startInterceptedServer(t *testing.T, interceptors ...Interceptor) Server {
+	localNode, _ := NewLocalNode()
+	server, err := NewServer("127.0.0.1:0", localNode, Config{Interceptors: interceptors})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+// syncBuffer is a bytes.Buffer safe for use by the server's goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestLogAndMetricsInterceptors(t *testing.T) {
+	var log syncBuffer
+	metrics := NewPacketMetrics()
+	server := startInterceptedServer(t, LogInterceptor(&log), metrics.Interceptor())
+	target, _ := startTestServer(t)
+
+	if _, err := server.Ping(context.Background(), remoteNodeOf(target)); err != nil {
+		t.Fatal(err)
+	}
+
+	if metrics.Outbound(PingPacketType) != 1 || metrics.Inbound(PongPacketType) != 1 {
+		t.Error("Unexpected packet counts", metrics.Outbound(PingPacketType), metrics.Inbound(PongPacketType))
+	}
+
+	if !strings.Contains(log.String(), "-> "+remoteNodeOf(target).address.String()+" PING") ||
+		!strings.Contains(log.String(), "<- "+remoteNodeOf(target).address.String()+" PONG") {
+		t.Error("Expected ping and pong to be logged", log.String())
+	}
+}
+
+func TestLossInterceptor(t *testing.T) {
+	server, _ := startTestServer(t)
+	target := startInterceptedServer(t, LossInterceptor(1, 0))
+
+	if _, err := server.Ping(context.Background(), remoteNodeOf(target)); err != ErrorTimeout {
+		t.Error("Expected lost ping to time out", err)
+	}
+
+	// Nothing is lost at rate zero.
+	target = startInterceptedServer(t, LossInterceptor(0, 0))
+
+	if _, err := server.Ping(context.Background(), remoteNodeOf(target)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFaultInterceptor(t *testing.T) {
+	target, _ := startTestServer(t)
+	server := startInterceptedServer(t, FaultInterceptor(Faults{
+		Types:       []PacketType{PingPacketType},
+		CorruptRate: 1,
+	}))
+
+	// Corrupted pings fail the hash check, while the other types pass.
+	if _, err := server.Ping(context.Background(), remoteNodeOf(target)); err != ErrorTimeout {
+		t.Error("Expected corrupted ping to time out", err)
+	}
+
+	if _, err := server.RequestENR(context.Background(), remoteNodeOf(target)); err != nil {
+		t.Error(err)
+	}
+
+	server, _ = startTestServer(t)
+	target = startInterceptedServer(t, FaultInterceptor(Faults{ExpireRate: 1}))
+
+	if _, err := server.Ping(context.Background(), remoteNodeOf(target)); err != ErrorTimeout {
+		t.Error("Expected expired ping to time out", err)
+	}
+
+	if stats := target.Stats(); stats.ExpiredPackets != 1 {
+		t.Error("Expected ping to be dropped as expired", stats)
+	}
+}
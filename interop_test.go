@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// go-ethereum's discv4 implementation serves as the reference peer in these
+// tests. Everything runs on loopback.
+
+func startGeth(t *testing.T, bootnodes ...*enode.Node) (*discover.UDPv4, *ecdsa.PrivateKey) {
+	socket, localNode, key := gethLocalNode(t)
+
+	geth, err := discover.ListenV4(socket, localNode, discover.Config{
+		PrivateKey: key,
+		Bootnodes:  bootnodes,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(geth.Close)
+	return geth, key
+}
+
+func startGethV5(t *testing.T, bootnodes ...*enode.Node) (*discover.UDPv5, *ecdsa.PrivateKey) {
+	socket, localNode, key := gethLocalNode(t)
+
+	geth, err := discover.ListenV5(socket, localNode, discover.Config{
+		PrivateKey: key,
+		Bootnodes:  bootnodes,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(geth.Close)
+	return geth, key
+}
+
+// gethLocalNode opens a loopback socket and the geth local node serving on
+// it.
+func gethLocalNode(t *testing.T) (*net.UDPConn, *enode.LocalNode, *ecdsa.PrivateKey) {
+	key, err := crypto.GenerateKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := enode.OpenDB("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localNode := enode.NewLocalNode(db, key)
+	localNode.SetStaticIP(net.IPv4(127, 0, 0, 1))
+	localNode.SetFallbackUDP(socket.LocalAddr().(*net.UDPAddr).Port)
+
+	// Cleanups run last in first out, so the database outlives the server.
+	t.Cleanup(db.Close)
+	return socket, localNode, key
+}
+
+// gethNode returns how legion sees a geth node.
+func gethNode(geth *discover.UDPv4) *Enode {
+	self := geth.Self()
+	id := crypto.FromECDSAPub(self.Pubkey())[1:]
+	return NewEnode(id, &net.UDPAddr{IP: self.IP(), Port: self.UDP()}, self.TCP())
+}
+
+// legionNode returns how geth sees a legion server, parsed from its enode
+// URL.
+func legionNode(t *testing.T, server Server, localNode LocalNode) *enode.Node {
+	node, err := enode.ParseV4(NewEnode(localNode.GetId(), remoteNodeOf(server).address, 0).URL())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return node
+}
+
+// bondWithGeth pings geth until it has pinged back, after which geth answers
+// legion's requests.
+func bondWithGeth(t *testing.T, server Server, geth *discover.UDPv4) *RemoteNode {
+	node := gethNode(geth)
+	remote, err := node.RemoteNode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.(*serverImpl).ensureBond(context.Background(), node, remote); err != nil {
+		t.Fatal(err)
+	}
+
+	return remote
+}
+
+func TestGethPingsLegion(t *testing.T) {
+	server, localNode := startTestServer(t)
+	geth, _ := startGeth(t)
+
+	if err := geth.Ping(legionNode(t, server, localNode)); err != nil {
+		t.Fatal("Expected geth to accept legion's pong", err)
+	}
+}
+
+func TestLegionPingsGeth(t *testing.T) {
+	server, _ := startTestServer(t)
+	geth, _ := startGeth(t)
+
+	remote, err := gethNode(geth).RemoteNode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pong, err := server.Ping(context.Background(), remote)
+
+	if err != nil {
+		t.Fatal("Expected geth to answer legion's ping", err)
+	}
+
+	if pong.to.UDPAddr().Port() != uint16(server.GetUdpPort()) || pong.to.UDPAddr().Addr().String() != server.GetIP() {
+		t.Error("Expected pong to report legion's address", pong.to.UDPAddr())
+	}
+
+	if pong.enrSeqNum != geth.Self().Seq() {
+		t.Error("Expected pong to carry geth's record sequence number", pong.enrSeqNum)
+	}
+}
+
+func TestGethRequestsENRFromLegion(t *testing.T) {
+	server, localNode := startTestServer(t)
+	geth, _ := startGeth(t)
+
+	node, err := geth.RequestENR(legionNode(t, server, localNode))
+
+	if err != nil {
+		t.Fatal("Expected geth to accept legion's record", err)
+	}
+
+	if node.UDP() != server.GetUdpPort() || !node.IP().Equal(net.ParseIP(server.GetIP())) {
+		t.Error("Unexpected endpoint in legion's record", node.IP(), node.UDP())
+	}
+}
+
+func TestLegionRequestsENRFromGeth(t *testing.T) {
+	server, _ := startTestServer(t)
+	geth, key := startGeth(t)
+	remote := bondWithGeth(t, server, geth)
+
+	record, err := server.RequestENR(context.Background(), remote)
+
+	if err != nil {
+		t.Fatal("Expected legion to accept geth's record", err)
+	}
+
+	id, err := record.NodeId()
+
+	if err != nil || string(id) != string(crypto.FromECDSAPub(&key.PublicKey)[1:]) {
+		t.Error("Expected record to carry geth's id", err)
+	}
+
+	if record.Seq() != geth.Self().Seq() || record.UdpPort() != geth.Self().UDP() {
+		t.Error("Unexpected record", record.Seq(), record.UdpPort())
+	}
+}
+
+func TestLegionFindsNodesThroughGeth(t *testing.T) {
+	server, _ := startTestServer(t)
+	geth, key := startGeth(t)
+
+	// Geth's table ignores new nodes until its first refresh is done, which
+	// a lookup waits for. Without bootnodes that takes a few seconds.
+	geth.LookupPubkey(&key.PublicKey)
+
+	// Nodes that ping geth end up in its table once they answer its ping
+	// back.
+	addresses := map[string]string{}
+	for i := 0; i < 3; i++ {
+		other, otherNode := startTestServer(t)
+		bondWithGeth(t, other, geth)
+		addresses[string(otherNode.GetId())] = remoteNodeOf(other).address.String()
+	}
+
+	remote := bondWithGeth(t, server, geth)
+	addresses[string(server.(*serverImpl).localNode.GetId())] = remoteNodeOf(server).address.String()
+
+	nodes, err := server.FindNode(context.Background(), remote, []byte(server.(*serverImpl).localNode.GetId()))
+
+	if err != nil {
+		t.Fatal("Expected geth to answer find node", err)
+	}
+
+	// Geth prefers nodes it has revalidated, so not every node may be
+	// returned yet.
+	if len(nodes) == 0 {
+		t.Error("Expected geth to return nodes it bonded with")
+	}
+
+	for _, node := range nodes {
+		remote, err := node.RemoteNode()
+
+		if err != nil || addresses[node.id] != remote.address.String() {
+			t.Error("Unexpected neighbor", node.URL(), err)
+		}
+	}
+}
+
+func TestGethLooksUpThroughLegion(t *testing.T) {
+	bootnode, bootNode := startTestServer(t)
+
+	// Servers bootstrapping from legion fill its table.
+	var ids []enode.ID
+	for i := 0; i < 3; i++ {
+		localNode, _ := NewLocalNode()
+		bootnodes := []*Enode{NewEnode(bootNode.GetId(), remoteNodeOf(bootnode).address, 0)}
+		server, err := NewServer("127.0.0.1:0", localNode, Config{Bootnodes: bootnodes})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server.Start(context.Background())
+		t.Cleanup(func() { server.Close() })
+
+		if _, err := Bootstrap(context.Background(), server, bootnodes); err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, legionNode(t, server, localNode).ID())
+	}
+
+	geth, key := startGeth(t, legionNode(t, bootnode, bootNode))
+
+	// The first lookup bootstraps geth's table from legion and then asks
+	// legion for neighbors.
+	deadline := time.Now().Add(5 * time.Second)
+	found := map[enode.ID]bool{}
+
+	for time.Now().Before(deadline) && len(found) < len(ids) {
+		for _, node := range geth.LookupPubkey(&key.PublicKey) {
+			found[node.ID()] = true
+		}
+	}
+
+	for _, id := range ids {
+		if !found[id] {
+			t.Error("Expected geth to find node through legion", id)
+		}
+	}
+}
+
+// gethV5Node returns how legion sees a geth discv5 node.
+func gethV5Node(geth *discover.UDPv5) *Enode {
+	self := geth.Self()
+	id := crypto.FromECDSAPub(self.Pubkey())[1:]
+	return NewEnode(id, &net.UDPAddr{IP: self.IP(), Port: self.UDP()}, self.TCP())
+}
+
+// legionV5Node returns how geth sees a legion discv5 server, parsed from its
+// record.
+func legionV5Node(t *testing.T, server V5Server) *enode.Node {
+	node, err := enode.Parse(enode.ValidSchemes, server.Self().URL())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return node
+}
+
+func TestGethPingsLegionV5(t *testing.T) {
+	server, _ := startV5TestServer(t)
+	geth, _ := startGethV5(t)
+
+	if err := geth.Ping(legionV5Node(t, server)); err != nil {
+		t.Fatal("Expected geth to accept legion's pong", err)
+	}
+}
+
+func TestLegionPingsGethV5(t *testing.T) {
+	server, _ := startV5TestServer(t)
+	geth, _ := startGethV5(t)
+
+	pong, err := server.Ping(context.Background(), gethV5Node(geth))
+
+	if err != nil {
+		t.Fatal("Expected geth to answer legion's ping", err)
+	}
+
+	if pong.Addr().Port() != uint16(server.GetUdpPort()) || pong.EnrSeq() != geth.Self().Seq() {
+		t.Error("Unexpected pong", pong.Addr(), pong.EnrSeq())
+	}
+}
+
+func TestGethRequestsENRFromLegionV5(t *testing.T) {
+	server, _ := startV5TestServer(t)
+	geth, _ := startGethV5(t)
+
+	node, err := geth.RequestENR(legionV5Node(t, server))
+
+	if err != nil {
+		t.Fatal("Expected geth to accept legion's record", err)
+	}
+
+	if node.Seq() != server.Self().Seq() || node.UDP() != server.GetUdpPort() {
+		t.Error("Unexpected record", node.Seq(), node.UDP())
+	}
+}
+
+func TestLegionRequestsENRFromGethV5(t *testing.T) {
+	server, _ := startV5TestServer(t)
+	geth, key := startGethV5(t)
+
+	record, err := server.RequestENR(context.Background(), gethV5Node(geth))
+
+	if err != nil {
+		t.Fatal("Expected legion to accept geth's record", err)
+	}
+
+	id, err := record.NodeId()
+
+	if err != nil || string(id) != string(crypto.FromECDSAPub(&key.PublicKey)[1:]) {
+		t.Error("Expected record to carry geth's id", err)
+	}
+}
+
+func TestGethLooksUpThroughLegionV5(t *testing.T) {
+	bootnode, bootNode := startV5TestServer(t)
+
+	// Nodes pinging legion fill its table.
+	var ids []enode.ID
+	for i := 0; i < 3; i++ {
+		server, _ := startV5TestServer(t)
+
+		if _, err := server.Ping(context.Background(), bootNode); err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, legionV5Node(t, server).ID())
+	}
+
+	geth, _ := startGethV5(t, legionV5Node(t, bootnode))
+
+	deadline := time.Now().Add(5 * time.Second)
+	found := map[enode.ID]bool{}
+
+	for time.Now().Before(deadline) && len(found) < len(ids) {
+		for _, id := range ids {
+			for _, node := range geth.Lookup(id) {
+				found[node.ID()] = true
+			}
+		}
+	}
+
+	for _, id := range ids {
+		if !found[id] {
+			t.Error("Expected geth to find node through legion", id)
+		}
+	}
+}
+
+func TestTalkRequestsWithGethV5(t *testing.T) {
+	server, _ := startV5TestServer(t)
+	geth, _ := startGethV5(t)
+
+	geth.RegisterTalkHandler("geth", func(id enode.ID, from *net.UDPAddr, payload []byte) []byte {
+		return append([]byte("geth "), payload...)
+	})
+
+	server.RegisterTalkHandler("legion", func(nodeID []byte, from *net.UDPAddr, payload []byte) []byte {
+		return append([]byte("legion "), payload...)
+	})
+
+	response, err := server.TalkRequest(context.Background(), gethV5Node(geth), "geth", []byte("hello"))
+
+	if err != nil || string(response) != "geth hello" {
+		t.Error("Unexpected response from geth", string(response), err)
+	}
+
+	response, err = geth.TalkRequest(legionV5Node(t, server), "legion", []byte("hello"))
+
+	if err != nil || string(response) != "legion hello" {
+		t.Error("Unexpected response from legion", string(response), err)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// Iterator is a stream of nodes. Next blocks until a node is available and
+// returns false once the iterator is exhausted or closed. Close may be called
+// concurrently with Next to unblock it.
+type Iterator interface {
+	Next() bool
+	Node() *Enode
+	Close()
+}
+
+// lookupIterator yields the results of random lookups until it or the server
+// is closed.
+type lookupIterator struct {
+	server *serverImpl
+	ctx    context.Context
+	cancel context.CancelFunc
+	buffer []*Enode
+	node   *Enode
+}
+
+// Delay before retrying when a lookup finds nothing, e.g. on an empty table.
+const emptyLookupDelay = time.Second
+
+func (s *serverImpl) RandomNodes() Iterator {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lookupIterator{server: s, ctx: ctx, cancel: cancel}
+}
+
+func (it *lookupIterator) Next() bool {
+	for len(it.buffer) == 0 {
+		if it.ctx.Err() != nil || it.server.ctx.Err() != nil {
+			it.node = nil
+			return false
+		}
+
+		target := make([]byte, len(it.server.localNode.GetId()))
+		rand.Read(target)
+		it.buffer = it.server.Lookup(it.ctx, target)
+
+		if len(it.buffer) == 0 {
+			select {
+			case <-it.server.clock.After(emptyLookupDelay):
+			case <-it.server.closed:
+			case <-it.ctx.Done():
+			}
+		}
+	}
+
+	it.node = it.buffer[0]
+	it.buffer = it.buffer[1:]
+	return true
+}
+
+func (it *lookupIterator) Node() *Enode { return it.node }
+func (it *lookupIterator) Close()       { it.cancel() }
+
+// sliceIterator yields a fixed list of nodes.
+type sliceIterator struct {
+	nodes  []*Enode
+	node   *Enode
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewSliceIterator(nodes []*Enode) Iterator {
+	return &sliceIterator{nodes: nodes}
+}
+
+func (it *sliceIterator) Next() bool {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	if it.closed || len(it.nodes) == 0 {
+		it.node = nil
+		return false
+	}
+
+	it.node = it.nodes[0]
+	it.nodes = it.nodes[1:]
+	return true
+}
+
+func (it *sliceIterator) Node() *Enode { return it.node }
+
+func (it *sliceIterator) Close() {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	it.closed = true
+}
+
+type filterIterator struct {
+	Iterator
+	check func(*Enode) bool
+}
+
+// Filter wraps an iterator so that it only yields nodes passing check.
+func Filter(it Iterator, check func(*Enode) bool) Iterator {
+	return &filterIterator{it, check}
+}
+
+func (f *filterIterator) Next() bool {
+	for f.Iterator.Next() {
+		if f.check(f.Node()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasENRKey is a Filter check for nodes whose record contains key. Nodes
+// without a known record never pass, see WithRecords.
+func HasENRKey(key string) func(*Enode) bool {
+	return func(node *Enode) bool {
+		if node.record == nil {
+			return false
+		}
+
+		_, ok := node.record.Get(key)
+		return ok
+	}
+}
+
+type recordIterator struct {
+	Iterator
+	server Server
+	ctx    context.Context
+	cancel context.CancelFunc
+	node   *Enode
+}
+
+// WithRecords wraps an iterator so that every node is yielded together with
+// its current ENR. Nodes whose record cannot be fetched are skipped.
+func WithRecords(it Iterator, server Server) Iterator {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &recordIterator{Iterator: it, server: server, ctx: ctx, cancel: cancel}
+}
+
+func (r *recordIterator) Next() bool {
+	for r.Iterator.Next() {
+		node := r.Iterator.Node()
+		remote, err := node.RemoteNode()
+
+		if err != nil {
+			continue
+		}
+
+		record, err := r.server.RequestENR(r.ctx, remote)
+
+		if err != nil {
+			continue
+		}
+
+		resolved := *node
+		resolved.record = record
+		r.node = &resolved
+		return true
+	}
+
+	r.node = nil
+	return false
+}
+
+func (r *recordIterator) Node() *Enode { return r.node }
+
+// Close also interrupts a record request in flight.
+func (r *recordIterator) Close() {
+	r.cancel()
+	r.Iterator.Close()
+}
+
+type dedupIterator struct {
+	Iterator
+	seen map[string]bool
+}
+
+// Dedup wraps an iterator so that every node id is yielded at most once.
+func Dedup(it Iterator) Iterator {
+	return &dedupIterator{it, make(map[string]bool)}
+}
+
+func (d *dedupIterator) Next() bool {
+	for d.Iterator.Next() {
+		id := d.Node().id
+
+		if !d.seen[id] {
+			d.seen[id] = true
+			return true
+		}
+	}
+
+	return false
+}
+
+type mixSource struct {
+	it   Iterator
+	next chan *Enode
+}
+
+// FairMix merges several iterators. Sources take turns in round robin order,
+// but a source that does not produce a node within the timeout is skipped in
+// favour of whichever source produces one first. Exhausted sources are
+// dropped, and while there are none Next waits for AddSource or Close.
+type FairMix struct {
+	mu      sync.Mutex
+	sources []*mixSource
+	last    int
+	timeout time.Duration
+	clock   Clock
+	fromAny chan *Enode
+	added   chan struct{}
+	closed  chan struct{}
+	node    *Enode
+	wg      sync.WaitGroup
+}
+
+func NewFairMix(timeout time.Duration, clock Clock) *FairMix {
+	return &FairMix{
+		timeout: timeout,
+		clock:   clock,
+		fromAny: make(chan *Enode),
+		added:   make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (m *FairMix) AddSource(it Iterator) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case <-m.closed:
+		it.Close()
+		return
+	default:
+	}
+
+	source := &mixSource{it, make(chan *Enode)}
+	m.sources = append(m.sources, source)
+
+	m.wg.Add(1)
+	go m.runSource(source)
+
+	select {
+	case m.added <- struct{}{}:
+	default:
+	}
+}
+
+func (m *FairMix) runSource(source *mixSource) {
+	defer m.wg.Done()
+	defer close(source.next)
+
+	for source.it.Next() {
+		node := source.it.Node()
+
+		select {
+		case source.next <- node:
+		case m.fromAny <- node:
+		case <-m.closed:
+			return
+		}
+	}
+}
+
+func (m *FairMix) pickSource() *mixSource {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.sources) == 0 {
+		return nil
+	}
+
+	m.last = (m.last + 1) % len(m.sources)
+	return m.sources[m.last]
+}
+
+func (m *FairMix) removeSource(source *mixSource) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, other := range m.sources {
+		if other == source {
+			m.sources = append(m.sources[:i], m.sources[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *FairMix) Next() bool {
+	m.node = nil
+
+	for {
+		source := m.pickSource()
+
+		if source == nil {
+			select {
+			case <-m.closed:
+				return false
+			case <-m.added:
+				continue
+			}
+		}
+
+		select {
+		case <-m.closed:
+			return false
+		case node, ok := <-source.next:
+			if !ok {
+				m.removeSource(source)
+				continue
+			}
+
+			m.node = node
+			return true
+		case <-m.clock.After(m.timeout):
+		}
+
+		select {
+		case <-m.closed:
+			return false
+		case node := <-m.fromAny:
+			m.node = node
+			return true
+		case node, ok := <-source.next:
+			if !ok {
+				m.removeSource(source)
+				continue
+			}
+
+			m.node = node
+			return true
+		}
+	}
+}
+
+func (m *FairMix) Node() *Enode { return m.node }
+
+func (m *FairMix) Close() {
+	m.mu.Lock()
+
+	select {
+	case <-m.closed:
+		m.mu.Unlock()
+		return
+	default:
+	}
+
+	close(m.closed)
+
+	for _, source := range m.sources {
+		source.it.Close()
+	}
+
+	m.mu.Unlock()
+	m.wg.Wait()
+}
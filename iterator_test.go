@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testNodes(ids ...string) []*Enode {
+	var nodes []*Enode
+	for _, id := range ids {
+		nodes = append(nodes, &Enode{id: id, host: "127.0.0.1", udpPort: "30303", tcpPort: "30303"})
+	}
+
+	return nodes
+}
+
+func collectIds(it Iterator) []string {
+	var ids []string
+	for it.Next() {
+		ids = append(ids, it.Node().id)
+	}
+
+	return ids
+}
+
+func TestFilterAndDedup(t *testing.T) {
+	it := Dedup(Filter(NewSliceIterator(testNodes("a", "b", "a", "c", "b")),
+		func(node *Enode) bool { return node.id != "c" }))
+
+	ids := collectIds(it)
+
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "b" {
+		t.Error("Unexpected nodes", ids)
+	}
+}
+
+func TestHasENRKey(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	record, err := NewENR(1, map[string]any{"eth": []any{}}, localNode.GetPrivKeyBytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := testNodes("a", "b")
+	nodes[1].record = record
+
+	ids := collectIds(Filter(NewSliceIterator(nodes), HasENRKey("eth")))
+
+	if len(ids) != 1 || ids[0] != "b" {
+		t.Error("Unexpected nodes", ids)
+	}
+}
+
+func TestFairMix(t *testing.T) {
+	mix := NewFairMix(100*time.Millisecond, systemClock{})
+	mix.AddSource(NewSliceIterator(testNodes("a1", "a2", "a3")))
+	mix.AddSource(NewSliceIterator(testNodes("b1", "b2", "b3")))
+	defer mix.Close()
+
+	// The mix waits for more sources once both are exhausted.
+	counts := map[byte]int{}
+	for i := 0; i < 6 && mix.Next(); i++ {
+		counts[mix.Node().id[0]]++
+	}
+
+	if counts['a'] != 3 || counts['b'] != 3 {
+		t.Error("Unexpected node counts", counts)
+	}
+}
+
+func TestFairMixClose(t *testing.T) {
+	mix := NewFairMix(time.Second, systemClock{})
+	mix.AddSource(NewSliceIterator(nil))
+
+	done := make(chan bool)
+	go func() { done <- mix.Next() }()
+
+	mix.Close()
+
+	if <-done {
+		t.Error("Expected no node from closed mix")
+	}
+}
+
+func TestFairMixWaitsForSource(t *testing.T) {
+	mix := NewFairMix(time.Second, systemClock{})
+	defer mix.Close()
+
+	done := make(chan bool)
+	go func() { done <- mix.Next() }()
+
+	select {
+	case <-done:
+		t.Fatal("Expected Next to wait for a source")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mix.AddSource(NewSliceIterator(testNodes("a1")))
+
+	if !<-done || mix.Node().id != "a1" {
+		t.Error("Expected the node of the added source")
+	}
+}
+
+func TestFairMixTimeoutByClock(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	mix := NewFairMix(time.Hour, clock)
+	defer mix.Close()
+
+	// An empty mix never yields, so the turn of the second source only
+	// ends when the clock passes the timeout.
+	idle := NewFairMix(time.Hour, clock)
+	mix.AddSource(NewSliceIterator(testNodes("a1")))
+	mix.AddSource(idle)
+
+	done := make(chan bool)
+	go func() { done <- mix.Next() }()
+
+	select {
+	case <-done:
+		t.Fatal("Expected Next to wait for the idle source")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for {
+		clock.Advance(time.Hour)
+
+		select {
+		case ok := <-done:
+			if !ok || mix.Node().id != "a1" {
+				t.Error("Expected the node of the other source")
+			}
+
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestWithRecordsClose(t *testing.T) {
+	server, _ := startTestServer(t)
+	silent, _ := listenPeer(t)
+	nodes := []*Enode{NewEnode([]byte("silent"), silent.LocalAddr().(*net.UDPAddr), 0)}
+
+	it := WithRecords(NewSliceIterator(nodes), server)
+	done := make(chan bool)
+	go func() { done <- it.Next() }()
+
+	time.Sleep(50 * time.Millisecond)
+	it.Close()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Expected no node from closed iterator")
+		}
+	case <-time.After(replyTimeout / 2):
+		t.Error("Expected Close to interrupt the record request")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+const (
+	// Number of concurrent FindNode requests in a lookup.
+	lookupAlpha = 3
+
+	// Nodes failing this many FindNode requests in a row leave the table.
+	maxFindNodeFailures = 5
+)
+
+// Lookup performs an iterative Kademlia lookup for the nodes closest to
+// target, starting from the closest nodes in the table. Every node found is
+// added to the table.
+func (s *serverImpl) Lookup(ctx context.Context, target []byte) []*Enode {
+	return lookup(ctx, s.table, s.localNode.GetId(), target, func(ctx context.Context, node *Enode) []*Enode {
+		return s.lookupQuery(ctx, node, target)
+	})
+}
+
+// lookup runs a lookup for target through table, asking nodes for their
+// neighbors with query.
+func lookup(ctx context.Context, table *Table, selfId, target []byte,
+	query func(context.Context, *Enode) []*Enode) []*Enode {
+	targetHash := Keccak256(target)
+	result := table.Closest(targetHash, bucketSize)
+
+	self := string(selfId)
+	asked := map[string]bool{self: true}
+	seen := map[string]bool{self: true}
+
+	for _, node := range result {
+		seen[node.id] = true
+	}
+
+	for ctx.Err() == nil {
+		var batch []*Enode
+		for _, node := range result {
+			if len(batch) < lookupAlpha && !asked[node.id] {
+				asked[node.id] = true
+				batch = append(batch, node)
+			}
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		found := make(chan []*Enode, len(batch))
+		for _, node := range batch {
+			go func(node *Enode) {
+				found <- query(ctx, node)
+			}(node)
+		}
+
+		for range batch {
+			for _, node := range <-found {
+				if seen[node.id] {
+					continue
+				}
+
+				seen[node.id] = true
+				table.AddSeen(node)
+				result = append(result, node)
+			}
+		}
+
+		sort.Slice(result, func(i, j int) bool {
+			return closerTo(targetHash,
+				Keccak256([]byte(result[i].id)), Keccak256([]byte(result[j].id)))
+		})
+
+		if len(result) > bucketSize {
+			result = result[:bucketSize]
+		}
+	}
+
+	return result
+}
+
+func (s *serverImpl) lookupQuery(ctx context.Context, node *Enode, target []byte) []*Enode {
+	remote, err := node.RemoteNode()
+
+	if err != nil {
+		return nil
+	}
+
+	s.ensureBond(ctx, node, remote)
+	nodes, err := s.FindNode(ctx, remote, target)
+
+	// Failures caused by our own cancellation say nothing about the node.
+	if ctx.Err() != nil || err == ErrorServerClosed {
+		return nil
+	}
+
+	fails := s.db.FindFails(node.id)
+
+	if err != nil {
+		fmt.Println("Lookup query failed", err)
+		fails++
+		s.db.UpdateFindFails(node.id, fails)
+
+		if fails >= maxFindNodeFailures {
+			s.table.Remove(node.id)
+		}
+
+		return nil
+	}
+
+	if fails > 0 {
+		s.db.UpdateFindFails(node.id, 0)
+	}
+
+	return nodes
+}
+
+// ensureBond pings a node that has not pinged us recently. Nodes answer such
+// a ping by pinging back, after which they answer our FindNode requests.
+func (s *serverImpl) ensureBond(ctx context.Context, node *Enode, remote *RemoteNode) error {
+	if s.clock.Now().Sub(s.db.LastPingReceived(node.id)) < bondExpiration {
+		return nil
+	}
+
+	if _, err := s.Ping(ctx, remote); err != nil {
+		return err
+	}
+
+	// Give the node time to ping back and process our pong.
+	select {
+	case <-s.clock.After(replyTimeout):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
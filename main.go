@@ -1,28 +1,211 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+const (
+	// How long a shutdown may take before the process exits anyway.
+	shutdownTimeout = 5 * time.Second
+
+	// Nodes taken from ENR trees for bootstrapping.
+	maxDNSBootnodes = 32
+)
+
+// Subcommands, selected by the first command line argument. Without one a
+// regular node is started.
+var commands = map[string]func(args []string) error{
+	"bootnode": runBootnode,
+	"crawl":    runCrawl,
+	"pcap":     runPcap,
+	"test":     runTest,
+}
+
 func main() {
+	run := runNode
+	args := os.Args[1:]
+
+	if len(args) > 0 && commands[args[0]] != nil {
+		run = commands[args[0]]
+		args = args[1:]
+	}
+
+	if err := run(args); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func runNode(args []string) error {
 	// Parse command line flags
-	serverAddress := flag.String("ip", "0.0.0.0:0", "IP:Port for the server")
-	flag.Parse()
+	flags := flag.NewFlagSet("legion", flag.ExitOnError)
+	serverAddress := flags.String("ip", "0.0.0.0:0", "IP:Port for the server")
+	extIP := flags.String("extip", "", "IP address advertised to other nodes, if not that of --ip")
+	tcpPort := flags.Int("tcpport", 0, "devp2p TCP port advertised to other nodes, if any")
+	clockSkew := flags.Duration("clockskew", 0, "How long expired packets are still accepted")
+	nodeDBPath := flags.String("nodedb", "", "Path of the node database. In-memory if empty")
+	bootnodeUrls := flags.String("bootnodes", "", "Comma separated enode or ENR URLs. Overrides --network")
+	network := flags.String("network", "mainnet", "Network whose bootnodes to use: mainnet, sepolia or holesky")
+	dnsTrees := flags.String("dns", "", "Comma separated enrtree:// URLs of node lists to bootstrap from as well")
+	netrestrict := flags.String("netrestrict", "", "Comma separated CIDR masks of the networks to communicate with")
+	capturePath := flags.String("capture", "", "File to record all traffic to")
+	discovery := flags.String("discovery", "v4", "Discovery versions to run on the socket: v4, v5 or v4,v5")
+	flags.Parse(args)
+
+	netlist, err := ParseNetlist(*netrestrict)
+
+	if err != nil {
+		return fmt.Errorf("Invalid --netrestrict: %w", err)
+	}
+
+	var externalIP net.IP
+
+	if *extIP != "" {
+		if externalIP = net.ParseIP(*extIP); externalIP == nil {
+			return fmt.Errorf("Invalid --extip: %s", *extIP)
+		}
+	}
+
+	bootnodes, err := SelectBootnodes(*network, *bootnodeUrls)
+
+	if err != nil {
+		return err
+	}
+
+	if *dnsTrees != "" {
+		nodes, err := NewDNSClient(DNSConfig{}).Nodes(strings.Split(*dnsTrees, ","), maxDNSBootnodes)
+
+		if err != nil {
+			return fmt.Errorf("Invalid --dns: %w", err)
+		}
+
+		fmt.Println("Found bootnodes in DNS", len(nodes))
+		bootnodes = append(bootnodes, nodes...)
+	}
+
+	nodeDB, err := OpenNodeDB(*nodeDBPath, systemClock{})
+
+	if err != nil {
+		return fmt.Errorf("Failed to open node database: %w", err)
+	}
 
 	// Start local node and server
-	localNode, _ := NewLocalNode()
-	server, _ := NewServer(*serverAddress, localNode)
-	server.Start()
-
-	// Write ping to bootnode
-	bootNode := GetBootNode()
-	server.WritePing(&bootNode, func(ppd *PongPacketData) {
-		fmt.Println("Got ping response", ppd.pingHash)
-		// This assumes the bootnode has also endpoint proofed us at this
-		// point in time.
-		server.FindNeighbors(&bootNode)
+	localNode, err := NewLocalNode()
+
+	if err != nil {
+		return err
+	}
+
+	capture, err := openCapture(*capturePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer closeCapture(capture)
+
+	server, v5Server, err := newDiscoveryServers(*discovery, *serverAddress, localNode, Config{
+		ClockSkew:   *clockSkew,
+		ExternalIP:  externalIP,
+		TCPPort:     *tcpPort,
+		NodeDB:      nodeDB,
+		Bootnodes:   bootnodes,
+		NetRestrict: netlist,
+		Capture:     capture,
 	})
 
-	select {}
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if server != nil {
+		server.Start(ctx)
+
+		// Ping bootnodes
+		alive, err := Bootstrap(ctx, server, bootnodes)
+
+		if err != nil {
+			fmt.Println("Failed to bootstrap", err)
+		} else {
+			fmt.Println("Bootnodes responded", len(alive))
+			// This assumes the bootnodes have also endpoint proofed us at this
+			// point in time.
+			nodes := server.Lookup(ctx, localNode.GetId())
+			fmt.Println("Found neighbors", len(nodes))
+		}
+	}
+
+	// The discv5 server starts out with the bootnodes in its table.
+	if v5Server != nil {
+		v5Server.Start(ctx)
+		nodes := v5Server.Lookup(ctx, localNode.GetId())
+		fmt.Println("Found discv5 neighbors", len(nodes))
+	}
+
+	<-ctx.Done()
+	return shutdown(v5Server, server)
+}
+
+// newDiscoveryServers creates the servers of the discovery versions listed in
+// discovery, sharing one socket if both are. The server of a version not
+// listed is nil.
+func newDiscoveryServers(discovery string, localAddress string, localNode LocalNode,
+	config Config) (Server, V5Server, error) {
+	v4, v5, err := ParseDiscovery(discovery)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if v4 && v5 {
+		return NewSharedServers(localAddress, localNode, config)
+	}
+
+	if v5 {
+		server, err := NewV5Server(localAddress, localNode, config)
+		return nil, server, err
+	}
+
+	server, err := NewServer(localAddress, localNode, config)
+	return server, nil, err
+}
+
+// shutdown closes the servers in order, skipping nil ones, giving up after
+// shutdownTimeout.
+func shutdown(servers ...io.Closer) error {
+	done := make(chan error, 1)
+	go func() {
+		var err error
+
+		for _, server := range servers {
+			if server == nil {
+				continue
+			}
+
+			if closeErr := server.Close(); err == nil {
+				err = closeErr
+			}
+		}
+
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(shutdownTimeout):
+		return fmt.Errorf("Shutdown timed out after %v", shutdownTimeout)
+	}
 }
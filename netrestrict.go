@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// ParseNetlist parses a comma separated list of CIDR masks.
+func ParseNetlist(s string) ([]*net.IPNet, error) {
+	var netlist []*net.IPNet
+
+	for _, mask := range strings.Split(s, ",") {
+		mask = strings.TrimSpace(mask)
+
+		if mask == "" {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(mask)
+
+		if err != nil {
+			return nil, err
+		}
+
+		netlist = append(netlist, network)
+	}
+
+	return netlist, nil
+}
+
+// netlistContains reports whether ip is in one of the networks. An empty
+// list allows every address.
+func netlistContains(netlist []*net.IPNet, ip net.IP) bool {
+	if len(netlist) == 0 {
+		return true
+	}
+
+	for _, network := range netlist {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Errors
+var (
+	ErrorInvalidIP          = errors.New("Invalid IP")
+	ErrorUnspecifiedIP      = errors.New("Unspecified IP")
+	ErrorSpecialIP          = errors.New("Special network IP")
+	ErrorLoopbackFromRemote = errors.New("Loopback IP from non-loopback node")
+	ErrorLANFromPublic      = errors.New("LAN IP from public node")
+	ErrorRestrictedIP       = errors.New("IP outside of restricted networks")
+	ErrorLowPort            = errors.New("Low port")
+)
+
+func mustParseNetlist(s string) []*net.IPNet {
+	netlist, err := ParseNetlist(s)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return netlist
+}
+
+var (
+	lanNetworks = mustParseNetlist("0.0.0.0/8,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fe80::/10,fc00::/7")
+
+	// Reserved ranges that are never used by real nodes, from RFC 6890.
+	specialNetworks = mustParseNetlist("192.0.0.0/29,192.0.0.9/32,192.0.0.170/32,192.0.0.171/32," +
+		"192.0.2.0/24,192.31.196.0/24,192.52.193.0/24,192.88.99.0/24,192.175.48.0/24," +
+		"198.18.0.0/15,198.51.100.0/24,203.0.113.0/24,255.255.255.255/32," +
+		"100::/64,2001::/32,2001:1::1/128,2001:2::/48,2001:3::/32,2001:4:112::/48," +
+		"2001:5::/32,2001:10::/28,2001:20::/28,2001:db8::/32,2002::/16")
+)
+
+func isLAN(ip net.IP) bool {
+	return ip.IsLoopback() || netlistContains(lanNetworks, ip)
+}
+
+func isSpecialNetwork(ip net.IP) bool {
+	return ip.IsMulticast() || netlistContains(specialNetworks, ip)
+}
+
+// checkRelayIP reports whether a node at sender may tell us about a node at
+// addr. Nodes cannot vouch for addresses they could not reach themselves, so
+// only LAN nodes may relay LAN addresses and only loopback nodes may relay
+// loopback addresses.
+func checkRelayIP(sender, addr net.IP) error {
+	if len(addr) != net.IPv4len && len(addr) != net.IPv6len {
+		return ErrorInvalidIP
+	}
+
+	if addr.IsUnspecified() {
+		return ErrorUnspecifiedIP
+	}
+
+	if isSpecialNetwork(addr) {
+		return ErrorSpecialIP
+	}
+
+	if addr.IsLoopback() && !sender.IsLoopback() {
+		return ErrorLoopbackFromRemote
+	}
+
+	if isLAN(addr) && !isLAN(sender) {
+		return ErrorLANFromPublic
+	}
+
+	return nil
+}
+
+// distinctNetSet counts IPs per subnet and refuses to go over a limit for
+// any one subnet. LAN addresses are not limited.
+type distinctNetSet struct {
+	subnet  int
+	limit   int
+	members map[string]int
+}
+
+func newDistinctNetSet(subnet, limit int) *distinctNetSet {
+	return &distinctNetSet{subnet, limit, make(map[string]int)}
+}
+
+func (s *distinctNetSet) key(ip net.IP) string {
+	bits := net.IPv6len * 8
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = net.IPv4len * 8
+	}
+
+	return ip.Mask(net.CIDRMask(s.subnet, bits)).String()
+}
+
+// add reports whether the IP fits and, if so, counts it.
+func (s *distinctNetSet) add(ip net.IP) bool {
+	if ip == nil || isLAN(ip) {
+		return true
+	}
+
+	key := s.key(ip)
+
+	if s.members[key] >= s.limit {
+		return false
+	}
+
+	s.members[key]++
+	return true
+}
+
+func (s *distinctNetSet) remove(ip net.IP) {
+	if ip == nil || isLAN(ip) {
+		return
+	}
+
+	key := s.key(ip)
+
+	if s.members[key] <= 1 {
+		delete(s.members, key)
+	} else {
+		s.members[key]--
+	}
+}
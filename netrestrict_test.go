@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCheckRelayIP(t *testing.T) {
+	tests := []struct {
+		sender, addr string
+		err          error
+	}{
+		{"1.2.3.4", "5.6.7.8", nil},
+		{"127.0.0.1", "127.0.0.2", nil},
+		{"10.0.0.1", "192.168.0.1", nil},
+		{"10.0.0.1", "5.6.7.8", nil},
+		{"1.2.3.4", "0.0.0.0", ErrorUnspecifiedIP},
+		{"1.2.3.4", "192.0.2.1", ErrorSpecialIP},
+		{"1.2.3.4", "224.0.0.1", ErrorSpecialIP},
+		{"1.2.3.4", "127.0.0.1", ErrorLoopbackFromRemote},
+		{"1.2.3.4", "192.168.0.1", ErrorLANFromPublic},
+	}
+
+	for _, test := range tests {
+		err := checkRelayIP(net.ParseIP(test.sender).To4(), net.ParseIP(test.addr).To4())
+
+		if err != test.err {
+			t.Errorf("%s relaying %s: got %v, expected %v", test.sender, test.addr, err, test.err)
+		}
+	}
+}
+
+func TestParseNetlist(t *testing.T) {
+	netlist, err := ParseNetlist("10.0.0.0/8, 192.168.1.0/24")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !netlistContains(netlist, net.ParseIP("192.168.1.7")) || netlistContains(netlist, net.ParseIP("192.168.2.7")) {
+		t.Error("Unexpected netlist membership")
+	}
+
+	if _, err := ParseNetlist("10.0.0.0"); err == nil {
+		t.Error("Expected error for missing mask")
+	}
+}
@@ -1,19 +1,28 @@
 package main
 
 import (
+	"encoding/hex"
+	"errors"
 	"net"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/decred/dcrd/dcrec/secp256k1/v4"
 )
 
-const bootEnodeUrl = "enode://22a8232c3abc76a16ae9d6c3b164f98775fe226f0917b0ca871128a74a8e9630b458460865bab457221f1d448dd9791d24c4e5d88786180ac185df813a68d4de@3.209.45.79:30303"
+const nodeIdLength = 64
+
+// Errors
+var (
+	ErrorInvalidEnode   = errors.New("Invalid enode URL")
+	ErrorInvalidNodeKey = errors.New("Invalid node key")
+)
 
 type LocalNode interface {
 	GetPrivKeyBytes() []byte
 	GetId() []byte
-
-	AddNeighborNode(Enode)
 }
 
 type LocalNodeData struct {
@@ -29,6 +38,9 @@ type Enode struct {
 	host    string
 	udpPort string
 	tcpPort string
+
+	// The node's record, if it has been fetched.
+	record *ENR
 }
 
 func NewLocalNode() (LocalNode, error) {
@@ -43,6 +55,54 @@ func NewLocalNode() (LocalNode, error) {
 	}, nil
 }
 
+func NewLocalNodeFromKey(privKey []byte) LocalNode {
+	return LocalNodeData{
+		privKey: secp256k1.PrivKeyFromBytes(privKey),
+	}
+}
+
+// LoadNodeKey reads a hex encoded private key from path.
+func LoadNodeKey(path string) (LocalNode, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+
+	if err != nil || len(key) != secp256k1.PrivKeyBytesLen {
+		return nil, ErrorInvalidNodeKey
+	}
+
+	return NewLocalNodeFromKey(key), nil
+}
+
+// LoadOrCreateNodeKey reads a hex encoded private key from path. If the file
+// does not exist a new key is generated and saved there, so that the node id
+// stays the same across restarts.
+func LoadOrCreateNodeKey(path string) (LocalNode, error) {
+	localNode, err := LoadNodeKey(path)
+
+	if !os.IsNotExist(err) {
+		return localNode, err
+	}
+
+	localNode, err = NewLocalNode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(path, []byte(hex.EncodeToString(localNode.GetPrivKeyBytes())), 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return localNode, nil
+}
+
 func (ln LocalNodeData) GetPrivKeyBytes() []byte {
 	bytes := ln.privKey.Key.Bytes()
 	return bytes[:]
@@ -53,7 +113,52 @@ func (ln LocalNodeData) GetId() []byte {
 	return ln.privKey.PubKey().SerializeUncompressed()[1:]
 }
 
-func (ln LocalNodeData) AddNeighborNode(node Enode) {
+// NodeID is the uncompressed secp256k1 public key of a node without its
+// leading format byte.
+type NodeID [nodeIdLength]byte
+
+func (id NodeID) String() string { return hex.EncodeToString(id[:]) }
+
+// nodeIDFrom copies a 64 byte id, as returned by LocalNode.GetId, into a
+// NodeID.
+func nodeIDFrom(b []byte) (id NodeID) {
+	copy(id[:], b)
+	return id
+}
+
+func NewEnode(id []byte, address *net.UDPAddr, tcpPort int) *Enode {
+	return &Enode{
+		id:      string(id),
+		host:    address.IP.String(),
+		udpPort: strconv.Itoa(address.Port),
+		tcpPort: strconv.Itoa(tcpPort),
+	}
+}
+
+func (e *Enode) RemoteNode() (*RemoteNode, error) {
+	address, err := net.ResolveUDPAddr("udp", net.JoinHostPort(e.host, e.udpPort))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &RemoteNode{address: address}, nil
+}
+
+// URL returns the node in enode:// form. The discovery port is only given
+// separately when it differs from the TCP port.
+func (e *Enode) URL() string {
+	u := url.URL{
+		Scheme: "enode",
+		User:   url.User(hex.EncodeToString([]byte(e.id))),
+		Host:   net.JoinHostPort(e.host, e.tcpPort),
+	}
+
+	if e.udpPort != e.tcpPort {
+		u.RawQuery = "discport=" + e.udpPort
+	}
+
+	return u.String()
 }
 
 func ParseEnode(enodeUrl string) (*Enode, error) {
@@ -63,7 +168,16 @@ func ParseEnode(enodeUrl string) (*Enode, error) {
 		return nil, err
 	}
 
-	id := u.User.Username()
+	id, err := hex.DecodeString(u.User.Username())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "enode" || len(id) != nodeIdLength {
+		return nil, ErrorInvalidEnode
+	}
+
 	host := u.Hostname()
 	tcpPort := u.Port()
 	udpPort := u.Query().Get("discport")
@@ -72,16 +186,5 @@ func ParseEnode(enodeUrl string) (*Enode, error) {
 		udpPort = tcpPort
 	}
 
-	return &Enode{id, host, tcpPort, udpPort}, nil
-}
-
-func GetBootNode() RemoteNode {
-	bootEnode, _ := ParseEnode(bootEnodeUrl)
-
-	address := bootEnode.host + ":" + bootEnode.udpPort
-	udpAddress, _ := net.ResolveUDPAddr("udp4", address)
-
-	return RemoteNode{
-		address: udpAddress,
-	}
+	return &Enode{string(id), host, udpPort, tcpPort, nil}, nil
 }
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	nodeDBVersion = 1
+
+	// Nodes that have not answered a ping for this long are deleted.
+	nodeDBNodeExpiration = 24 * time.Hour
+	nodeDBFlushInterval  = time.Minute
+	nodeDBExpireInterval = time.Hour
+
+	// Seeds are recently alive nodes used to fill the table on startup. Older
+	// nodes would have expired already.
+	seedCount  = 30
+	seedMaxAge = nodeDBNodeExpiration
+)
+
+type nodeDBEntry struct {
+	Host      string    `json:"host"`
+	UdpPort   string    `json:"udpPort"`
+	TcpPort   string    `json:"tcpPort"`
+	ENR       []byte    `json:"enr,omitempty"`
+	LastPing  time.Time `json:"lastPing"`
+	LastPong  time.Time `json:"lastPong"`
+	FindFails int       `json:"findFails"`
+}
+
+type nodeDBFile struct {
+	Version int                     `json:"version"`
+	Nodes   map[string]*nodeDBEntry `json:"nodes"`
+}
+
+// NodeDB stores what discovery has learned about other nodes in a single file,
+// keyed by hex encoded node id. It is held in memory and written back on
+// Flush. An empty path gives a database that is never written to disk.
+//
+// Every flush that follows a change rewrites the whole file, which servers do
+// once a minute. That is cheap for the few thousand nodes a discovery table
+// comes across, but the database is not meant for much larger node sets,
+// such as the results of a long crawl.
+type NodeDB struct {
+	mu    sync.Mutex
+	path  string
+	nodes map[string]*nodeDBEntry
+	dirty bool
+	clock Clock
+}
+
+func OpenNodeDB(path string, clock Clock) (*NodeDB, error) {
+	db := &NodeDB{
+		path:  path,
+		nodes: make(map[string]*nodeDBEntry),
+		clock: clock,
+	}
+
+	if path == "" {
+		return db, nil
+	}
+
+	data, err := os.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return db, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var file nodeDBFile
+	err = json.Unmarshal(data, &file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries written by other versions are discarded rather than migrated.
+	if file.Version == nodeDBVersion && file.Nodes != nil {
+		db.nodes = file.Nodes
+	}
+
+	// A null entry decodes as nil, which nothing else expects.
+	for key, e := range db.nodes {
+		if e == nil {
+			delete(db.nodes, key)
+		}
+	}
+
+	return db, nil
+}
+
+// entry returns the entry for a node id, creating it if needed. Must be called
+// with the lock held.
+func (db *NodeDB) entry(id string) *nodeDBEntry {
+	key := hex.EncodeToString([]byte(id))
+	e := db.nodes[key]
+
+	if e == nil {
+		e = &nodeDBEntry{}
+		db.nodes[key] = e
+	}
+
+	db.dirty = true
+	return e
+}
+
+func (db *NodeDB) UpdateNode(node *Enode) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	e := db.entry(node.id)
+	e.Host = node.host
+	e.UdpPort = node.udpPort
+	e.TcpPort = node.tcpPort
+}
+
+func (db *NodeDB) UpdateRecord(id string, record *ENR) error {
+	encoded, err := record.ToRLP()
+
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.entry(id).ENR = encoded
+	return nil
+}
+
+// Node returns a stored node together with its record, if known.
+func (db *NodeDB) Node(id string) *Enode {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	e := db.nodes[hex.EncodeToString([]byte(id))]
+
+	if e == nil || e.Host == "" {
+		return nil
+	}
+
+	return e.enode(id)
+}
+
+func (e *nodeDBEntry) enode(id string) *Enode {
+	node := &Enode{
+		id:      id,
+		host:    e.Host,
+		udpPort: e.UdpPort,
+		tcpPort: e.TcpPort,
+	}
+
+	if len(e.ENR) > 0 {
+		node.record, _ = DecodeENR(e.ENR)
+	}
+
+	return node
+}
+
+func (db *NodeDB) UpdateLastPingReceived(id string, t time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.entry(id).LastPing = t
+}
+
+func (db *NodeDB) LastPingReceived(id string) time.Time {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if e := db.nodes[hex.EncodeToString([]byte(id))]; e != nil {
+		return e.LastPing
+	}
+
+	return time.Time{}
+}
+
+func (db *NodeDB) UpdateLastPongReceived(id string, t time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.entry(id).LastPong = t
+}
+
+func (db *NodeDB) LastPongReceived(id string) time.Time {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if e := db.nodes[hex.EncodeToString([]byte(id))]; e != nil {
+		return e.LastPong
+	}
+
+	return time.Time{}
+}
+
+func (db *NodeDB) UpdateFindFails(id string, fails int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.entry(id).FindFails = fails
+}
+
+func (db *NodeDB) FindFails(id string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if e := db.nodes[hex.EncodeToString([]byte(id))]; e != nil {
+		return e.FindFails
+	}
+
+	return 0
+}
+
+// QuerySeeds returns up to n nodes that answered a ping within maxAge, most
+// recently alive first.
+func (db *NodeDB) QuerySeeds(n int, maxAge time.Duration) []*Enode {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := db.clock.Now()
+
+	type seed struct {
+		node     *Enode
+		lastPong time.Time
+	}
+
+	var seeds []seed
+	for key, e := range db.nodes {
+		if e.Host == "" || now.Sub(e.LastPong) > maxAge {
+			continue
+		}
+
+		id, err := hex.DecodeString(key)
+
+		if err != nil {
+			continue
+		}
+
+		seeds = append(seeds, seed{e.enode(string(id)), e.LastPong})
+	}
+
+	sort.Slice(seeds, func(i, j int) bool {
+		return seeds[i].lastPong.After(seeds[j].lastPong)
+	})
+
+	var result []*Enode
+	for i := 0; i < len(seeds) && i < n; i++ {
+		result = append(result, seeds[i].node)
+	}
+
+	return result
+}
+
+// Expire deletes nodes that have not answered a ping recently.
+func (db *NodeDB) Expire() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := db.clock.Now()
+
+	for key, e := range db.nodes {
+		if now.Sub(e.LastPong) > nodeDBNodeExpiration && now.Sub(e.LastPing) > nodeDBNodeExpiration {
+			delete(db.nodes, key)
+			db.dirty = true
+		}
+	}
+}
+
+func (db *NodeDB) Len() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return len(db.nodes)
+}
+
+// Flush writes the database to disk if it changed.
+func (db *NodeDB) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.path == "" || !db.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(nodeDBFile{nodeDBVersion, db.nodes})
+
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(db.path, data); err != nil {
+		return err
+	}
+
+	db.dirty = false
+	return nil
+}
+
+// writeFileAtomic replaces a file through a temporary file, so that a crash
+// never leaves it partially written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
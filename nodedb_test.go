@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNodeDBPersistence(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	db, err := OpenNodeDB(path, clock)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localNode, _ := NewLocalNode()
+	record, err := NewENR(3, map[string]any{enrKeyUdp: 30303}, localNode.GetPrivKeyBytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alive := &Enode{id: string(localNode.GetId()), host: "10.0.0.1", udpPort: "30303", tcpPort: "30303"}
+	stale := &Enode{id: "stale", host: "10.0.0.2", udpPort: "30303", tcpPort: "30303"}
+
+	db.UpdateNode(stale)
+	db.UpdateLastPongReceived(stale.id, clock.Now())
+	clock.Advance(2 * nodeDBNodeExpiration)
+
+	db.UpdateNode(alive)
+	db.UpdateRecord(alive.id, record)
+	db.UpdateLastPongReceived(alive.id, clock.Now())
+	db.UpdateFindFails(alive.id, 2)
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenNodeDB(path, clock)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if db.FindFails(alive.id) != 2 || !db.LastPongReceived(alive.id).Equal(clock.Now()) {
+		t.Error("Node state was not persisted")
+	}
+
+	node := db.Node(alive.id)
+
+	if node == nil || node.record == nil || node.record.Seq() != 3 {
+		t.Fatal("Node record was not persisted")
+	}
+
+	seeds := db.QuerySeeds(seedCount, seedMaxAge)
+
+	// The stale node is about to expire and no longer a seed.
+	if len(seeds) != 1 || !bytes.Equal([]byte(seeds[0].id), localNode.GetId()) {
+		t.Error("Expected only the recently alive node", len(seeds))
+	}
+
+	db.Expire()
+
+	if db.Len() != 1 || db.Node(stale.id) != nil {
+		t.Error("Expected stale node to expire")
+	}
+}
+
+func TestNodeDBNullEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	data := []byte(`{"version": 1, "nodes": {"00": null}}`)
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenNodeDB(path, NewManualClock(time.Now()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if db.Len() != 0 {
+		t.Error("Expected null entries to be dropped", db.Len())
+	}
+
+	db.QuerySeeds(seedCount, seedMaxAge)
+	db.Expire()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Above this many tracked sources, idle ones are forgotten.
+const maxRateLimitSources = 10000
+
+// RateLimit allows Rate events per second, with bursts of up to Burst
+// events.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last call, up to burst.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	b.last = now
+
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// ipRateLimiter keeps a token bucket per source IP. Each bucket refills at
+// rate tokens per second up to burst, and every allowed packet takes a token.
+type ipRateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	clock   Clock
+	buckets map[string]*tokenBucket
+}
+
+func newIPRateLimiter(rate float64, burst int, clock Clock) *ipRateLimiter {
+	return &ipRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clock:   clock,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (l *ipRateLimiter) allow(ip net.IP) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	key := ip.String()
+	b := l.buckets[key]
+
+	if b == nil {
+		if len(l.buckets) >= maxRateLimitSources {
+			l.forgetIdle(now)
+		}
+
+		b = &tokenBucket{l.burst, now}
+		l.buckets[key] = b
+	}
+
+	b.refill(now, l.rate, l.burst)
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// forgetIdle drops buckets that have refilled completely, since a new bucket
+// would be in the same state.
+func (l *ipRateLimiter) forgetIdle(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+const maxSeenPackets = 10000
+
+type seenPacket struct {
+	hash  string
+	until time.Time
+}
+
+// seenPacketHeap orders remembered packets by the time they can be
+// forgotten, soonest first.
+type seenPacketHeap []seenPacket
+
+func (h seenPacketHeap) Len() int           { return len(h) }
+func (h seenPacketHeap) Less(i, j int) bool { return h[i].until.Before(h[j].until) }
+func (h seenPacketHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *seenPacketHeap) Push(x any)        { *h = append(*h, x.(seenPacket)) }
+
+func (h *seenPacketHeap) Pop() any {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
+
+// packetHashCache remembers the hashes of recently received packets so that
+// exact replays can be dropped. Each entry is kept until the packet it stands
+// for expires, after which a replay is rejected as expired instead. Above the
+// limit, the entries expiring soonest are forgotten first.
+type packetHashCache struct {
+	mu    sync.Mutex
+	limit int
+	seen  map[string]bool
+	order seenPacketHeap
+}
+
+func newPacketHashCache(limit int) *packetHashCache {
+	return &packetHashCache{
+		limit: limit,
+		seen:  make(map[string]bool),
+	}
+}
+
+// add records a packet hash until the packet expires and reports whether it
+// was seen before.
+func (c *packetHashCache) add(hash []byte, now, until time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evict(now)
+
+	key := string(hash)
+	if c.seen[key] {
+		return true
+	}
+
+	if len(c.order) >= c.limit {
+		delete(c.seen, heap.Pop(&c.order).(seenPacket).hash)
+	}
+
+	c.seen[key] = true
+	heap.Push(&c.order, seenPacket{key, until})
+
+	return false
+}
+
+func (c *packetHashCache) evict(now time.Time) {
+	for len(c.order) > 0 && c.order[0].until.Before(now) {
+		delete(c.seen, heap.Pop(&c.order).(seenPacket).hash)
+	}
+}
@@ -16,6 +16,19 @@ func getLengthInBytes(length int) byte {
 	return byte(math.Ceil(float64(binaryLength) / 8))
 }
 
+// encodeLength returns the big endian bytes of a length with no leading zeros.
+func encodeLength(length int) []byte {
+	numBytes := int(getLengthInBytes(length))
+	output := make([]byte, numBytes)
+
+	for i := numBytes - 1; i >= 0; i-- {
+		output[i] = byte(length)
+		length >>= 8
+	}
+
+	return output
+}
+
 func encodeString(data string) []byte {
 	var strLen = len(data)
 
@@ -31,7 +44,7 @@ func encodeString(data string) []byte {
 
 	default:
 		output = append(output, 0xb7+getLengthInBytes(strLen))
-		output = append(output, byte(strLen))
+		output = append(output, encodeLength(strLen)...)
 		return append(output, data...)
 	}
 }
@@ -79,7 +92,8 @@ func encodeList(data any) ([]byte, error) {
 			return append([]byte{0xc0 + byte(len(output))}, output...), nil
 
 		default:
-			return append([]byte{0xf7 + getLengthInBytes(outputLen), byte(outputLen)}, output...), nil
+			prefix := append([]byte{0xf7 + getLengthInBytes(outputLen)}, encodeLength(outputLen)...)
+			return append(prefix, output...), nil
 		}
 	}
 }
@@ -92,7 +106,7 @@ func encodeUInt(i uint64) ([]byte, error) {
 		return []byte{byte(i)}, nil
 	default:
 		buf := new(bytes.Buffer)
-		err := binary.Write(buf, binary.BigEndian, uint32(i))
+		err := binary.Write(buf, binary.BigEndian, i)
 
 		if err != nil {
 			return nil, err
@@ -149,6 +163,31 @@ func Encode(data any) ([]byte, error) {
 	}
 }
 
+// Errors
+var (
+	ErrorRLPTooShort       = errors.New("RLP input too short")
+	ErrorRLPLengthTooLarge = errors.New("RLP length too large")
+)
+
+// decodeLength reads a big endian length of n bytes at start and returns it
+// together with the index of the first byte after it.
+func decodeLength(data []byte, start, n int) (int, int, error) {
+	if n > 4 {
+		return 0, 0, ErrorRLPLengthTooLarge
+	}
+
+	end := start + n
+
+	if end > len(data) {
+		return 0, 0, ErrorRLPTooShort
+	}
+
+	lengthBytes := make([]byte, 4-n, 4)
+	lengthBytes = append(lengthBytes, data[start:end]...)
+
+	return int(binary.BigEndian.Uint32(lengthBytes)), end, nil
+}
+
 func decodeNextList(data []byte, start int) (any, int, error) {
 	prefix := data[start]
 
@@ -164,18 +203,26 @@ func decodeNextList(data []byte, start int) (any, int, error) {
 		}
 
 		end = start + 1 + listLength
+
+		if end > len(data) {
+			return nil, 0, ErrorRLPTooShort
+		}
+
 		list = data[start+1 : end]
 
 	case prefix >= 0xf8 && prefix <= 0xff:
-		listLengthEnd := start + 1 + int(prefix-0xf7)
-		listLengthBytes := data[start+1 : listLengthEnd]
+		listLength, listLengthEnd, err := decodeLength(data, start+1, int(prefix-0xf7))
 
-		for len(listLengthBytes) != 4 {
-			listLengthBytes = append([]byte{0}, listLengthBytes...)
+		if err != nil {
+			return nil, 0, err
 		}
 
-		listLength := int(binary.BigEndian.Uint32(listLengthBytes))
 		end = listLengthEnd + listLength
+
+		if end > len(data) {
+			return nil, 0, ErrorRLPTooShort
+		}
+
 		list = data[listLengthEnd:end]
 
 	default:
@@ -205,6 +252,10 @@ func decodeNextList(data []byte, start int) (any, int, error) {
 }
 
 func decodeNext(data []byte, start int) (any, int, error) {
+	if start >= len(data) {
+		return nil, 0, ErrorRLPTooShort
+	}
+
 	prefix := data[start]
 
 	switch {
@@ -214,18 +265,26 @@ func decodeNext(data []byte, start int) (any, int, error) {
 	case prefix >= 0x80 && prefix <= 0xb7:
 		stringLength := int(prefix - 0x80)
 		end := start + 1 + stringLength
+
+		if end > len(data) {
+			return nil, 0, ErrorRLPTooShort
+		}
+
 		return string(data[start+1 : end]), end, nil
 
 	case prefix >= 0xb8 && prefix <= 0xbf:
-		stringLengthEnd := start + 1 + int(prefix-0xb7)
-		stringLengthBytes := data[start+1 : stringLengthEnd]
+		stringLength, stringLengthEnd, err := decodeLength(data, start+1, int(prefix-0xb7))
 
-		for len(stringLengthBytes) != 4 {
-			stringLengthBytes = append([]byte{0}, stringLengthBytes...)
+		if err != nil {
+			return nil, 0, err
 		}
 
-		stringLength := int(binary.BigEndian.Uint32(stringLengthBytes))
 		end := stringLengthEnd + stringLength
+
+		if end > len(data) {
+			return nil, 0, ErrorRLPTooShort
+		}
+
 		return string(data[stringLengthEnd:end]), end, nil
 
 	case prefix >= 0xc0 && prefix <= 0xff:
@@ -190,3 +190,30 @@ func TestDecodeFindNeighbors(t *testing.T) {
 		t.Error("Unexpected expiration")
 	}
 }
+
+func TestEncodeLongList(t *testing.T) {
+	items := make([]string, 100)
+	for i := range items {
+		items[i] = "dog"
+	}
+
+	actual := encodeAndIgnoreError(items)
+
+	// 100 items of 4 bytes each need a two byte length.
+	testHelper(actual[:3], []byte{0xf9, 0x01, 0x90}, t)
+
+	if !reflect.DeepEqual(decodeAndIgnoreError(actual), func() []any {
+		var expected []any
+		for _, item := range items {
+			expected = append(expected, item)
+		}
+		return expected
+	}()) {
+		t.Error("Failed to round trip long list")
+	}
+}
+
+func TestEncodeLongString(t *testing.T) {
+	actual := encodeAndIgnoreError(string(make([]byte, 1024)))
+	testHelper(actual[:3], []byte{0xb9, 0x04, 0x00}, t)
+}
@@ -1,102 +1,620 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	packetExpiration = 20 * time.Second
+	replyTimeout     = 500 * time.Millisecond
 	maxDatagramSize  = 1280
 	enrSeqNum        = 1
+	bucketSize       = 16
+
+	// Nodes only answer FindNode from peers that answered one of their pings
+	// within this time.
+	bondExpiration = 24 * time.Hour
+
+	defaultWorkers      = 8
+	defaultQueueSize    = 256
+	defaultRequestRate  = 10
+	defaultRequestBurst = 30
+	defaultReplyRate    = 100
+	defaultReplyBurst   = 300
+	defaultWriteQueue   = 64
+	defaultEgressPPS    = 500
+	defaultEgressBPS    = 512 * 1024
+
+	// Pause after a failed socket read, so that a persistent error does not
+	// turn readLoop into a busy loop.
+	readErrorDelay = 100 * time.Millisecond
 )
 
+// Errors
+var (
+	ErrorTimeout            = errors.New("Request timed out")
+	ErrorInvalidResponse    = errors.New("Invalid response")
+	ErrorExpiredPacket      = errors.New("Packet expired")
+	ErrorReplayedPacket     = errors.New("Packet replayed")
+	ErrorServerClosed       = errors.New("Server closed")
+	ErrorAddressFamily      = errors.New("Address family not supported by socket")
+	ErrorUnsupportedAddress = errors.New("Transport address is not a UDP address")
+)
+
+type Config struct {
+	// ExternalIP is the address advertised in the local record, for servers
+	// reachable at another address than the one they listen on. Without it,
+	// a server listening on a wildcard address advertises loopback.
+	ExternalIP net.IP
+
+	// TCPPort is the devp2p port of the node, advertised in the local record
+	// and in pings. Zero leaves it out.
+	TCPPort int
+
+	// ClockSkew is how long after its expiration a packet is still accepted,
+	// to tolerate peers whose clocks are behind ours.
+	ClockSkew time.Duration
+
+	// RevalidateInterval is the maximum time between two liveness checks of
+	// table nodes. Values of zero or less select the default.
+	RevalidateInterval time.Duration
+
+	// RefreshInterval is the time between two table refreshes. Values of
+	// zero or less select the default.
+	RefreshInterval time.Duration
+
+	// Clock drives table maintenance and reply timeouts. Defaults to the
+	// system clock.
+	Clock Clock
+
+	// NodeDB persists knowledge about other nodes. Defaults to an in-memory
+	// database.
+	NodeDB *NodeDB
+
+	// Bootnodes are used to join the network when the table is empty.
+	Bootnodes []*Enode
+
+	// NetRestrict limits communication to the given networks, if not empty.
+	NetRestrict []*net.IPNet
+
+	// Workers is the number of goroutines handling incoming packets.
+	Workers int
+
+	// QueueSize is the number of received packets waiting for a worker.
+	// Packets arriving while the queue is full are dropped.
+	QueueSize int
+
+	// RequestRate is the number of requests per second accepted from a single
+	// IP, with bursts of up to RequestBurst requests. The discv5 server also
+	// counts the packets it answers with a WHOAREYOU.
+	RequestRate  float64
+	RequestBurst int
+
+	// ReplyRate and ReplyBurst limit all other discv4 packets from a single
+	// IP the same way. A lookup receives several replies for each request,
+	// so this budget is larger.
+	ReplyRate  float64
+	ReplyBurst int
+
+	// TalkRateLimits further limits the discv5 TALKREQ requests accepted from
+	// a single IP for each protocol. All TALKREQ requests also count towards
+	// RequestRate and RequestBurst, like other requests.
+	TalkRateLimits map[string]RateLimit
+
+	// WriteQueueSize is the number of outgoing packets of each priority that
+	// may wait to be written before callers block.
+	WriteQueueSize int
+
+	// EgressPacketRate and EgressByteRate limit outgoing traffic in packets
+	// and bytes per second. Negative values disable the limit.
+	EgressPacketRate float64
+	EgressByteRate   float64
+
+	// Capture, if set, records every datagram sent and received. It is not
+	// closed with the server.
+	Capture *Capture
+
+	// Interceptors see every packet in the order given, see Interceptor.
+	Interceptors []Interceptor
+
+	// Unhandled, if set, receives the datagrams that are not discv4 packets
+	// instead of them being dropped, see NewSharedServers. Datagrams are
+	// dropped while the channel is full.
+	Unhandled chan<- UnhandledPacket
+}
+
+func (c Config) withDefaults() (Config, error) {
+	if c.RevalidateInterval <= 0 {
+		c.RevalidateInterval = defaultRevalidateInterval
+	}
+
+	if c.RefreshInterval <= 0 {
+		c.RefreshInterval = defaultRefreshInterval
+	}
+
+	if c.Clock == nil {
+		c.Clock = systemClock{}
+	}
+
+	if c.NodeDB == nil {
+		db, err := OpenNodeDB("", c.Clock)
+
+		if err != nil {
+			return c, err
+		}
+
+		c.NodeDB = db
+	}
+
+	if c.Workers <= 0 {
+		c.Workers = defaultWorkers
+	}
+
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaultQueueSize
+	}
+
+	if c.RequestRate <= 0 {
+		c.RequestRate = defaultRequestRate
+	}
+
+	if c.RequestBurst <= 0 {
+		c.RequestBurst = defaultRequestBurst
+	}
+
+	if c.ReplyRate <= 0 {
+		c.ReplyRate = defaultReplyRate
+	}
+
+	if c.ReplyBurst <= 0 {
+		c.ReplyBurst = defaultReplyBurst
+	}
+
+	if c.WriteQueueSize <= 0 {
+		c.WriteQueueSize = defaultWriteQueue
+	}
+
+	if c.EgressPacketRate == 0 {
+		c.EgressPacketRate = defaultEgressPPS
+	}
+
+	if c.EgressByteRate == 0 {
+		c.EgressByteRate = defaultEgressBPS
+	}
+
+	return c, nil
+}
+
+type ServerStats struct {
+	ExpiredPackets     uint64
+	ReplayedPackets    uint64
+	DroppedPackets     uint64
+	RateLimitedPackets uint64
+	ReadErrors         uint64
+}
+
 type Server interface {
 	GetIP() string
 	GetUdpPort() int
 	GetTcpPort() int
-	Start()
-	WritePing(*RemoteNode, func(*PongPacketData)) error
-	FindNeighbors(*RemoteNode) error
+	Start(context.Context)
+	Close() error
+	Stats() ServerStats
+	Ping(context.Context, *RemoteNode) (*PongPacketData, error)
+	FindNode(ctx context.Context, to *RemoteNode, target []byte) ([]*Enode, error)
+	RequestENR(context.Context, *RemoteNode) (*ENR, error)
+	Lookup(ctx context.Context, target []byte) []*Enode
+	RandomNodes() Iterator
+}
+
+// pendingReply is a request waiting for one or more response packets of a
+// given type from a given address. The callback is invoked for every such
+// packet and reports whether the packet belongs to the request and whether
+// the request is complete.
+type pendingReply struct {
+	from       *net.UDPAddr
+	packetType PacketType
+	callback   func(header *PacketHeader, data any) (matched, done bool)
+	done       chan error
+}
+
+// pingCall is a ping in flight, shared by everyone pinging the same node
+// with the same packet.
+type pingCall struct {
+	done chan struct{}
+	pong *PongPacketData
+	err  error
 }
 
 type serverImpl struct {
-	localNode     LocalNode
-	udpSocket     *net.UDPConn
-	ip            string
-	udpPort       int
-	tcpPort       int
-	pingCallbacks map[string]func(*PongPacketData)
+	localNode LocalNode
+	transport Transport
+	ip        string
+	udpPort   int
+	tcpPort   int
+	record    *ENR
+	config    Config
+	clock     Clock
+	table     *Table
+	db        *NodeDB
+
+	mu      sync.Mutex
+	pending []*pendingReply
+	pings   map[string]*pingCall
+
+	queue        chan inboundPacket
+	rateLimiter  *ipRateLimiter
+	replyLimiter *ipRateLimiter
+	writer       *packetWriter
+
+	// ctx is cancelled by Close to stop the background loops, which wg
+	// tracks. closed is closed at the same time.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	wg        sync.WaitGroup
+
+	seenPackets        *packetHashCache
+	expiredPackets     atomic.Uint64
+	replayedPackets    atomic.Uint64
+	droppedPackets     atomic.Uint64
+	rateLimitedPackets atomic.Uint64
+	readErrors         atomic.Uint64
+}
+
+type inboundPacket struct {
+	data []byte
+	from *net.UDPAddr
 }
 
-func NewServer(localAddress string, localNode LocalNode) (Server, error) {
-	socket, err := net.ListenPacket("udp4", localAddress)
+func NewServer(localAddress string, localNode LocalNode, config Config) (Server, error) {
+	// Wildcard addresses give a dual-stack socket.
+	socket, err := net.ListenPacket("udp", localAddress)
 
 	if err != nil {
 		return nil, err
 	}
 
-	usocket := socket.(*net.UDPConn)
-	var ip string
-	uaddr := socket.LocalAddr().(*net.UDPAddr)
-	if uaddr.IP.IsUnspecified() {
-		ip = "127.0.0.1"
-	} else {
-		ip = uaddr.IP.String()
+	return NewServerWithTransport(socket, localNode, config)
+}
+
+// NewServerWithTransport creates a server that sends and receives packets
+// through transport. The server takes ownership of the transport and closes
+// it in Close.
+func NewServerWithTransport(transport Transport, localNode LocalNode, config Config) (Server, error) {
+	uaddr, ok := transport.LocalAddr().(*net.UDPAddr)
+
+	if !ok {
+		return nil, ErrorUnsupportedAddress
+	}
+
+	config, err := config.withDefaults()
+
+	if err != nil {
+		return nil, err
 	}
 
-	udpPort := uaddr.Port
+	ip, record, err := localRecord(localNode, uaddr, config.ExternalIP, config.TCPPort)
+
+	if err != nil {
+		return nil, err
+	}
 
-	return serverImpl{
-		localNode,
-		usocket,
-		ip,
-		udpPort,
-		0,
-		make(map[string]func(*PongPacketData)),
+	if config.Capture != nil {
+		transport = &captureTransport{transport, config.Capture, config.Clock}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &serverImpl{
+		localNode: localNode,
+		transport: transport,
+		ip:        ip,
+		udpPort:   uaddr.Port,
+		tcpPort:   config.TCPPort,
+		record:    record,
+		config:    config,
+		clock:     config.Clock,
+		table:     NewTable(localNode.GetId(), config.Clock),
+		db:        config.NodeDB,
+		pings:     make(map[string]*pingCall),
+
+		queue:        make(chan inboundPacket, config.QueueSize),
+		rateLimiter:  newIPRateLimiter(config.RequestRate, config.RequestBurst, config.Clock),
+		replyLimiter: newIPRateLimiter(config.ReplyRate, config.ReplyBurst, config.Clock),
+		writer: newPacketWriter(transport, config.WriteQueueSize,
+			config.EgressPacketRate, config.EgressByteRate, config.Interceptors),
+		ctx:         ctx,
+		cancel:      cancel,
+		closed:      make(chan struct{}),
+		seenPackets: newPacketHashCache(maxSeenPackets),
 	}, nil
 }
 
-func (s serverImpl) GetIP() string   { return s.ip }
-func (s serverImpl) GetUdpPort() int { return s.udpPort }
-func (s serverImpl) GetTcpPort() int { return s.tcpPort }
+// localRecord returns the address a server advertises for a socket and the
+// record carrying it. That is externalIP if set, otherwise the socket's
+// address, with wildcard sockets advertising loopback. An IPv6 wildcard
+// socket is dual-stack and advertises both families.
+func localRecord(localNode LocalNode, uaddr *net.UDPAddr, externalIP net.IP, tcpPort int) (string, *ENR, error) {
+	ip := uaddr.IP.String()
+	var ip6 string
+
+	if externalIP != nil {
+		ip = externalIP.String()
+	} else if uaddr.IP.IsUnspecified() {
+		ip = "127.0.0.1"
+
+		if uaddr.IP.To4() == nil {
+			ip6 = "::1"
+		}
+	}
+
+	pairs := make(map[string]any)
+
+	for _, s := range []string{ip, ip6} {
+		if s == "" {
+			continue
+		}
+
+		addr, err := netip.ParseAddr(s)
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		ipKey, udpKey, tcpKey := enrKeyIp, enrKeyUdp, enrKeyTcp
+
+		if !addr.Unmap().Is4() {
+			ipKey, udpKey, tcpKey = enrKeyIp6, enrKeyUdp6, enrKeyTcp6
+		}
+
+		pairs[ipKey] = ipBytes(addr)
+		pairs[udpKey] = uaddr.Port
+
+		if tcpPort != 0 {
+			pairs[tcpKey] = tcpPort
+		}
+	}
+
+	record, err := NewENR(enrSeqNum, pairs, localNode.GetPrivKeyBytes())
+	return ip, record, err
+}
+
+func (s *serverImpl) GetIP() string   { return s.ip }
+func (s *serverImpl) GetUdpPort() int { return s.udpPort }
+func (s *serverImpl) GetTcpPort() int { return s.tcpPort }
+
+func (s *serverImpl) Stats() ServerStats {
+	return ServerStats{
+		ExpiredPackets:     s.expiredPackets.Load(),
+		ReplayedPackets:    s.replayedPackets.Load(),
+		DroppedPackets:     s.droppedPackets.Load(),
+		RateLimitedPackets: s.rateLimitedPackets.Load(),
+		ReadErrors:         s.readErrors.Load(),
+	}
+}
 
-func getExpiration() uint64 { return uint64(time.Now().Add(packetExpiration).Unix()) }
+// expiration is the expiration of packets sent now by the server's clock.
+func (s *serverImpl) expiration() uint64 {
+	return uint64(s.clock.Now().Add(packetExpiration).Unix())
+}
 
-func (s serverImpl) Start() {
+// Start runs the server in the background until Close is called or ctx is
+// done, whichever happens first.
+func (s *serverImpl) Start(ctx context.Context) {
 	fmt.Println("Server starting.", s.ip, s.udpPort)
-	go s.readLoop()
+
+	for _, node := range s.db.QuerySeeds(seedCount, seedMaxAge) {
+		s.table.AddSeen(node)
+	}
+
+	for i := 0; i < s.config.Workers; i++ {
+		s.spawn(s.worker)
+	}
+
+	s.spawn(s.readLoop)
+	s.spawn(s.writer.loop)
+	s.spawn(s.dbLoop)
+	s.spawn(s.revalidateLoop)
+	s.spawn(s.refreshLoop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.closed:
+		}
+	}()
+}
+
+func (s *serverImpl) spawn(loop func()) {
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+		loop()
+	}()
+}
+
+// Close stops the server. Requests in flight fail with ErrorServerClosed, the
+// background loops are stopped, the node database is flushed and the socket
+// is closed. It is safe to call Close more than once; every call returns the
+// result of the first.
+func (s *serverImpl) Close() error {
+	s.closeOnce.Do(func() {
+		fmt.Println("Server closing.", s.ip, s.udpPort)
+
+		s.cancel()
+		close(s.closed)
+		s.writer.close()
+		s.transport.Close()
+		s.failPending(ErrorServerClosed)
+		s.wg.Wait()
+
+		s.closeErr = s.db.Flush()
+	})
+
+	return s.closeErr
 }
 
-func (s serverImpl) readLoop() {
+// readLoop hands received packets to the workers. It never blocks on a slow
+// handler: packets are dropped when the queue is full or when the sender is
+// over its request rate.
+func (s *serverImpl) readLoop() {
+	defer close(s.queue)
+
 	buf := make([]byte, maxDatagramSize)
 	for {
-		numBytes, from, err := s.udpSocket.ReadFromUDP(buf)
+		numBytes, addr, err := s.transport.ReadFrom(buf)
+
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 
 		if err != nil {
-			panic(err)
+			fmt.Println("Error reading packet", err)
+			s.readErrors.Add(1)
+
+			select {
+			case <-s.clock.After(readErrorDelay):
+			case <-s.closed:
+				return
+			}
+
+			continue
+		}
+
+		if !s.receive(buf[:numBytes], addr) {
+			packetHandled(s.transport)
 		}
+	}
+}
+
+// receive queues a datagram for the workers and reports whether it did.
+// Datagrams that are dropped or passed on count as handled right away.
+func (s *serverImpl) receive(data []byte, addr net.Addr) bool {
+	from, ok := addr.(*net.UDPAddr)
+
+	if !ok {
+		return false
+	}
+
+	// This also covers the datagrams passed on to another protocol.
+	if !netlistContains(s.config.NetRestrict, from.IP) {
+		fmt.Println("Dropping packet from restricted address", from.IP)
+		return false
+	}
 
-		fmt.Println("Read new packet. Size", numBytes)
+	bytes := make([]byte, len(data))
+	copy(bytes, data)
 
-		bytes := make([]byte, numBytes)
-		copy(bytes, buf)
+	// Datagrams of another protocol sharing the socket are left to its
+	// own rate limiting.
+	if s.config.Unhandled != nil && !hasPacketHash(bytes) {
+		s.passUnhandled(bytes, from)
+		return false
+	}
+
+	// The type byte is not authenticated yet, but whatever a datagram
+	// claims to be, it counts against one of the budgets of its source.
+	limiter := s.replyLimiter
+
+	if isRequest(bytes) {
+		limiter = s.rateLimiter
+	}
+
+	if !limiter.allow(from.IP) {
+		s.rateLimitedPackets.Add(1)
+		return false
+	}
+
+	select {
+	case s.queue <- inboundPacket{bytes, from}:
+		return true
+	default:
+		s.droppedPackets.Add(1)
+		return false
+	}
+}
+
+func (s *serverImpl) worker() {
+	for packet := range s.queue {
+		s.handlePacket(packet.data, packet.from)
+		packetHandled(s.transport)
+	}
+}
+
+// isRequest reports whether a packet asks us to do work, judging only by the
+// type byte. The packet is not decoded yet, so this must not be trusted for
+// anything but rate limiting.
+func isRequest(packet []byte) bool {
+	return len(packet) >= headerSize && isRequestType(PacketType(packet[headerSize-1]))
+}
+
+// hasPacketHash reports whether a datagram starts with the hash of its
+// remainder, as discv4 packets do. Unlike the signature, this is cheap to
+// check before rate limiting.
+func hasPacketHash(packet []byte) bool {
+	return len(packet) > headerSize && bytes.Equal(packet[:hashLength], Keccak256(packet[hashLength:]))
+}
+
+// passUnhandled hands a datagram that is not a discv4 packet to
+// Config.Unhandled, see NewSharedServers.
+func (s *serverImpl) passUnhandled(data []byte, from *net.UDPAddr) {
+	select {
+	case s.config.Unhandled <- UnhandledPacket{data, from}:
+	default:
+		s.droppedPackets.Add(1)
+	}
+}
 
-		go s.handlePacket(bytes, from)
+func isRequestType(t PacketType) bool {
+	switch t {
+	case PingPacketType, FindNodePacketType, ENRRequestPacketType:
+		return true
 	}
+
+	return false
 }
 
-func (s serverImpl) handlePacket(packetBytes []byte, from *net.UDPAddr) {
+func (s *serverImpl) handlePacket(packetBytes []byte, from *net.UDPAddr) {
 	decodedPacket, err := DecodePacket(packetBytes)
 
+	if err != nil && s.config.Unhandled != nil {
+		s.passUnhandled(packetBytes, from)
+		return
+	}
+
 	if err != nil {
 		fmt.Println("Error handling packet", err)
 		return
 	}
 
+	decodedPacket = interceptInbound(s.config.Interceptors, decodedPacket, from)
+
+	if decodedPacket == nil {
+		return
+	}
+
+	err = s.checkFreshness(&decodedPacket.header, decodedPacket.data)
+
+	if err != nil {
+		fmt.Println("Dropping packet", err)
+		return
+	}
+
 	t := decodedPacket.header.packetType
 	switch t {
 	case PingPacketType:
@@ -110,19 +628,38 @@ func (s serverImpl) handlePacket(packetBytes []byte, from *net.UDPAddr) {
 			decodedPacket.data.(*PongPacketData),
 			from)
 
+	case FindNodePacketType:
+		s.handleFindNodePacket(
+			&decodedPacket.header,
+			decodedPacket.data.(*FindNodePacketData),
+			from)
 	case NeighborsPacketType:
 		s.handleNeighborsPacket(
 			&decodedPacket.header,
 			decodedPacket.data.(*NeighborsPacketData),
 			from)
+	case ENRRequestPacketType:
+		s.handleENRRequestPacket(
+			&decodedPacket.header,
+			decodedPacket.data.(*ENRRequestPacketData),
+			from)
+	case ENRResponsePacketType:
+		s.handleENRResponsePacket(
+			&decodedPacket.header,
+			decodedPacket.data.(*ENRResponsePacketData),
+			from)
 	default:
 		fmt.Println("Cannot handle packet with type", t)
 	}
 }
 
-func (s serverImpl) handlePingPacket(header *PacketHeader, data *PingPacketData, from *net.UDPAddr) {
+func (s *serverImpl) handlePingPacket(header *PacketHeader, data *PingPacketData, from *net.UDPAddr) {
 	fmt.Println("Replying to ping packet with hash", hex.EncodeToString(header.hash))
-	pongPacket, _, err := NewPongPacket(data.from, header.hash, getExpiration(),
+
+	// The pong goes to where the ping came from rather than to the endpoint
+	// the node claims, which may be a private address behind a NAT.
+	to := NewEndpoint(from.AddrPort(), data.from.tcpPort)
+	pongPacket, _, err := NewPongPacket(to, header.hash, s.expiration(),
 		enrSeqNum, s.localNode.GetPrivKeyBytes())
 
 	if err != nil {
@@ -130,15 +667,7 @@ func (s serverImpl) handlePingPacket(header *PacketHeader, data *PingPacketData,
 		return
 	}
 
-	toIp := NormalizeIp(data.from.ip)
-	toAddr, err := net.ResolveUDPAddr("udp4", toIp+":"+fmt.Sprint(data.from.udpPort))
-
-	if err != nil {
-		fmt.Println("Failed to create address for pong packet", err)
-		return
-	}
-
-	_, err = s.udpSocket.WriteToUDP(pongPacket, toAddr)
+	err = s.writer.write(context.Background(), priorityReply, pongPacket, from)
 
 	if err != nil {
 		fmt.Println("Failed to write pong packet", err)
@@ -146,87 +675,492 @@ func (s serverImpl) handlePingPacket(header *PacketHeader, data *PingPacketData,
 	}
 
 	fmt.Println("Responded to ping")
+
+	node := NewEnode(header.senderId, from, int(data.from.tcpPort))
+	s.db.UpdateNode(node)
+	s.db.UpdateLastPingReceived(node.id, s.clock.Now())
+	s.table.AddVerified(node)
+
+	// Ping back so that the node proves its endpoint to us as well.
+	if !s.isBonded(node.id) {
+		s.spawn(func() { s.Ping(s.ctx, &RemoteNode{address: from}) })
+	}
 }
 
-func (s serverImpl) handlePongPacket(header *PacketHeader, data *PongPacketData, from *net.UDPAddr) {
+func (s *serverImpl) handlePongPacket(header *PacketHeader, data *PongPacketData, from *net.UDPAddr) {
 	fmt.Println("Handling pong packet with ping hash", hex.EncodeToString(data.pingHash))
 
-	mapKey := string(data.pingHash)
-	callback := s.pingCallbacks[mapKey]
+	if !s.handleReply(header, data, from) {
+		fmt.Println("Failed to find pending ping for pong")
+		return
+	}
+
+	node := NewEnode(header.senderId, from, 0)
+
+	if s.db.Node(node.id) == nil {
+		s.db.UpdateNode(node)
+	}
+
+	s.db.UpdateLastPongReceived(node.id, s.clock.Now())
+	s.table.AddVerified(node)
+}
+
+func (s *serverImpl) isBonded(id string) bool {
+	return s.clock.Now().Sub(s.db.LastPongReceived(id)) < bondExpiration
+}
 
-	if callback == nil {
-		fmt.Println("Failed to find callback for ping")
+func (s *serverImpl) handleFindNodePacket(header *PacketHeader, data *FindNodePacketData, from *net.UDPAddr) {
+	// Answering unbonded nodes would allow amplification attacks with a
+	// spoofed source address.
+	if !s.isBonded(string(header.senderId)) {
+		fmt.Println("Ignoring find node from unbonded node")
 		return
 	}
 
-	callback(data)
-	delete(s.pingCallbacks, mapKey)
+	closest := s.table.Closest(Keccak256(data.target[:]), bucketSize)
+	nodes := []NeighborNode{}
+
+	for _, node := range closest {
+		neighbor, err := enodeToNeighbor(node)
+
+		if err == nil {
+			nodes = append(nodes, *neighbor)
+		}
+	}
+
+	// Always reply, even if there are no neighbors to tell about.
+	for {
+		n := len(nodes)
+		if n > maxNeighbors {
+			n = maxNeighbors
+		}
+
+		packet, _, err := NewNeighborsPacket(nodes[:n], s.expiration(), s.localNode.GetPrivKeyBytes())
+
+		if err != nil {
+			fmt.Println("Failed to create neighbors packet", err)
+			return
+		}
+
+		err = s.writer.write(context.Background(), priorityReply, packet, from)
+
+		if err != nil {
+			fmt.Println("Failed to write neighbors packet", err)
+			return
+		}
+
+		nodes = nodes[n:]
+
+		if len(nodes) == 0 {
+			return
+		}
+	}
 }
 
-func (s serverImpl) handleNeighborsPacket(header *PacketHeader, data *NeighborsPacketData, from *net.UDPAddr) {
+func (s *serverImpl) handleNeighborsPacket(header *PacketHeader, data *NeighborsPacketData, from *net.UDPAddr) {
 	fmt.Println("Got neighbors", len(data.nodes))
 
-	for _, node := range data.nodes {
-		s.localNode.AddNeighborNode(Enode{
-			id:      node.nodeId,
-			host:    NormalizeIp(node.ip),
-			udpPort: strconv.Itoa(int(node.udpPort)),
-			tcpPort: strconv.Itoa(int(node.tcpPort)),
-		})
+	if !s.handleReply(header, data, from) {
+		fmt.Println("Failed to find pending find node request for neighbors")
+	}
+}
+
+func (s *serverImpl) handleENRRequestPacket(header *PacketHeader, data *ENRRequestPacketData, from *net.UDPAddr) {
+	fmt.Println("Replying to ENR request with hash", hex.EncodeToString(header.hash))
+	responsePacket, _, err := NewENRResponsePacket(header.hash, s.record, s.localNode.GetPrivKeyBytes())
+
+	if err != nil {
+		fmt.Println("Failed to create ENR response", err)
+		return
+	}
+
+	err = s.writer.write(context.Background(), priorityReply, responsePacket, from)
+
+	if err != nil {
+		fmt.Println("Failed to write ENR response", err)
+	}
+}
+
+func (s *serverImpl) handleENRResponsePacket(header *PacketHeader, data *ENRResponsePacketData, from *net.UDPAddr) {
+	if !s.handleReply(header, data, from) {
+		fmt.Println("Failed to find pending ENR request for response")
+	}
+}
+
+// checkFreshness rejects packets past their expiration and replays of
+// requests that have not yet expired.
+func (s *serverImpl) checkFreshness(header *PacketHeader, data any) error {
+	now := s.clock.Now()
+	until := now.Add(packetExpiration + s.config.ClockSkew)
+	expiration, ok := expirationOf(data)
+
+	if ok {
+		until = time.Unix(int64(expiration), 0).Add(s.config.ClockSkew)
+	}
+
+	if until.Before(now) {
+		s.expiredPackets.Add(1)
+		return ErrorExpiredPacket
+	}
+
+	// Replies are only accepted for pending requests. Signatures are
+	// deterministic, so a node answering two requests within a second may
+	// legitimately send the same reply twice. The signed payload does not
+	// cover the sender, so the sender is part of the key.
+	key := append(append([]byte{}, header.senderId...), header.signedHash...)
+
+	if isRequestType(header.packetType) && s.seenPackets.add(key, now, until) {
+		s.replayedPackets.Add(1)
+		return ErrorReplayedPacket
+	}
+
+	return nil
+}
+
+func neighborToEnode(node *NeighborNode) *Enode {
+	return &Enode{
+		id:      string(node.id[:]),
+		host:    node.ip.String(),
+		udpPort: strconv.Itoa(int(node.udpPort)),
+		tcpPort: strconv.Itoa(int(node.tcpPort)),
+	}
+}
+
+// checkNeighbor validates the address of a node relayed to us by the node at
+// from.
+func (s *serverImpl) checkNeighbor(from *net.UDPAddr, node *NeighborNode) error {
+	ip := net.IP(node.ip.AsSlice())
+
+	if err := checkRelayIP(from.IP, ip); err != nil {
+		return err
+	}
+
+	if !netlistContains(s.config.NetRestrict, ip) {
+		return ErrorRestrictedIP
 	}
+
+	if !s.canReach(ip) {
+		return ErrorAddressFamily
+	}
+
+	if node.udpPort <= 1024 {
+		return ErrorLowPort
+	}
+
+	return nil
 }
 
-func (s serverImpl) WritePing(to *RemoteNode, callback func(*PongPacketData)) error {
+// canReach reports whether the socket can send to ip. Sockets bound to a
+// wildcard address are dual-stack, others only serve their own family.
+func (s *serverImpl) canReach(ip net.IP) bool {
+	local := s.transport.LocalAddr().(*net.UDPAddr).IP
+
+	if local.IsUnspecified() {
+		return true
+	}
+
+	return (local.To4() != nil) == (ip.To4() != nil)
+}
+
+func enodeToNeighbor(node *Enode) (*NeighborNode, error) {
+	ip, err := netip.ParseAddr(node.host)
+
+	if err != nil {
+		return nil, ErrorInvalidEnode
+	}
+
+	udpPort, err := strconv.ParseUint(node.udpPort, 10, 16)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tcpPort, err := strconv.ParseUint(node.tcpPort, 10, 16)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &NeighborNode{
+		ip:      ip.Unmap(),
+		udpPort: uint16(udpPort),
+		tcpPort: uint16(tcpPort),
+		id:      nodeIDFrom([]byte(node.id)),
+	}, nil
+}
+
+func sameAddress(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+func (s *serverImpl) addPending(from *net.UDPAddr, t PacketType,
+	callback func(*PacketHeader, any) (bool, bool)) *pendingReply {
+	p := &pendingReply{
+		from:       from,
+		packetType: t,
+		callback:   callback,
+		done:       make(chan error, 1),
+	}
+
+	s.mu.Lock()
+	s.pending = append(s.pending, p)
+	s.mu.Unlock()
+
+	return p
+}
+
+// failPending completes every pending request with err.
+func (s *serverImpl) failPending(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.pending {
+		p.done <- err
+	}
+
+	s.pending = nil
+}
+
+func (s *serverImpl) removePending(p *pendingReply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, other := range s.pending {
+		if other == p {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// handleReply passes a response packet to every pending request it belongs
+// to. Identical requests sent within the same second are byte for byte the
+// same packet, so a single response may complete several of them. It reports
+// whether any such request was found.
+func (s *serverImpl) handleReply(header *PacketHeader, data any, from *net.UDPAddr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := false
+	remaining := s.pending[:0]
+
+	for _, p := range s.pending {
+		if p.packetType == header.packetType && sameAddress(p.from, from) {
+			matched, done := p.callback(header, data)
+			found = found || matched
+
+			if matched && done {
+				p.done <- nil
+				continue
+			}
+		}
+
+		remaining = append(remaining, p)
+	}
+
+	s.pending = remaining
+
+	return found
+}
+
+// request writes a packet and waits until the pending reply completes, the
+// reply timeout elapses or the context is done.
+func (s *serverImpl) request(ctx context.Context, packet []byte, p *pendingReply) error {
+	err := s.writer.write(ctx, priorityRequest, packet, p.from)
+
+	if err != nil {
+		s.removePending(p)
+		return err
+	}
+
+	select {
+	case err = <-p.done:
+		return err
+	case <-s.clock.After(replyTimeout):
+		s.removePending(p)
+		return ErrorTimeout
+	case <-ctx.Done():
+		s.removePending(p)
+		return ctx.Err()
+	}
+}
+
+func (s *serverImpl) Ping(ctx context.Context, to *RemoteNode) (*PongPacketData, error) {
 	fmt.Println("Writing ping to", to.address.IP, to.address.Port)
 
 	pingPacket, hash, err := NewPingPacket(4,
-		Endpoint{
-			s.GetIP(),
-			s.GetUdpPort(),
-			s.GetTcpPort(),
-		},
-		Endpoint{
-			to.address.IP.To4().String(),
-			to.address.Port,
-			0,
-		},
-		getExpiration(),
+		NewEndpoint(netip.AddrPortFrom(netip.MustParseAddr(s.GetIP()), uint16(s.GetUdpPort())),
+			uint16(s.GetTcpPort())),
+		NewEndpoint(to.address.AddrPort(), 0),
+		s.expiration(),
 		enrSeqNum,
 		s.localNode.GetPrivKeyBytes(),
 	)
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// Signatures are deterministic, so pings to the same node within the
+	// same second are identical and the node drops all but the first as
+	// replays. Such pings therefore share one request, whose pong is kept
+	// until the packet can no longer be repeated. The request belongs to the
+	// server rather than to any caller, each of which only waits for it as
+	// long as its own context allows.
+	key := string(hash)
+	s.mu.Lock()
+	call := s.pings[key]
+
+	if call == nil {
+		call = &pingCall{done: make(chan struct{})}
+		s.pings[key] = call
+		go s.runPing(call, key, to, pingPacket, hash)
+	}
+
+	s.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.pong, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runPing sends a shared ping and completes it once answered, timed out or
+// the server is closed.
+func (s *serverImpl) runPing(call *pingCall, key string, to *RemoteNode, pingPacket, hash []byte) {
+	call.pong, call.err = s.ping(s.ctx, to, pingPacket, hash)
+
+	// The server's context is only cancelled by Close.
+	if call.err != nil && s.ctx.Err() != nil {
+		call.err = ErrorServerClosed
 	}
 
-	_, err = s.udpSocket.WriteToUDP(pingPacket, to.address)
+	close(call.done)
+
+	// A pong is kept for as long as the same ping could be sent again.
+	if call.err == nil {
+		select {
+		case <-s.clock.After(time.Second):
+		case <-s.closed:
+		}
+	}
+
+	s.mu.Lock()
+	delete(s.pings, key)
+	s.mu.Unlock()
+}
+
+func (s *serverImpl) ping(ctx context.Context, to *RemoteNode, pingPacket, hash []byte) (*PongPacketData, error) {
+	var pong *PongPacketData
+	p := s.addPending(to.address, PongPacketType, func(header *PacketHeader, data any) (bool, bool) {
+		pongData := data.(*PongPacketData)
+
+		if !bytes.Equal(pongData.pingHash, hash) {
+			return false, false
+		}
+
+		pong = pongData
+		return true, true
+	})
+
+	err := s.request(ctx, pingPacket, p)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	s.pingCallbacks[string(hash)] = callback
+	fmt.Println("Got pong for ping with hash", hex.EncodeToString(hash))
 
-	fmt.Println("Wrote ping with hash", hex.EncodeToString(hash))
+	return pong, nil
+}
 
-	return nil
+// FindNode asks a node for the neighbors closest to target. Neighbors may
+// be split over several packets, so results are collected until a full
+// bucket has been received or the reply timeout elapses.
+func (s *serverImpl) FindNode(ctx context.Context, to *RemoteNode, target []byte) ([]*Enode, error) {
+	fmt.Println("Writing find node request")
+	packet, _, err := NewFindNodePacket(nodeIDFrom(target), s.expiration(), s.localNode.GetPrivKeyBytes())
+
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []*Enode
+	replied := false
+	p := s.addPending(to.address, NeighborsPacketType, func(header *PacketHeader, data any) (bool, bool) {
+		replied = true
+
+		for _, node := range data.(*NeighborsPacketData).nodes {
+			if err := s.checkNeighbor(to.address, &node); err != nil {
+				fmt.Println("Ignoring neighbor", err)
+				continue
+			}
+
+			nodes = append(nodes, neighborToEnode(&node))
+		}
+
+		return true, len(nodes) >= bucketSize
+	})
+
+	err = s.request(ctx, packet, p)
+
+	// A node knowing fewer than a bucket's worth of neighbors, or none at
+	// all, is not an error.
+	if err == ErrorTimeout && replied {
+		err = nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
 }
 
-func (s serverImpl) FindNeighbors(to *RemoteNode) error {
-	fmt.Println("Writing find neighbors request")
-	packet, _, err := NewFindNodePacket(s.localNode.GetId(), getExpiration(), s.localNode.GetPrivKeyBytes())
+// RequestENR fetches the node record of a node. The record must carry a
+// valid signature from the same key that signed the response packet.
+func (s *serverImpl) RequestENR(ctx context.Context, to *RemoteNode) (*ENR, error) {
+	packet, hash, err := NewENRRequestPacket(s.expiration(), s.localNode.GetPrivKeyBytes())
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	numBytesWritten, err := s.udpSocket.WriteToUDP(packet, to.address)
+	var response *ENRResponsePacketData
+	var senderId []byte
+	p := s.addPending(to.address, ENRResponsePacketType, func(header *PacketHeader, data any) (bool, bool) {
+		responseData := data.(*ENRResponsePacketData)
+
+		if !bytes.Equal(responseData.requestHash, hash) {
+			return false, false
+		}
+
+		response = responseData
+		senderId = header.senderId
+		return true, true
+	})
+
+	err = s.request(ctx, packet, p)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	fmt.Println("Wrote find neighbors bytes", numBytesWritten)
+	if response.record.Verify() != nil {
+		return nil, ErrorInvalidResponse
+	}
 
-	return nil
+	recordId, err := response.record.NodeId()
+
+	if err != nil || !bytes.Equal(recordId, senderId) {
+		return nil, ErrorInvalidResponse
+	}
+
+	if err := s.db.UpdateRecord(string(recordId), response.record); err != nil {
+		fmt.Println("Failed to store node record", err)
+	}
+
+	return response.record, nil
 }
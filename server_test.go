@@ -0,0 +1,884 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T) (Server, LocalNode) {
+	return startTestServerAt(t, "127.0.0.1:0")
+}
+
+func startTestServerAt(t *testing.T, address string) (Server, LocalNode) {
+	localNode, err := NewLocalNode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(address, localNode, Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	t.Cleanup(func() { server.Close() })
+	return server, localNode
+}
+
+func remoteNodeOf(server Server) *RemoteNode {
+	return &RemoteNode{
+		address: &net.UDPAddr{IP: net.ParseIP(server.GetIP()), Port: server.GetUdpPort()},
+	}
+}
+
+func TestPing(t *testing.T) {
+	a, _ := startTestServer(t)
+	b, _ := startTestServer(t)
+
+	pong, err := a.Ping(context.Background(), remoteNodeOf(b))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pong.pingHash) != hashLength {
+		t.Error("Unexpected ping hash in pong")
+	}
+}
+
+func TestConcurrentPings(t *testing.T) {
+	a, _ := startTestServer(t)
+	b, _ := startTestServer(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, err := a.Ping(context.Background(), remoteNodeOf(b)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestPingTimeout(t *testing.T) {
+	a, _ := startTestServer(t)
+
+	// Nothing answers on this socket.
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer silent.Close()
+
+	to := &RemoteNode{address: silent.LocalAddr().(*net.UDPAddr)}
+
+	if _, err := a.Ping(context.Background(), to); err != ErrorTimeout {
+		t.Error("Expected timeout, got", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := a.Ping(ctx, to); err != context.DeadlineExceeded {
+		t.Error("Expected deadline exceeded, got", err)
+	}
+}
+
+func TestRequestENR(t *testing.T) {
+	a, _ := startTestServer(t)
+	b, bNode := startTestServer(t)
+
+	record, err := a.RequestENR(context.Background(), remoteNodeOf(b))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := record.NodeId()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(id, bNode.GetId()) {
+		t.Error("Unexpected node id in ENR")
+	}
+
+	if record.UdpPort() != b.GetUdpPort() {
+		t.Error("Unexpected udp port in ENR")
+	}
+}
+
+func waitForStats(server Server, check func(ServerStats) bool) bool {
+	for i := 0; i < 100; i++ {
+		if check(server.Stats()) {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
+
+// testExpiration is the expiration of packets sent now by the system clock.
+func testExpiration() uint64 { return uint64(time.Now().Add(packetExpiration).Unix()) }
+
+func writeTestPing(t *testing.T, socket net.PacketConn, to Server, expiration uint64) {
+	localNode, _ := NewLocalNode()
+	packet, _, err := NewPingPacket(4,
+		NewEndpoint(socket.LocalAddr().(*net.UDPAddr).AddrPort(), 0),
+		NewEndpoint(remoteNodeOf(to).address.AddrPort(), 0),
+		expiration, enrSeqNum, localNode.GetPrivKeyBytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := socket.WriteTo(packet, remoteNodeOf(to).address); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExpiredAndReplayedPackets(t *testing.T) {
+	server, _ := startTestServer(t)
+	socket, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer socket.Close()
+
+	writeTestPing(t, socket, server, uint64(time.Now().Add(-time.Minute).Unix()))
+
+	if !waitForStats(server, func(stats ServerStats) bool { return stats.ExpiredPackets == 2 }) {
+		t.Error("Expected expired pings to be dropped", server.Stats())
+	}
+
+	writeTestPing(t, socket, server, testExpiration())
+
+	if !waitForStats(server, func(stats ServerStats) bool { return stats.ReplayedPackets == 1 }) {
+		t.Error("Expected replayed ping to be dropped", server.Stats())
+	}
+}
+
+func TestMalleatedReplay(t *testing.T) {
+	server, _ := startTestServer(t)
+	socket, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer socket.Close()
+
+	localNode, _ := NewLocalNode()
+	packet, _, err := NewPingPacket(4,
+		NewEndpoint(socket.LocalAddr().(*net.UDPAddr).AddrPort(), 0),
+		NewEndpoint(remoteNodeOf(server).address.AddrPort(), 0),
+		testExpiration(), enrSeqNum, localNode.GetPrivKeyBytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip s to n-s and the recovery id, which still verifies.
+	malleated := append([]byte{}, packet...)
+	sig := malleated[hashLength : hashLength+signatureLength]
+	order, _ := new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", 16)
+	new(big.Int).Sub(order, new(big.Int).SetBytes(sig[32:64])).FillBytes(sig[32:64])
+	sig[64] ^= 1
+	copy(malleated, Keccak256(malleated[hashLength:]))
+
+	if _, err := RecoverPubkey(Keccak256(malleated[headerSize-1:]), sig); err != nil {
+		t.Skip("Signature backend rejects high-S signatures")
+	}
+
+	for _, data := range [][]byte{packet, malleated} {
+		if _, err := socket.WriteTo(data, remoteNodeOf(server).address); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !waitForStats(server, func(stats ServerStats) bool { return stats.ReplayedPackets == 1 }) {
+		t.Error("Expected malleated ping to be dropped as a replay", server.Stats())
+	}
+}
+
+func TestPacketHashCacheUntilExpiry(t *testing.T) {
+	cache := newPacketHashCache(2)
+	now := time.Now()
+
+	if cache.add([]byte("far"), now, now.Add(time.Hour)) {
+		t.Fatal("Expected new hash to be unseen")
+	}
+
+	cache.add([]byte("near"), now, now.Add(time.Second))
+
+	if !cache.add([]byte("far"), now.Add(time.Minute), now.Add(time.Hour)) {
+		t.Error("Expected hash to be remembered until its packet expires")
+	}
+
+	cache.add([]byte("other"), now.Add(time.Minute), now.Add(time.Hour))
+
+	if !cache.add([]byte("far"), now.Add(time.Minute), now.Add(time.Hour)) {
+		t.Error("Expected the soonest expiring hash to be evicted first")
+	}
+}
+
+func TestExpirationByClock(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	clock := NewManualClock(time.Now().Add(time.Hour))
+	server, err := NewServer("127.0.0.1:0", localNode, Config{Clock: clock})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	defer server.Close()
+
+	socket, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer socket.Close()
+
+	// By the server's clock these pings expired an hour ago.
+	writeTestPing(t, socket, server, testExpiration())
+
+	if !waitForStats(server, func(stats ServerStats) bool { return stats.ExpiredPackets == 2 }) {
+		t.Error("Expected pings to expire by the server's clock", server.Stats())
+	}
+}
+
+// listenPeer opens a socket acting as a peer of a server under test, with
+// the key it signs its packets with.
+func listenPeer(t *testing.T) (net.PacketConn, LocalNode) {
+	socket, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { socket.Close() })
+
+	peerNode, err := NewLocalNode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return socket, peerNode
+}
+
+// readRequest reads a packet from a peer socket within a second.
+func readRequest(t *testing.T, socket net.PacketConn) (*Packet[any], net.Addr) {
+	buf := make([]byte, maxDatagramSize)
+	socket.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := socket.ReadFrom(buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, err := DecodePacket(buf[:n])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return packet, from
+}
+
+func TestRepeatedReply(t *testing.T) {
+	localNode, _ := NewLocalNode()
+
+	// The clock stands still, so both requests are the same packet and so
+	// are the responses to them.
+	server, err := NewServer("127.0.0.1:0", localNode, Config{Clock: NewManualClock(time.Now())})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	defer server.Close()
+
+	socket, peerNode := listenPeer(t)
+	record, err := NewENR(1, map[string]any{
+		enrKeyIp:  ipBytes(netip.MustParseAddr("127.0.0.1")),
+		enrKeyUdp: socket.LocalAddr().(*net.UDPAddr).Port,
+	}, peerNode.GetPrivKeyBytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		done := make(chan error, 1)
+		go func() {
+			_, err := server.RequestENR(ctx, &RemoteNode{address: socket.LocalAddr().(*net.UDPAddr)})
+			done <- err
+		}()
+
+		request, from := readRequest(t, socket)
+		response, _, err := NewENRResponsePacket(request.header.hash, record, peerNode.GetPrivKeyBytes())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := socket.WriteTo(response, from); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := <-done; err != nil {
+			t.Fatal("Expected response to be accepted", i, err)
+		}
+	}
+
+	if stats := server.Stats(); stats.ReplayedPackets != 0 {
+		t.Error("Expected repeated response not to be replayed", stats)
+	}
+}
+
+func TestRepeatedPing(t *testing.T) {
+	server, _ := startTestServer(t)
+	target, _ := startTestServer(t)
+
+	// Both pings are usually the same packet, which target must not see
+	// twice.
+	for i := 0; i < 2; i++ {
+		if _, err := server.Ping(context.Background(), remoteNodeOf(target)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stats := target.Stats(); stats.ReplayedPackets != 0 {
+		t.Error("Expected repeated ping not to be replayed", stats)
+	}
+}
+
+func TestSharedPing(t *testing.T) {
+	localNode, _ := NewLocalNode()
+
+	// The clock stands still, so every ping to the peer is the same packet.
+	clock := NewManualClock(time.Now())
+	server, err := NewServer("127.0.0.1:0", localNode, Config{Clock: clock})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	defer server.Close()
+
+	socket, peerNode := listenPeer(t)
+	to := &RemoteNode{address: socket.LocalAddr().(*net.UDPAddr)}
+
+	results := make(chan error, 2)
+	ping := func() {
+		_, err := server.Ping(context.Background(), to)
+		results <- err
+	}
+
+	// The second ping shares the pong of the first, whether it arrives
+	// before or after the pong does.
+	go ping()
+	request, from := readRequest(t, socket)
+	go ping()
+
+	pong, _, err := NewPongPacket(NewEndpoint(from.(*net.UDPAddr).AddrPort(), 0), request.header.hash,
+		testExpiration(), enrSeqNum, peerNode.GetPrivKeyBytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := socket.WriteTo(pong, from); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	socket.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+
+	if _, _, err := socket.ReadFrom(make([]byte, maxDatagramSize)); err == nil {
+		t.Error("Expected a single ping to reach the peer")
+	}
+
+	// The pong is forgotten once the server's clock moves on.
+	impl := server.(*serverImpl)
+	deadline := time.Now().Add(time.Second)
+
+	for time.Now().Before(deadline) {
+		clock.Advance(time.Second)
+		impl.mu.Lock()
+		pings := len(impl.pings)
+		impl.mu.Unlock()
+
+		if pings == 0 {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Error("Expected the shared ping to be forgotten")
+}
+
+func TestSharedPingContext(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	server, err := NewServer("127.0.0.1:0", localNode, Config{Clock: NewManualClock(time.Now())})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	defer server.Close()
+
+	socket, peerNode := listenPeer(t)
+	to := &RemoteNode{address: socket.LocalAddr().(*net.UDPAddr)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := server.Ping(ctx, to)
+		cancelled <- err
+	}()
+
+	request, from := readRequest(t, socket)
+
+	results := make(chan error, 1)
+	go func() {
+		_, err := server.Ping(context.Background(), to)
+		results <- err
+	}()
+
+	// Giving up on the first ping leaves the shared request running for the
+	// second one.
+	cancel()
+
+	if err := <-cancelled; err != context.Canceled {
+		t.Error("Expected first ping to be cancelled", err)
+	}
+
+	pong, _, err := NewPongPacket(NewEndpoint(from.(*net.UDPAddr).AddrPort(), 0), request.header.hash,
+		testExpiration(), enrSeqNum, peerNode.GetPrivKeyBytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := socket.WriteTo(pong, from); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-results; err != nil {
+		t.Error("Expected second ping to get the pong", err)
+	}
+
+	socket.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+
+	if _, _, err := socket.ReadFrom(make([]byte, maxDatagramSize)); err == nil {
+		t.Error("Expected a single ping to reach the peer")
+	}
+}
+
+func TestEmptyNeighbors(t *testing.T) {
+	server, _ := startTestServer(t)
+	socket, peerNode := listenPeer(t)
+
+	var nodes []*Enode
+	done := make(chan error, 1)
+
+	go func() {
+		var err error
+		nodes, err = server.FindNode(context.Background(), &RemoteNode{address: socket.LocalAddr().(*net.UDPAddr)},
+			peerNode.GetId())
+		done <- err
+	}()
+
+	_, from := readRequest(t, socket)
+
+	// A node without neighbors answers with an empty packet, which is not a
+	// timeout.
+	neighbors, _, err := NewNeighborsPacket([]NeighborNode{}, testExpiration(), peerNode.GetPrivKeyBytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := socket.WriteTo(neighbors, from); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil || len(nodes) != 0 {
+		t.Error("Expected an empty result", nodes, err)
+	}
+}
+
+func TestRequestRateLimit(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	clock := NewManualClock(time.Now())
+	server, err := NewServer("127.0.0.1:0", localNode, Config{Clock: clock, RequestRate: 1, RequestBurst: 3})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	defer server.Close()
+
+	socket, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer socket.Close()
+
+	// Three pairs of pings, of which only the first three packets fit in
+	// the burst while the clock stands still.
+	for i := 0; i < 3; i++ {
+		writeTestPing(t, socket, server, testExpiration()+uint64(i))
+	}
+
+	if !waitForStats(server, func(stats ServerStats) bool { return stats.RateLimitedPackets == 3 }) {
+		t.Error("Expected pings over the burst to be dropped", server.Stats())
+	}
+
+	clock.Advance(time.Second)
+	writeTestPing(t, socket, server, testExpiration()+3)
+
+	if !waitForStats(server, func(stats ServerStats) bool { return stats.RateLimitedPackets == 4 }) {
+		t.Error("Expected one ping after refill", server.Stats())
+	}
+}
+
+func TestReplyRateLimit(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	clock := NewManualClock(time.Now())
+	server, err := NewServer("127.0.0.1:0", localNode, Config{Clock: clock, ReplyRate: 1, ReplyBurst: 2})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	defer server.Close()
+
+	socket, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer socket.Close()
+
+	// Unsolicited pongs are not requests, but still count against the
+	// reply budget of their source.
+	for i := 0; i < 5; i++ {
+		packet, _, err := NewPongPacket(NewEndpoint(remoteNodeOf(server).address.AddrPort(), 0),
+			make([]byte, hashLength), testExpiration()+uint64(i), enrSeqNum, localNode.GetPrivKeyBytes())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := socket.WriteTo(packet, remoteNodeOf(server).address); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !waitForStats(server, func(stats ServerStats) bool { return stats.RateLimitedPackets == 3 }) {
+		t.Error("Expected pongs over the burst to be dropped", server.Stats())
+	}
+}
+
+func TestNegativeQueueSizes(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	server, err := NewServer("127.0.0.1:0", localNode, Config{
+		Workers:        -1,
+		QueueSize:      -1,
+		WriteQueueSize: -1,
+		RequestRate:    -1,
+		RequestBurst:   -1,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	defer server.Close()
+
+	other, _ := startTestServer(t)
+
+	if _, err := other.Ping(context.Background(), remoteNodeOf(server)); err != nil {
+		t.Error("Expected the defaults to replace negative sizes", err)
+	}
+}
+
+// localTestRecord returns the local record for uaddr as a peer decodes it.
+func localTestRecord(t *testing.T, uaddr *net.UDPAddr, tcpPort int) *ENR {
+	localNode, _ := NewLocalNode()
+	_, record, err := localRecord(localNode, uaddr, nil, tcpPort)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := record.ToRLP()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err = DecodeENR(encoded)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return record
+}
+
+func TestDualStackRecord(t *testing.T) {
+	record := localTestRecord(t, &net.UDPAddr{IP: net.IPv6unspecified, Port: 30303}, 30304)
+
+	if !record.IP().Equal(net.IPv4(127, 0, 0, 1)) || record.UdpPort() != 30303 || record.TcpPort() != 30304 {
+		t.Error("Expected IPv4 endpoint in dual-stack record")
+	}
+
+	if !record.IP6().Equal(net.IPv6loopback) || record.Udp6Port() != 30303 || record.Tcp6Port() != 30304 {
+		t.Error("Expected IPv6 endpoint in dual-stack record")
+	}
+
+	record = localTestRecord(t, &net.UDPAddr{IP: net.IPv4zero, Port: 30303}, 0)
+
+	if record.IP6() != nil || record.TcpPort() != 0 {
+		t.Error("Expected only an IPv4 endpoint without TCP port")
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	if socket, err := net.ListenPacket("udp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 loopback not available", err)
+	} else {
+		socket.Close()
+	}
+
+	a, _ := startTestServerAt(t, "[::1]:0")
+	b, _ := startTestServerAt(t, "[::1]:0")
+	c, cNode := startTestServerAt(t, "[::1]:0")
+
+	record, err := a.RequestENR(context.Background(), remoteNodeOf(b))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !record.IP6().Equal(net.ParseIP("::1")) || record.Udp6Port() != b.GetUdpPort() || record.IP() != nil {
+		t.Error("Expected IPv6 endpoint in record")
+	}
+
+	// B learns about C, and A and B bond.
+	if _, err := b.Ping(context.Background(), remoteNodeOf(c)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Ping(context.Background(), remoteNodeOf(b)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		nodes, err := a.FindNode(context.Background(), remoteNodeOf(b), cNode.GetId())
+
+		if err == ErrorTimeout {
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, node := range nodes {
+			if node.id == string(cNode.GetId()) && node.host == "::1" {
+				return
+			}
+		}
+	}
+
+	t.Error("Expected IPv6 neighbor")
+}
+
+func TestAddressFamily(t *testing.T) {
+	server, _ := startTestServer(t)
+	impl := server.(*serverImpl)
+	neighbor := &NeighborNode{netip.MustParseAddr("::1"), 30303, 30303, NodeID{}}
+
+	if err := impl.checkNeighbor(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, neighbor); err != ErrorAddressFamily {
+		t.Error("Expected IPv6 neighbor to be unreachable from IPv4 socket", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	db, err := OpenNodeDB(path, systemClock{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer("127.0.0.1:0", localNode, Config{NodeDB: db})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server.Start(ctx)
+	db.UpdateNode(testNodes("a")[0])
+
+	// Nothing answers on this socket, so the ping stays pending until the
+	// server is closed.
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer silent.Close()
+
+	pinged := make(chan error)
+	go func() {
+		_, err := server.Ping(context.Background(),
+			&RemoteNode{address: silent.LocalAddr().(*net.UDPAddr)})
+		pinged <- err
+	}()
+
+	if _, _, err := silent.ReadFrom(make([]byte, maxDatagramSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	if err := <-pinged; err != ErrorServerClosed {
+		t.Error("Expected pending ping to fail with server closed", err)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Error("Expected node database to be flushed", err)
+	}
+
+	if _, err := server.Ping(context.Background(), remoteNodeOf(server)); err != ErrorServerClosed {
+		t.Error("Expected ping after close to fail", err)
+	}
+}
+
+func TestFindNode(t *testing.T) {
+	a, aNode := startTestServer(t)
+	b, _ := startTestServer(t)
+	c, cNode := startTestServer(t)
+
+	// B learns about C, and A and B bond by pinging each other.
+	if _, err := b.Ping(context.Background(), remoteNodeOf(c)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Ping(context.Background(), remoteNodeOf(b)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		nodes, err := a.FindNode(context.Background(), remoteNodeOf(b), aNode.GetId())
+
+		// B only answers once its ping back to A has been answered.
+		if err == ErrorTimeout {
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, node := range nodes {
+			if node.id == string(cNode.GetId()) {
+				return
+			}
+		}
+	}
+
+	t.Error("Expected C in neighbors of B")
+}
+
+func TestFindNodeWithoutBond(t *testing.T) {
+	a, aNode := startTestServer(t)
+	b, _ := startTestServer(t)
+
+	if _, err := a.FindNode(context.Background(), remoteNodeOf(b), aNode.GetId()); err != ErrorTimeout {
+		t.Error("Expected unbonded find node to be ignored, got", err)
+	}
+}
+
+func TestExternalIP(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	server, err := NewServer("0.0.0.0:0", localNode, Config{ExternalIP: net.ParseIP("203.0.113.7")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	record, err := ParseENRURL(server.(*serverImpl).record.URL())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server.GetIP() != "203.0.113.7" || !record.IP().Equal(net.ParseIP("203.0.113.7")) {
+		t.Error("Expected external IP to be advertised", server.GetIP(), record.IP())
+	}
+
+	if record.UdpPort() != server.GetUdpPort() {
+		t.Error("Expected record to carry the listening port", record.UdpPort())
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Errors
+var (
+	ErrorInvalidDiscovery = errors.New("Discovery must be v4, v5 or v4,v5")
+)
+
+// UnhandledPacket is a datagram the discv4 server could not decode, see
+// Config.Unhandled.
+type UnhandledPacket struct {
+	Data []byte
+	From *net.UDPAddr
+}
+
+// ParseDiscovery parses a comma separated list of discovery versions.
+func ParseDiscovery(versions string) (v4, v5 bool, err error) {
+	for _, version := range strings.Split(versions, ",") {
+		switch strings.TrimSpace(version) {
+		case "v4":
+			v4 = true
+		case "v5":
+			v5 = true
+		default:
+			return false, false, ErrorInvalidDiscovery
+		}
+	}
+
+	return v4, v5, nil
+}
+
+// NewSharedServers creates a discv4 and a discv5 server on the same socket.
+// The discv4 server reads the socket and passes the datagrams it cannot
+// decode on to the discv5 server. Both advertise the same record.
+//
+// The discv5 server writes through the discv4 server's writer, so that both
+// share one egress budget, and both directions of its traffic are recorded by
+// config.Capture. Closing the discv4 server closes the socket.
+func NewSharedServers(localAddress string, localNode LocalNode, config Config) (Server, V5Server, error) {
+	socket, err := net.ListenPacket("udp", localAddress)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config, err = config.withDefaults()
+
+	if err != nil {
+		socket.Close()
+		return nil, nil, err
+	}
+
+	unhandled := make(chan UnhandledPacket, config.QueueSize)
+
+	v4Config := config
+	v4Config.Unhandled = unhandled
+	v4, err := NewServerWithTransport(socket, localNode, v4Config)
+
+	if err != nil {
+		socket.Close()
+		return nil, nil, err
+	}
+
+	v4Impl := v4.(*serverImpl)
+
+	// The discv5 server still orders its replies before its requests, but
+	// leaves pacing to the shared writer.
+	v5Config := config
+	v5Config.Capture = nil
+	v5Config.EgressPacketRate = -1
+	v5Config.EgressByteRate = -1
+	v5, err := NewV5ServerWithTransport(newSharedTransport(v4Impl, unhandled), localNode, v5Config)
+
+	if err != nil {
+		v4.Close()
+		return nil, nil, err
+	}
+
+	v5.(*v5ServerImpl).record = v4Impl.record
+	return v4, v5, nil
+}
+
+// sharedTransport reads the datagrams the discv4 server passes on and writes
+// through its writer to the socket they share. Closing it leaves the socket
+// open.
+type sharedTransport struct {
+	server  *serverImpl
+	packets <-chan UnhandledPacket
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func newSharedTransport(server *serverImpl, packets <-chan UnhandledPacket) *sharedTransport {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &sharedTransport{server: server, packets: packets, ctx: ctx, cancel: cancel}
+}
+
+func (t *sharedTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-t.packets:
+		return copy(b, packet.Data), packet.From, nil
+	case <-t.ctx.Done():
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// WriteTo queues the datagram with the discv4 server's replies. The discv5
+// writer uses writeWithPriority instead, so that its requests wait behind
+// the replies of both servers.
+func (t *sharedTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	to, ok := addr.(*net.UDPAddr)
+
+	if !ok {
+		return 0, ErrorUnsupportedAddress
+	}
+
+	if err := t.writeWithPriority(priorityReply, b, to); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// writeWithPriority queues the datagram on the discv4 server's writer. The
+// discv5 server writes one packet at a time, so it never holds more than one
+// place in its queues.
+func (t *sharedTransport) writeWithPriority(priority writePriority, data []byte, to *net.UDPAddr) error {
+	if t.ctx.Err() != nil {
+		return net.ErrClosed
+	}
+
+	return t.server.writer.writeOther(t.ctx, priority, data, to)
+}
+
+func (t *sharedTransport) LocalAddr() net.Addr { return t.server.transport.LocalAddr() }
+
+func (t *sharedTransport) Close() error {
+	t.cancel()
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseDiscovery(t *testing.T) {
+	tests := []struct {
+		versions string
+		v4, v5   bool
+		err      error
+	}{
+		{"v4", true, false, nil},
+		{"v5", false, true, nil},
+		{"v4,v5", true, true, nil},
+		{"v5, v4", true, true, nil},
+		{"", false, false, ErrorInvalidDiscovery},
+		{"v4,v6", false, false, ErrorInvalidDiscovery},
+	}
+
+	for _, test := range tests {
+		v4, v5, err := ParseDiscovery(test.versions)
+
+		if v4 != test.v4 || v5 != test.v5 || err != test.err {
+			t.Error("Unexpected result for", test.versions, v4, v5, err)
+		}
+	}
+}
+
+func TestSharedServers(t *testing.T) {
+	localNode, err := NewLocalNode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, v5Server, err := NewSharedServers("127.0.0.1:0", localNode, Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	v5Server.Start(context.Background())
+	t.Cleanup(func() { shutdown(v5Server, server) })
+
+	if server.GetUdpPort() != v5Server.GetUdpPort() || server.(*serverImpl).record != v5Server.Self() {
+		t.Fatal("Expected both servers to share the socket and record")
+	}
+
+	// Both protocols are answered on the same port.
+	v4Client, _ := startTestServer(t)
+
+	if _, err := v4Client.Ping(context.Background(), remoteNodeOf(server)); err != nil {
+		t.Error("Expected discv4 ping to be answered", err)
+	}
+
+	v5Client, _ := startV5TestServer(t)
+	address := &net.UDPAddr{IP: net.ParseIP(server.GetIP()), Port: server.GetUdpPort()}
+
+	if _, err := v5Client.Ping(context.Background(), NewEnode(localNode.GetId(), address, 0)); err != nil {
+		t.Error("Expected discv5 ping to be answered", err)
+	}
+
+	// Geth's discv5 accepts the shared record.
+	geth, _ := startGethV5(t)
+
+	if err := geth.Ping(legionV5Node(t, v5Server)); err != nil {
+		t.Error("Expected geth to ping the shared socket", err)
+	}
+}
+
+func TestSharedRateLimit(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	unhandled := make(chan UnhandledPacket, 10)
+	server, err := NewServer("127.0.0.1:0", localNode, Config{RequestRate: 0.001, RequestBurst: 1, Unhandled: unhandled})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	defer server.Close()
+
+	socket, _ := listenPeer(t)
+
+	// Datagrams of another protocol may happen to carry a request type where
+	// discv4 has it, but are not discv4's to rate limit.
+	datagram := make([]byte, 100)
+	datagram[headerSize-1] = byte(PingPacketType)
+
+	for i := 0; i < 5; i++ {
+		if _, err := socket.WriteTo(datagram, remoteNodeOf(server).address); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		select {
+		case <-unhandled:
+		case <-time.After(time.Second):
+			t.Fatal("Expected every datagram to be passed on", i, server.Stats())
+		}
+	}
+
+	if stats := server.Stats(); stats.RateLimitedPackets != 0 {
+		t.Error("Expected no datagram to be rate limited", stats)
+	}
+}
+
+func TestSharedNetRestrict(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	unhandled := make(chan UnhandledPacket, 10)
+	server, err := NewServer("127.0.0.1:0", localNode, Config{
+		NetRestrict: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+		Unhandled:   unhandled,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	defer server.Close()
+
+	socket, _ := listenPeer(t)
+
+	if _, err := socket.WriteTo(make([]byte, 100), remoteNodeOf(server).address); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case packet := <-unhandled:
+		t.Error("Expected datagram from a restricted address to be dropped", packet.From)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSharedWritePriority(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	server, err := NewServer("127.0.0.1:0", localNode, Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	// The discv4 writer is not running, so the packet stays in its queue.
+	impl := server.(*serverImpl)
+	writer := newPacketWriter(newSharedTransport(impl, nil), 1, -1, -1, nil)
+	go writer.loop()
+	defer writer.close()
+
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	go writer.write(context.Background(), priorityRequest, []byte("request"), to)
+
+	deadline := time.Now().Add(time.Second)
+	for len(impl.writer.requests) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(impl.writer.requests) != 1 || len(impl.writer.replies) != 0 {
+		t.Error("Expected the request to be queued as a request")
+	}
+}
+
+func TestSharedEgress(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	server, err := NewServer("127.0.0.1:0", localNode, Config{EgressPacketRate: 10})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	defer server.Close()
+
+	socket, _ := listenPeer(t)
+	transport := newSharedTransport(server.(*serverImpl), nil)
+	defer transport.Close()
+
+	// At ten packets per second the second packet waits for the first one's
+	// share of the budget.
+	start := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if _, err := transport.WriteTo([]byte{byte(i)}, socket.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Error("Expected writes to be paced by the shared writer", elapsed)
+	}
+
+	for i := 0; i < 2; i++ {
+		socket.SetReadDeadline(time.Now().Add(time.Second))
+
+		if _, _, err := socket.ReadFrom(make([]byte, maxDatagramSize)); err != nil {
+			t.Error("Expected written datagram", i, err)
+		}
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"errors"
+	mrand "math/rand"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Packets waiting to be read by a simulated host, like a socket buffer.
+	// Further packets are dropped.
+	simInboxSize = 256
+
+	// First public port handed out by a simulated NAT.
+	simNATFirstPort = 40000
+
+	// Real time without a packet being sent or the clock advancing after
+	// which Settle assumes that the servers' own goroutines are done too.
+	simSettleQuiet = 3 * time.Millisecond
+)
+
+// Errors
+var (
+	ErrorAddressInUse = errors.New("Address in use")
+	ErrorNATExhausted = errors.New("No free NAT ports")
+)
+
+// SimConfig describes the links of a simulated network.
+type SimConfig struct {
+	// Latency is the one way delay of every packet.
+	Latency time.Duration
+
+	// Jitter adds a random delay of up to Jitter to every packet, so that
+	// packets sent close together may arrive out of order.
+	Jitter time.Duration
+
+	// LossRate is the probability that a packet is dropped.
+	LossRate float64
+
+	// Seed drives loss and jitter, so that a simulation sending the same
+	// packets in the same order sees the same network behaviour.
+	Seed int64
+
+	// Clock schedules deliveries. Packets are delivered in order of their
+	// delivery time and, at the same time, in the order they were sent. With
+	// a ManualClock nothing is delivered until Advance is called, which
+	// makes delivery independent of goroutine scheduling. Defaults to the
+	// system clock.
+	Clock Clock
+}
+
+// simDelivery is a packet in flight. seq orders packets due at the same
+// time.
+type simDelivery struct {
+	at     time.Time
+	seq    uint64
+	dst    *SimTransport
+	packet simPacket
+}
+
+// SimNetwork is an in-memory network for running many servers in one
+// process. Hosts either have a public address or sit behind a SimNAT.
+type SimNetwork struct {
+	mu      sync.Mutex
+	config  SimConfig
+	manual  *ManualClock
+	rand    *mrand.Rand
+	hosts   map[netip.AddrPort]*SimTransport
+	nats    map[netip.Addr]*SimNAT
+	pending []simDelivery
+	seq     uint64
+
+	// inFlight counts the packets delivered to an inbox and not yet handled
+	// by the server reading it. settled is signalled when it drops to zero.
+	// lastActive is the real time of the last packet sent or of the last
+	// Advance, either of which may wake goroutines of the servers.
+	inFlight   int
+	settled    *sync.Cond
+	lastActive time.Time
+
+	wake      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSimNetwork creates a network. Unless it runs on a ManualClock, it
+// delivers packets from a goroutine of its own until closed.
+func NewSimNetwork(config SimConfig) *SimNetwork {
+	if config.Clock == nil {
+		config.Clock = systemClock{}
+	}
+
+	manual, _ := config.Clock.(*ManualClock)
+
+	n := &SimNetwork{
+		config: config,
+		manual: manual,
+		rand:   mrand.New(mrand.NewSource(config.Seed)),
+		hosts:  make(map[netip.AddrPort]*SimTransport),
+		nats:   make(map[netip.Addr]*SimNAT),
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+
+	n.settled = sync.NewCond(&n.mu)
+
+	if manual == nil {
+		go n.dispatchLoop()
+	}
+
+	return n
+}
+
+// Close drops the packets in flight and stops their delivery.
+func (n *SimNetwork) Close() {
+	n.closeOnce.Do(func() { close(n.closed) })
+}
+
+// Listen returns a transport for a host with a public address.
+func (n *SimNetwork) Listen(addr netip.AddrPort) (*SimTransport, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.hosts[addr] != nil || n.nats[addr.Addr()] != nil {
+		return nil, ErrorAddressInUse
+	}
+
+	t := newSimTransport(n, nil, addr)
+	n.hosts[addr] = t
+	return t, nil
+}
+
+// AddNAT adds a gateway with the given public IP. Hosts behind it get a
+// public port when they first send a packet, and keep it for every
+// destination. A full cone NAT then lets in packets from anywhere; a
+// restricted one only from addresses the host has sent to.
+func (n *SimNetwork) AddNAT(public netip.Addr, restricted bool) *SimNAT {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	nat := &SimNAT{
+		network:    n,
+		public:     public,
+		restricted: restricted,
+		nextPort:   simNATFirstPort,
+		hosts:      make(map[netip.AddrPort]*SimTransport),
+		mappings:   make(map[*SimTransport]uint16),
+		ports:      make(map[uint16]*simMapping),
+	}
+
+	n.nats[public] = nat
+	return nat
+}
+
+// send routes a packet and schedules its delivery.
+func (n *SimNetwork) send(from *SimTransport, data []byte, to netip.AddrPort) error {
+	n.mu.Lock()
+
+	src := from.addr
+	if from.nat != nil {
+		var err error
+		src, err = from.nat.outbound(from, to)
+
+		if err != nil {
+			n.mu.Unlock()
+			return err
+		}
+	}
+
+	var dst *SimTransport
+	if nat := n.nats[to.Addr()]; nat != nil {
+		dst = nat.inbound(src, to.Port())
+	} else {
+		dst = n.hosts[to]
+	}
+
+	n.lastActive = time.Now()
+	lost := n.config.LossRate > 0 && n.rand.Float64() < n.config.LossRate
+	delay := n.config.Latency
+
+	if n.config.Jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(n.config.Jitter)))
+	}
+
+	// Like UDP, undeliverable packets vanish without an error.
+	if dst != nil && !lost {
+		n.schedule(simDelivery{n.config.Clock.Now().Add(delay), n.seq, dst, simPacket{data, src}})
+		n.seq++
+	}
+
+	n.mu.Unlock()
+	return nil
+}
+
+// schedule queues a delivery in delivery order. It is called with the
+// network lock held.
+func (n *SimNetwork) schedule(d simDelivery) {
+	i := sort.Search(len(n.pending), func(i int) bool {
+		return n.pending[i].at.After(d.at)
+	})
+
+	n.pending = append(n.pending, simDelivery{})
+	copy(n.pending[i+1:], n.pending[i:])
+	n.pending[i] = d
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next removes and returns the first delivery if it is due by end.
+func (n *SimNetwork) next(end time.Time) (simDelivery, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.pending) == 0 || n.pending[0].at.After(end) {
+		return simDelivery{}, false
+	}
+
+	d := n.pending[0]
+	n.pending = n.pending[1:]
+	return d, true
+}
+
+// Advance moves a network on a ManualClock forward by d. Packets due by then
+// are delivered in order, and the clock is advanced to each delivery time
+// first, so that timers fire in between as they would in real time. It does
+// nothing on other clocks.
+func (n *SimNetwork) Advance(d time.Duration) {
+	if n.manual == nil {
+		return
+	}
+
+	end := n.manual.Now().Add(d)
+
+	for {
+		delivery, ok := n.next(end)
+
+		if !ok {
+			break
+		}
+
+		if wait := delivery.at.Sub(n.manual.Now()); wait > 0 {
+			n.manual.Advance(wait)
+		}
+
+		delivery.dst.deliver(delivery.packet)
+	}
+
+	if rest := end.Sub(n.manual.Now()); rest > 0 {
+		n.manual.Advance(rest)
+	}
+
+	n.mu.Lock()
+	n.lastActive = time.Now()
+	n.mu.Unlock()
+}
+
+// Settle waits until the servers of the network have handled every packet
+// delivered so far, and then until nothing has been sent and the clock has
+// not advanced for a moment.
+// Servers acknowledge each packet they read from a SimTransport once they
+// have handled or dropped it, so Settle must only be used when every host is
+// read by a server. Handling a packet may wake goroutines that send later,
+// such as a lookup receiving a reply or a timer firing, which only the
+// quiet period covers.
+// Packets sent in the meantime stay pending; on a ManualClock, the next
+// Advance delivers them.
+func (n *SimNetwork) Settle() {
+	for {
+		n.mu.Lock()
+		for n.inFlight > 0 {
+			n.settled.Wait()
+		}
+
+		quiet := time.Since(n.lastActive)
+		n.mu.Unlock()
+
+		if quiet >= simSettleQuiet {
+			return
+		}
+
+		time.Sleep(simSettleQuiet - quiet)
+	}
+}
+
+// InFlight returns the number of packets delivered to an inbox that have not
+// been handled yet.
+func (n *SimNetwork) InFlight() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.inFlight
+}
+
+// handled acknowledges count delivered packets.
+func (n *SimNetwork) handled(count int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.inFlight -= count
+
+	if n.inFlight == 0 {
+		n.settled.Broadcast()
+	}
+}
+
+// dispatchLoop delivers packets as they become due on a real clock.
+func (n *SimNetwork) dispatchLoop() {
+	for {
+		now := n.config.Clock.Now()
+
+		for {
+			delivery, ok := n.next(now)
+
+			if !ok {
+				break
+			}
+
+			delivery.dst.deliver(delivery.packet)
+		}
+
+		var timer <-chan time.Time
+
+		n.mu.Lock()
+		if len(n.pending) > 0 {
+			timer = n.config.Clock.After(n.pending[0].at.Sub(now))
+		}
+		n.mu.Unlock()
+
+		select {
+		case <-timer:
+		case <-n.wake:
+		case <-n.closed:
+			return
+		}
+	}
+}
+
+func (n *SimNetwork) remove(t *SimTransport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if t.nat != nil {
+		t.nat.remove(t)
+	} else if n.hosts[t.addr] == t {
+		delete(n.hosts, t.addr)
+	}
+}
+
+type simMapping struct {
+	host      *SimTransport
+	contacted map[netip.AddrPort]bool
+}
+
+// SimNAT is a gateway between private hosts and a SimNetwork. It is only
+// used with the network lock held.
+type SimNAT struct {
+	network    *SimNetwork
+	public     netip.Addr
+	restricted bool
+	nextPort   uint16
+	hosts      map[netip.AddrPort]*SimTransport
+	mappings   map[*SimTransport]uint16
+	ports      map[uint16]*simMapping
+}
+
+// Listen returns a transport for a host with a private address behind the
+// NAT.
+func (nat *SimNAT) Listen(private netip.AddrPort) (*SimTransport, error) {
+	nat.network.mu.Lock()
+	defer nat.network.mu.Unlock()
+
+	if nat.hosts[private] != nil {
+		return nil, ErrorAddressInUse
+	}
+
+	t := newSimTransport(nat.network, nat, private)
+	nat.hosts[private] = t
+	return t, nil
+}
+
+// outbound returns the public address of a packet from host to dst.
+func (nat *SimNAT) outbound(host *SimTransport, dst netip.AddrPort) (netip.AddrPort, error) {
+	port, ok := nat.mappings[host]
+
+	if !ok {
+		if nat.nextPort == 0 {
+			return netip.AddrPort{}, ErrorNATExhausted
+		}
+
+		port = nat.nextPort
+		nat.nextPort++
+		nat.mappings[host] = port
+		nat.ports[port] = &simMapping{host, make(map[netip.AddrPort]bool)}
+	}
+
+	nat.ports[port].contacted[dst] = true
+	return netip.AddrPortFrom(nat.public, port), nil
+}
+
+// inbound returns the host a packet from src to a public port is let
+// through to, if any.
+func (nat *SimNAT) inbound(src netip.AddrPort, port uint16) *SimTransport {
+	mapping := nat.ports[port]
+
+	if mapping == nil || (nat.restricted && !mapping.contacted[src]) {
+		return nil
+	}
+
+	return mapping.host
+}
+
+func (nat *SimNAT) remove(host *SimTransport) {
+	if port, ok := nat.mappings[host]; ok {
+		delete(nat.ports, port)
+		delete(nat.mappings, host)
+	}
+
+	delete(nat.hosts, host.addr)
+}
+
+type simPacket struct {
+	data []byte
+	from netip.AddrPort
+}
+
+// SimTransport is the Transport of a host on a SimNetwork.
+type SimTransport struct {
+	network   *SimNetwork
+	nat       *SimNAT
+	addr      netip.AddrPort
+	inbox     chan simPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newSimTransport(network *SimNetwork, nat *SimNAT, addr netip.AddrPort) *SimTransport {
+	return &SimTransport{
+		network: network,
+		nat:     nat,
+		addr:    addr,
+		inbox:   make(chan simPacket, simInboxSize),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (t *SimTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-t.inbox:
+		return copy(b, p.data), net.UDPAddrFromAddrPort(p.from), nil
+	case <-t.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (t *SimTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+
+	if !ok {
+		return 0, ErrorUnsupportedAddress
+	}
+
+	to := udpAddr.AddrPort()
+	to = netip.AddrPortFrom(to.Addr().Unmap(), to.Port())
+
+	data := make([]byte, len(b))
+	copy(data, b)
+
+	if err := t.network.send(t, data, to); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// LocalAddr returns the address of the host, which is private for hosts
+// behind a NAT.
+func (t *SimTransport) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(t.addr)
+}
+
+// Close drops the packets waiting in the inbox, which no server will handle.
+func (t *SimTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		t.network.remove(t)
+
+		for {
+			select {
+			case <-t.inbox:
+				t.network.handled(1)
+			default:
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// handled acknowledges a packet returned by ReadFrom, see SimNetwork.Settle.
+func (t *SimTransport) handled() {
+	t.network.handled(1)
+}
+
+func (t *SimTransport) deliver(p simPacket) {
+	// Counted first, so that the reader cannot acknowledge it before.
+	t.network.mu.Lock()
+	t.network.inFlight++
+	t.network.mu.Unlock()
+
+	select {
+	case <-t.closed:
+	case t.inbox <- p:
+		return
+	default:
+	}
+
+	t.network.handled(1)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	mrand "math/rand"
+	"net"
+	"net/netip"
+	"sort"
+	"testing"
+	"time"
+)
+
+func startSimServer(t *testing.T, transport Transport, config Config) (Server, LocalNode) {
+	localNode, err := NewLocalNode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServerWithTransport(transport, localNode, config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	t.Cleanup(func() { server.Close() })
+	return server, localNode
+}
+
+// newSimNetwork creates a network that is closed with the test.
+func newSimNetwork(t *testing.T, config SimConfig) *SimNetwork {
+	network := NewSimNetwork(config)
+	t.Cleanup(network.Close)
+	return network
+}
+
+func listenSim(t *testing.T, network *SimNetwork, addr string) *SimTransport {
+	transport, err := network.Listen(netip.MustParseAddrPort(addr))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return transport
+}
+
+func TestSimulatedDiscovery(t *testing.T) {
+	const (
+		numNodes = 30
+		step     = 10 * time.Millisecond
+		duration = 2 * time.Second
+	)
+
+	clock := NewManualClock(time.Now())
+	network := newSimNetwork(t, SimConfig{Latency: 2 * time.Millisecond, Jitter: 2 * time.Millisecond, Seed: 1, Clock: clock})
+	bootnode, bootNode := startSimServer(t, listenSim(t, network, "10.0.0.1:30303"), Config{Clock: clock})
+	bootEnode := NewEnode(bootNode.GetId(), remoteNodeOf(bootnode).address, 0)
+
+	var servers []Server
+	for i := 2; i <= numNodes; i++ {
+		addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 30303)
+		server, _ := startSimServer(t, listenSim(t, network, addr.String()),
+			Config{Clock: clock, Bootnodes: []*Enode{bootEnode}})
+		servers = append(servers, server)
+	}
+
+	// Every node starts with a refresh, which only reaches the other nodes
+	// through the bootnode. Time only passes once the servers have handled
+	// what was delivered, so a slow machine sees the same simulation.
+	for elapsed := time.Duration(0); elapsed < duration; elapsed += step {
+		network.Settle()
+		network.Advance(step)
+	}
+
+	network.Settle()
+
+	for i, server := range servers {
+		if n := server.(*serverImpl).table.Len(); n < bucketSize/2 {
+			t.Error("Node did not discover enough nodes", i+2, n)
+		}
+	}
+}
+
+func TestSimulatedLoss(t *testing.T) {
+	network := newSimNetwork(t, SimConfig{LossRate: 1})
+	a, _ := startSimServer(t, listenSim(t, network, "10.0.0.1:30303"), Config{})
+	b, _ := startSimServer(t, listenSim(t, network, "10.0.0.2:30303"), Config{})
+
+	if _, err := a.Ping(context.Background(), remoteNodeOf(b)); err != ErrorTimeout {
+		t.Error("Expected ping to be lost", err)
+	}
+}
+
+func TestSimulatedReordering(t *testing.T) {
+	const (
+		numPackets = 50
+		jitter     = 20 * time.Millisecond
+		seed       = 1
+	)
+
+	// Packets arrive in order of their jitter, which is drawn from the seed
+	// in send order. Packets with the same jitter keep their send order.
+	rand := mrand.New(mrand.NewSource(seed))
+	delays := make([]int64, numPackets)
+	expected := make([]byte, numPackets)
+
+	for i := range delays {
+		delays[i] = rand.Int63n(int64(jitter))
+		expected[i] = byte(i)
+	}
+
+	sort.SliceStable(expected, func(i, j int) bool {
+		return delays[expected[i]] < delays[expected[j]]
+	})
+
+	network := newSimNetwork(t, SimConfig{Jitter: jitter, Seed: seed, Clock: NewManualClock(time.Now())})
+	a := listenSim(t, network, "10.0.0.1:30303")
+	b := listenSim(t, network, "10.0.0.2:30303")
+
+	for i := 0; i < numPackets; i++ {
+		if _, err := a.WriteTo([]byte{byte(i)}, b.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := network.InFlight(); n != 0 {
+		t.Fatal("Expected no delivery before the clock advances", n)
+	}
+
+	network.Advance(jitter)
+
+	if n := network.InFlight(); n != numPackets {
+		t.Fatal("Expected every packet to be delivered", n)
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	var received []byte
+
+	for i := 0; i < numPackets; i++ {
+		_, from, err := b.ReadFrom(buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if from.String() != "10.0.0.1:30303" {
+			t.Error("Unexpected sender", from)
+		}
+
+		received = append(received, buf[0])
+	}
+
+	if string(received) != string(expected) {
+		t.Error("Unexpected delivery order", received, expected)
+	}
+
+	if sort.SliceIsSorted(received, func(i, j int) bool { return received[i] < received[j] }) {
+		t.Error("Expected jitter to reorder packets")
+	}
+}
+
+func TestSimulatedSettle(t *testing.T) {
+	network := newSimNetwork(t, SimConfig{Latency: time.Millisecond, Clock: NewManualClock(time.Now())})
+	server, _ := startSimServer(t, listenSim(t, network, "10.0.0.1:30303"), Config{})
+	peer := listenSim(t, network, "10.0.0.2:30303")
+
+	if _, err := peer.WriteTo([]byte("not a packet"), remoteNodeOf(server).address); err != nil {
+		t.Fatal(err)
+	}
+
+	network.Advance(time.Millisecond)
+	network.Settle()
+
+	if n := network.InFlight(); n != 0 {
+		t.Error("Expected the server to acknowledge the packet", n)
+	}
+}
+
+func TestSimulatedNAT(t *testing.T) {
+	for _, restricted := range []bool{true, false} {
+		network := newSimNetwork(t, SimConfig{})
+		nat := network.AddNAT(netip.MustParseAddr("2.2.2.2"), restricted)
+		private, err := nat.Listen(netip.MustParseAddrPort("192.168.0.2:30303"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		natted, _ := startSimServer(t, private, Config{})
+		public, _ := startSimServer(t, listenSim(t, network, "1.1.1.1:30303"), Config{})
+		other, _ := startSimServer(t, listenSim(t, network, "3.3.3.3:30303"), Config{})
+
+		// The pong comes back through the mapping created by the ping.
+		pong, err := natted.Ping(context.Background(), remoteNodeOf(public))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mapped := &RemoteNode{address: net.UDPAddrFromAddrPort(
+			netip.AddrPortFrom(netip.MustParseAddr("2.2.2.2"), simNATFirstPort))}
+
+		if pong.to.UDPAddr() != mapped.address.AddrPort() {
+			t.Error("Expected pong to report the public address", pong.to.UDPAddr())
+		}
+
+		if _, err := public.Ping(context.Background(), mapped); err != nil {
+			t.Error("Expected contacted node to reach the NAT", err)
+		}
+
+		_, err = other.Ping(context.Background(), mapped)
+
+		if restricted && err != ErrorTimeout {
+			t.Error("Expected restricted NAT to drop unsolicited ping", err)
+		}
+
+		if !restricted && err != nil {
+			t.Error("Expected full cone NAT to let ping through", err)
+		}
+	}
+}
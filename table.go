@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"math/bits"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	nBuckets          = 17
+	bucketMinDistance = hashLength*8 - nBuckets
+	maxReplacements   = 10
+
+	// Limits on nodes from the same /24 subnet, which make it expensive to
+	// fill a table with nodes controlled by one party.
+	tableSubnet   = 24
+	bucketIPLimit = 2
+	tableIPLimit  = 10
+)
+
+type tableNode struct {
+	enode          *Enode
+	hash           []byte
+	ip             net.IP
+	addedAt        time.Time
+	lastSeen       time.Time
+	livenessChecks int
+}
+
+// bucket holds nodes ordered from most to least recently seen, plus a list of
+// replacements used when an entry fails revalidation.
+type bucket struct {
+	entries      []*tableNode
+	replacements []*tableNode
+	ips          *distinctNetSet
+}
+
+// Table is a Kademlia routing table keyed by the keccak256 hash of node ids.
+// Nodes closer than bucketMinDistance all share the first bucket since they
+// are rare in practice.
+type Table struct {
+	mu      sync.Mutex
+	self    []byte
+	buckets [nBuckets]*bucket
+	ips     *distinctNetSet
+	clock   Clock
+	rand    *rand.Rand
+}
+
+func NewTable(selfId []byte, clock Clock) *Table {
+	t := &Table{
+		self:  Keccak256(selfId),
+		ips:   newDistinctNetSet(tableSubnet, tableIPLimit),
+		clock: clock,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for i := range t.buckets {
+		t.buckets[i] = &bucket{ips: newDistinctNetSet(tableSubnet, bucketIPLimit)}
+	}
+
+	return t
+}
+
+// logDistance returns the number of the highest bit in which a and b differ.
+func logDistance(a, b []byte) int {
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x != 0 {
+			return (len(a)-i-1)*8 + bits.Len8(x)
+		}
+	}
+
+	return 0
+}
+
+// closerTo reports whether a is closer to target than b.
+func closerTo(target, a, b []byte) bool {
+	for i := range target {
+		da := a[i] ^ target[i]
+		db := b[i] ^ target[i]
+
+		if da != db {
+			return da < db
+		}
+	}
+
+	return false
+}
+
+func (t *Table) bucketFor(hash []byte) *bucket {
+	d := logDistance(t.self, hash)
+
+	if d <= bucketMinDistance {
+		return t.buckets[0]
+	}
+
+	return t.buckets[d-bucketMinDistance-1]
+}
+
+func indexOf(nodes []*tableNode, id string) int {
+	for i, n := range nodes {
+		if n.enode.id == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func removeAt(nodes []*tableNode, i int) []*tableNode {
+	return append(nodes[:i], nodes[i+1:]...)
+}
+
+func (t *Table) newTableNode(node *Enode) *tableNode {
+	now := t.clock.Now()
+	return &tableNode{
+		enode:    node,
+		hash:     Keccak256([]byte(node.id)),
+		ip:       net.ParseIP(node.host),
+		addedAt:  now,
+		lastSeen: now,
+	}
+}
+
+func (t *Table) isSelf(n *tableNode) bool {
+	return bytes.Equal(n.hash, t.self)
+}
+
+// addIP counts a node's IP against the bucket and table limits and reports
+// whether it is within them.
+func (t *Table) addIP(b *bucket, ip net.IP) bool {
+	if !t.ips.add(ip) {
+		return false
+	}
+
+	if !b.ips.add(ip) {
+		t.ips.remove(ip)
+		return false
+	}
+
+	return true
+}
+
+func (t *Table) removeIP(b *bucket, ip net.IP) {
+	t.ips.remove(ip)
+	b.ips.remove(ip)
+}
+
+func (t *Table) addReplacement(b *bucket, n *tableNode) {
+	if indexOf(b.replacements, n.enode.id) >= 0 || !t.addIP(b, n.ip) {
+		return
+	}
+
+	b.replacements = append([]*tableNode{n}, b.replacements...)
+
+	if len(b.replacements) > maxReplacements {
+		t.removeIP(b, b.replacements[maxReplacements].ip)
+		b.replacements = b.replacements[:maxReplacements]
+	}
+}
+
+// AddSeen adds a node learned about from another node. It is appended to the
+// back of its bucket since it has not been contacted yet.
+func (t *Table) AddSeen(node *Enode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.newTableNode(node)
+
+	if t.isSelf(n) {
+		return
+	}
+
+	b := t.bucketFor(n.hash)
+
+	if indexOf(b.entries, node.id) >= 0 {
+		return
+	}
+
+	if len(b.entries) >= bucketSize {
+		t.addReplacement(b, n)
+	} else if t.addIP(b, n.ip) {
+		b.entries = append(b.entries, n)
+	}
+}
+
+// AddVerified adds a node that has proven to be alive, moving it to the front
+// of its bucket.
+func (t *Table) AddVerified(node *Enode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.newTableNode(node)
+
+	if t.isSelf(n) {
+		return
+	}
+
+	b := t.bucketFor(n.hash)
+
+	if i := indexOf(b.entries, node.id); i >= 0 {
+		n = b.entries[i]
+		n.lastSeen = t.clock.Now()
+		b.entries = removeAt(b.entries, i)
+
+		// A fetched record replaces what we knew, the address stays.
+		if node.record != nil && node.host == n.enode.host {
+			n.enode = node
+		}
+	} else if len(b.entries) >= bucketSize {
+		t.addReplacement(b, n)
+		return
+	} else if !t.addIP(b, n.ip) {
+		return
+	}
+
+	b.entries = append([]*tableNode{n}, b.entries...)
+}
+
+// nodeToRevalidate returns the least recently seen node of a random
+// non-empty bucket, or nil if the table is empty.
+func (t *Table) nodeToRevalidate() *Enode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var candidates []*bucket
+	for _, b := range t.buckets {
+		if len(b.entries) > 0 {
+			candidates = append(candidates, b)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	b := candidates[t.rand.Intn(len(candidates))]
+	return b.entries[len(b.entries)-1].enode
+}
+
+// revalidated records the outcome of a liveness check. A live node moves to
+// the front of its bucket, a dead one is replaced by a random replacement.
+func (t *Table) revalidated(node *Enode, alive bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(Keccak256([]byte(node.id)))
+	i := indexOf(b.entries, node.id)
+
+	if i < 0 {
+		return
+	}
+
+	n := b.entries[i]
+	b.entries = removeAt(b.entries, i)
+
+	if alive {
+		n.lastSeen = t.clock.Now()
+		n.livenessChecks++
+		b.entries = append([]*tableNode{n}, b.entries...)
+		return
+	}
+
+	t.removeIP(b, n.ip)
+
+	// Replacements are already counted against the IP limits.
+	if len(b.replacements) > 0 {
+		r := t.rand.Intn(len(b.replacements))
+		b.entries = append(b.entries, b.replacements[r])
+		b.replacements = removeAt(b.replacements, r)
+	}
+}
+
+// Closest returns up to n nodes closest to the given target hash.
+func (t *Table) Closest(targetHash []byte, n int) []*Enode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var all []*tableNode
+	for _, b := range t.buckets {
+		all = append(all, b.entries...)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return closerTo(targetHash, all[i].hash, all[j].hash)
+	})
+
+	var result []*Enode
+	for i := 0; i < len(all) && i < n; i++ {
+		result = append(result, all[i].enode)
+	}
+
+	return result
+}
+
+// AtDistance returns up to n nodes at the given log distance from us.
+func (t *Table) AtDistance(d, n int) []*Enode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var result []*Enode
+	for _, b := range t.buckets {
+		for _, entry := range b.entries {
+			if len(result) < n && logDistance(t.self, entry.hash) == d {
+				result = append(result, entry.enode)
+			}
+		}
+	}
+
+	return result
+}
+
+func (t *Table) Contains(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(Keccak256([]byte(id)))
+	return indexOf(b.entries, id) >= 0
+}
+
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b.entries)
+	}
+
+	return n
+}
+
+// Remove deletes a node from the table, e.g. after repeated failures.
+func (t *Table) Remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(Keccak256([]byte(id)))
+
+	if i := indexOf(b.entries, id); i >= 0 {
+		t.removeIP(b, b.entries[i].ip)
+		b.entries = removeAt(b.entries, i)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand"
+	"time"
+)
+
+const (
+	defaultRevalidateInterval = 10 * time.Second
+	defaultRefreshInterval    = 30 * time.Minute
+	randomLookupsPerRefresh   = 3
+)
+
+// revalidateDelay is a random delay of up to interval, which withDefaults
+// keeps positive.
+func revalidateDelay(interval time.Duration) time.Duration {
+	return time.Duration(mrand.Int63n(int64(interval)))
+}
+
+// revalidateLoop periodically checks that the least recently seen node of a
+// random bucket is still alive, replacing it if it is not.
+func (s *serverImpl) revalidateLoop() {
+	for {
+		delay := revalidateDelay(s.config.RevalidateInterval)
+
+		select {
+		case <-s.clock.After(delay):
+		case <-s.closed:
+			return
+		}
+
+		s.revalidate()
+	}
+}
+
+func (s *serverImpl) revalidate() {
+	node := s.table.nodeToRevalidate()
+
+	if node == nil {
+		return
+	}
+
+	remote, err := node.RemoteNode()
+
+	if err == nil {
+		_, err = s.Ping(s.ctx, remote)
+	}
+
+	// The node is not to blame for our own shutdown.
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	if err != nil {
+		fmt.Println("Revalidation failed, evicting node", err)
+	}
+
+	s.table.revalidated(node, err == nil)
+}
+
+// refreshLoop fills the table by looking up our own id, which finds our
+// closest neighbors, and a few random targets, which fill the far buckets.
+func (s *serverImpl) refreshLoop() {
+	for {
+		s.refresh()
+
+		select {
+		case <-s.clock.After(s.config.RefreshInterval):
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *serverImpl) refresh() {
+	ctx := s.ctx
+
+	// Fall back to the bootnodes if every node has been lost.
+	if s.table.Len() == 0 {
+		for _, node := range s.config.Bootnodes {
+			s.table.AddSeen(node)
+		}
+	}
+	s.Lookup(ctx, s.localNode.GetId())
+
+	for i := 0; i < randomLookupsPerRefresh; i++ {
+		target := make([]byte, len(s.localNode.GetId()))
+		rand.Read(target)
+		s.Lookup(ctx, target)
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+
+	fmt.Println("Refreshed table. Size", s.table.Len())
+}
+
+// dbLoop writes the node database to disk and expires stale nodes. The final
+// flush is left to Close.
+func (s *serverImpl) dbLoop() {
+	expire := s.clock.After(nodeDBExpireInterval)
+
+	for {
+		select {
+		case <-s.clock.After(nodeDBFlushInterval):
+		case <-expire:
+			s.db.Expire()
+			expire = s.clock.After(nodeDBExpireInterval)
+		case <-s.closed:
+			return
+		}
+
+		if err := s.db.Flush(); err != nil {
+			fmt.Println("Failed to flush node database", err)
+		}
+	}
+}
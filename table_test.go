@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLogDistance(t *testing.T) {
+	a := make([]byte, hashLength)
+	b := make([]byte, hashLength)
+
+	if logDistance(a, b) != 0 {
+		t.Error("Expected distance 0 for equal hashes")
+	}
+
+	b[hashLength-1] = 0x01
+	if logDistance(a, b) != 1 {
+		t.Error("Expected distance 1")
+	}
+
+	b[0] = 0x80
+	if logDistance(a, b) != 256 {
+		t.Error("Expected distance 256")
+	}
+}
+
+func TestRevalidationReplacesDeadNode(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	localNode, _ := NewLocalNode()
+	server, err := NewServer("127.0.0.1:0", localNode, Config{
+		RevalidateInterval: time.Second,
+		Clock:              clock,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Start(context.Background())
+	defer server.Close()
+
+	table := server.(*serverImpl).table
+
+	// Nothing answers on this socket.
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer silent.Close()
+
+	deadNode, _ := NewLocalNode()
+	dead := NewEnode(deadNode.GetId(), silent.LocalAddr().(*net.UDPAddr), 0)
+	table.AddSeen(dead)
+
+	alive, aliveNode := startTestServer(t)
+	replacement := NewEnode(aliveNode.GetId(), remoteNodeOf(alive).address, 0)
+	table.mu.Lock()
+	b := table.bucketFor(Keccak256([]byte(dead.id)))
+	b.replacements = append(b.replacements, table.newTableNode(replacement))
+	table.mu.Unlock()
+
+	for i := 0; i < 200; i++ {
+		if !table.Contains(dead.id) && table.Contains(replacement.id) {
+			return
+		}
+
+		clock.Advance(time.Second)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Error("Dead node was not replaced")
+}
+
+func TestNonPositiveIntervals(t *testing.T) {
+	config, err := Config{RevalidateInterval: -time.Second, RefreshInterval: -time.Second}.withDefaults()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.RevalidateInterval != defaultRevalidateInterval || config.RefreshInterval != defaultRefreshInterval {
+		t.Error("Expected defaults for negative intervals", config.RevalidateInterval, config.RefreshInterval)
+	}
+
+	if delay := revalidateDelay(config.RevalidateInterval); delay < 0 || delay >= config.RevalidateInterval {
+		t.Error("Unexpected delay", delay)
+	}
+}
+
+func TestTableIPLimits(t *testing.T) {
+	localNode, _ := NewLocalNode()
+	table := NewTable(localNode.GetId(), systemClock{})
+
+	for i := 0; i < 3*tableIPLimit; i++ {
+		node, _ := NewLocalNode()
+		table.AddSeen(NewEnode(node.GetId(), &net.UDPAddr{IP: net.IPv4(1, 2, 3, byte(i)), Port: 30303}, 0))
+	}
+
+	if table.Len() > tableIPLimit {
+		t.Error("Table exceeds subnet limit", table.Len())
+	}
+
+	for _, b := range table.buckets {
+		if len(b.entries) > bucketIPLimit {
+			t.Error("Bucket exceeds subnet limit", len(b.entries))
+		}
+	}
+
+	// LAN addresses are not limited. Few enough are added that no bucket
+	// can overflow.
+	before := table.Len()
+	for i := 0; i < bucketSize/2; i++ {
+		node, _ := NewLocalNode()
+		table.AddSeen(NewEnode(node.GetId(), &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 30303}, 0))
+	}
+
+	if table.Len() != before+bucketSize/2 {
+		t.Error("Expected LAN nodes to be exempt from subnet limits", table.Len())
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import "net"
+
+// Transport sends and receives the packets of a server. Addresses are
+// *net.UDPAddr values. It is implemented by UDP sockets and by SimNetwork.
+type Transport interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// handledTransport is a Transport that is told when each packet read from
+// it has been handled or dropped, see SimNetwork.Settle.
+type handledTransport interface {
+	Transport
+	handled()
+}
+
+// packetHandled acknowledges a packet read from t, if t wants to know.
+func packetHandled(t Transport) {
+	if t, ok := t.(handledTransport); ok {
+		t.handled()
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+type writePriority int
+
+const (
+	// Replies are answers to requests from other nodes. They are written
+	// before any of our own requests, which can wait without harm.
+	priorityReply writePriority = iota
+	priorityRequest
+)
+
+type outboundPacket struct {
+	data      []byte
+	to        *net.UDPAddr
+	priority  writePriority
+	intercept bool
+	done      chan error
+}
+
+// priorityTransport is a transport that queues writes by priority itself, as
+// sharedTransport does. The writer passes the priority of each packet on.
+type priorityTransport interface {
+	writeWithPriority(priority writePriority, data []byte, to *net.UDPAddr) error
+}
+
+// packetWriter is the only writer to the UDP socket. Packets are written one
+// at a time within the configured egress budget. Callers block while the
+// queue for their priority is full.
+type packetWriter struct {
+	socket   Transport
+	replies  chan *outboundPacket
+	requests chan *outboundPacket
+	closed   chan struct{}
+
+	// interceptors see packets before they are paced and written.
+	interceptors []Interceptor
+
+	// Budgets in packets and bytes per second. Zero means unlimited.
+	packetRate float64
+	byteRate   float64
+	packets    tokenBucket
+	bytes      tokenBucket
+}
+
+func newPacketWriter(socket Transport, queueSize int, packetRate, byteRate float64,
+	interceptors []Interceptor) *packetWriter {
+	now := time.Now()
+
+	w := &packetWriter{
+		socket:       socket,
+		replies:      make(chan *outboundPacket, queueSize),
+		requests:     make(chan *outboundPacket, queueSize),
+		closed:       make(chan struct{}),
+		packetRate:   packetRate,
+		byteRate:     byteRate,
+		interceptors: interceptors,
+	}
+
+	w.packets = tokenBucket{w.packetBurst(), now}
+	w.bytes = tokenBucket{w.byteBurst(), now}
+
+	return w
+}
+
+// Bursts allow a tenth of a second worth of traffic at once, and always at
+// least one full sized packet.
+func (w *packetWriter) packetBurst() float64 {
+	if w.packetRate < 10 {
+		return 1
+	}
+
+	return w.packetRate / 10
+}
+
+func (w *packetWriter) byteBurst() float64 {
+	if w.byteRate < 10*maxDatagramSize {
+		return maxDatagramSize
+	}
+
+	return w.byteRate / 10
+}
+
+// close stops the writer loop and fails writes that are waiting.
+func (w *packetWriter) close() {
+	close(w.closed)
+}
+
+// write queues a packet and waits until it has been written.
+func (w *packetWriter) write(ctx context.Context, priority writePriority, data []byte, to *net.UDPAddr) error {
+	return w.enqueue(ctx, priority, &outboundPacket{data, to, priority, true, make(chan error, 1)})
+}
+
+// writeOther queues a datagram of another protocol sharing the socket, see
+// sharedTransport. It is paced like our own packets but not intercepted.
+func (w *packetWriter) writeOther(ctx context.Context, priority writePriority, data []byte, to *net.UDPAddr) error {
+	return w.enqueue(ctx, priority, &outboundPacket{data, to, priority, false, make(chan error, 1)})
+}
+
+func (w *packetWriter) enqueue(ctx context.Context, priority writePriority, p *outboundPacket) error {
+	queue := w.requests
+
+	if priority == priorityReply {
+		queue = w.replies
+	}
+
+	select {
+	case queue <- p:
+	case <-w.closed:
+		return ErrorServerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-p.done:
+		return err
+	case <-w.closed:
+		return ErrorServerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *packetWriter) loop() {
+	for {
+		var p *outboundPacket
+
+		select {
+		case p = <-w.replies:
+		default:
+			select {
+			case p = <-w.replies:
+			case p = <-w.requests:
+			case <-w.closed:
+				return
+			}
+		}
+
+		data := p.data
+
+		if p.intercept {
+			data = interceptOutbound(w.interceptors, data, p.to)
+		}
+
+		// A dropped packet is lost on the way as far as the caller knows.
+		if data == nil {
+			p.done <- nil
+			continue
+		}
+
+		w.pace(len(data))
+		p.done <- w.writeTo(p.priority, data, p.to)
+	}
+}
+
+func (w *packetWriter) writeTo(priority writePriority, data []byte, to *net.UDPAddr) error {
+	if socket, ok := w.socket.(priorityTransport); ok {
+		return socket.writeWithPriority(priority, data, to)
+	}
+
+	_, err := w.socket.WriteTo(data, to)
+	return err
+}
+
+// pace charges a packet of the given size to the budgets and sleeps until
+// they are no longer overdrawn. Pacing uses the system clock, since it is
+// about the real link rather than protocol time.
+func (w *packetWriter) pace(size int) {
+	now := time.Now()
+	var wait time.Duration
+
+	if w.packetRate > 0 {
+		wait = take(&w.packets, 1, w.packetRate, w.packetBurst(), now)
+	}
+
+	if w.byteRate > 0 {
+		if d := take(&w.bytes, float64(size), w.byteRate, w.byteBurst(), now); d > wait {
+			wait = d
+		}
+	}
+
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-w.closed:
+		}
+	}
+}
+
+// take removes n tokens from the bucket, going into debt if needed, and
+// returns how long it takes to pay the debt back.
+func take(b *tokenBucket, n, rate, burst float64, now time.Time) time.Duration {
+	b.refill(now, rate, burst)
+	b.tokens -= n
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
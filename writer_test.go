@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenTestSocket(t *testing.T) *net.UDPConn {
+	socket, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { socket.Close() })
+	return socket
+}
+
+func TestWriterRepliesFirst(t *testing.T) {
+	sender := listenTestSocket(t)
+	receiver := listenTestSocket(t)
+	to := receiver.LocalAddr().(*net.UDPAddr)
+	writer := newPacketWriter(sender, 4, -1, -1, nil)
+
+	// Queue before the loop runs, so that the writer sees both queues full.
+	results := make(chan error, 4)
+	for _, p := range []struct {
+		priority writePriority
+		data     string
+	}{{priorityRequest, "q1"}, {priorityRequest, "q2"}, {priorityReply, "r1"}, {priorityReply, "r2"}} {
+		p := p
+		go func() {
+			results <- writer.write(context.Background(), p.priority, []byte(p.data), to)
+		}()
+	}
+
+	for len(writer.requests)+len(writer.replies) < 4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	go writer.loop()
+
+	buf := make([]byte, maxDatagramSize)
+	var order []string
+
+	for i := 0; i < 4; i++ {
+		n, _, err := receiver.ReadFromUDP(buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		order = append(order, string(buf[:n]))
+
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if order[0][0] != 'r' || order[1][0] != 'r' {
+		t.Error("Expected replies before requests", order)
+	}
+}
+
+func TestWriterEgressRate(t *testing.T) {
+	sender := listenTestSocket(t)
+	receiver := listenTestSocket(t)
+	to := receiver.LocalAddr().(*net.UDPAddr)
+
+	// Two packets of burst, then one packet every 50ms.
+	writer := newPacketWriter(sender, 4, 20, -1, nil)
+	go writer.loop()
+
+	start := time.Now()
+
+	for i := 0; i < 5; i++ {
+		if err := writer.write(context.Background(), priorityRequest, []byte("ping"), to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Error("Packets written faster than the egress budget", elapsed)
+	}
+}